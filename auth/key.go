@@ -0,0 +1,283 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	`crypto/ed25519`
+	`crypto/hmac`
+	`crypto/rand`
+	`crypto/sha256`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`regexp`
+	`time`
+)
+
+const (
+	Ed25519			string		= `ed25519`
+	HMACSHA256		string		= `hmac-sha256`
+
+	hmacKeySize		int		= 32
+	secretFileMode		os.FileMode	= 0600
+	secretDirMode		os.FileMode	= 0700
+)
+
+var (
+	ErrUnknownKey	= errors.New(`unknown key`)
+	ErrKeyExpired	= errors.New(`key expired or revoked`)
+	ErrBadSignature	= errors.New(`bad signature`)
+
+	keyIDRgx	= regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// Key is the verification half of an agent key, enrolled on the server
+// for a single host. For Ed25519 keys Public is the public key; for
+// HMAC-SHA256 keys it is the shared secret, so a keyring holding HMAC keys
+// must be protected like the agents' identities. A key with a non-zero
+// Expires time stops verifying at that time, as does a revoked key.
+type Key struct {
+	ID		string		`json:"id"`
+	Host		string		`json:"host"`
+	Algorithm	string		`json:"algorithm"`
+	Public		[]byte		`json:"public"`
+	Created		time.Time	`json:"created"`
+	Expires		time.Time	`json:"expires"`
+	Revoked		bool		`json:"revoked"`
+}
+
+// Verify checks that the key is well formed.
+func (this *Key) Verify() (error) {
+
+	if !keyIDRgx.MatchString(this.ID) {
+		return fmt.Errorf(`key id %q: invalid`, this.ID)
+	}
+	if this.Host == `` {
+		return fmt.Errorf(`key %s: missing host`, this.ID)
+	}
+
+	switch this.Algorithm {
+
+	case Ed25519:
+		if len(this.Public) != ed25519.PublicKeySize {
+			return fmt.Errorf(`key %s: ed25519 public key must be %d bytes`, this.ID, ed25519.PublicKeySize)
+		}
+
+	case HMACSHA256:
+		if len(this.Public) < hmacKeySize {
+			return fmt.Errorf(`key %s: hmac secret must be at least %d bytes`, this.ID, hmacKeySize)
+		}
+
+	default:
+		return fmt.Errorf(`key %s: unknown algorithm %q`, this.ID, this.Algorithm)
+	}
+
+	return nil
+}
+
+// Active reports whether the key verifies signatures at a given time.
+func (this *Key) Active(t time.Time) (bool) {
+	return !this.Revoked && (this.Expires.IsZero() || t.Before(this.Expires))
+}
+
+// Check verifies a signature of a message.
+func (this *Key) Check(msg, sig []byte) (error) {
+
+	switch this.Algorithm {
+
+	case Ed25519:
+		if len(this.Public) == ed25519.PublicKeySize && ed25519.Verify(this.Public, msg, sig) {
+			return nil
+		}
+
+	case HMACSHA256:
+		if hmac.Equal(macSHA256(this.Public, msg), sig) {
+			return nil
+		}
+	}
+
+	return ErrBadSignature
+}
+
+// Identity is an agent's signing key. It is created on the agent, its Key
+// is enrolled with the server, and it is replaced by a new identity when
+// the key is rotated.
+type Identity struct {
+	KeyID		string		`json:"key_id"`
+	Host		string		`json:"host"`
+	Algorithm	string		`json:"algorithm"`
+	Private		[]byte		`json:"private"`
+	Created		time.Time	`json:"created"`
+	Enrolled	bool		`json:"enrolled"`
+}
+
+// NewIdentity generates a new signing key for a host.
+func NewIdentity(host, alg string) (*Identity, error) {
+
+	this := &Identity{Host: host, Algorithm: alg, Created: time.Now()}
+
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	this.KeyID = hex.EncodeToString(id)
+
+	switch alg {
+
+	case Ed25519:
+		if _, priv, err := ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		} else {
+			this.Private = priv
+		}
+
+	case HMACSHA256:
+		this.Private = make([]byte, hmacKeySize)
+		if _, err := rand.Read(this.Private); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf(`unknown algorithm %q`, alg)
+	}
+
+	return this, nil
+}
+
+// LoadIdentity reads an identity from a file.
+func LoadIdentity(fn string) (*Identity, error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &Identity{}
+
+	if err := json.Unmarshal(j, this); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	if err := this.Key().Verify(); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return this, nil
+}
+
+// Save writes the identity to a file readable only by its owner.
+func (this *Identity) Save(fn string) (error) {
+
+	j, err := json.Marshal(this)
+
+	if err != nil {
+		return err
+	}
+
+	return writeSecret(fn, j)
+}
+
+// Key returns the verification key to enroll for the identity.
+func (this *Identity) Key() (*Key) {
+
+	k := &Key{
+		ID:		this.KeyID,
+		Host:		this.Host,
+		Algorithm:	this.Algorithm,
+		Created:	this.Created,
+	}
+
+	switch this.Algorithm {
+
+	case Ed25519:
+		if len(this.Private) == ed25519.PrivateKeySize {
+			k.Public = ed25519.PrivateKey(this.Private).Public().(ed25519.PublicKey)
+		}
+
+	case HMACSHA256:
+		k.Public = this.Private
+	}
+
+	return k
+}
+
+// Sign signs a message.
+func (this *Identity) Sign(msg []byte) ([]byte, error) {
+
+	switch this.Algorithm {
+
+	case Ed25519:
+		if len(this.Private) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf(`key %s: invalid ed25519 private key`, this.KeyID)
+		}
+		return ed25519.Sign(this.Private, msg), nil
+
+	case HMACSHA256:
+		return macSHA256(this.Private, msg), nil
+
+	default:
+		return nil, fmt.Errorf(`key %s: unknown algorithm %q`, this.KeyID, this.Algorithm)
+	}
+}
+
+// macSHA256 returns the HMAC-SHA256 of a message.
+func macSHA256(key, msg []byte) ([]byte) {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// writeSecret atomically replaces a file with data readable only by its
+// owner.
+func writeSecret(fn string, data []byte) (error) {
+
+	if err := os.MkdirAll(filepath.Dir(fn), secretDirMode); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), `.tmp-`)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), secretFileMode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
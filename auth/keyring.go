@@ -0,0 +1,244 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`sort`
+	`sync`
+	`time`
+)
+
+var (
+	ErrKeyExists	= errors.New(`key already enrolled`)
+	ErrHostEnrolled	= errors.New(`host already has an active key`)
+)
+
+// Keyring holds the keys enrolled for agents, persisted as JSON to a file
+// readable only by its owner. A keyring without a file is kept in memory.
+type Keyring struct {
+	File		string
+
+	mu		sync.RWMutex
+	keys		map[string]*Key
+}
+
+// NewKeyring instantiates a Keyring, loading the keys in a file if it
+// exists.
+func NewKeyring(fn string) (*Keyring, error) {
+
+	this := &Keyring{File: fn, keys: make(map[string]*Key)}
+
+	if fn == `` {
+		return this, nil
+	}
+
+	j, err := ioutil.ReadFile(fn)
+
+	if os.IsNotExist(err) {
+		return this, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+
+	if err := json.Unmarshal(j, &keys); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	for _, k := range keys {
+		if err := k.Verify(); err != nil {
+			return nil, fmt.Errorf(`%s: %v`, fn, err)
+		}
+		this.keys[k.ID] = k
+	}
+
+	return this, nil
+}
+
+// Get returns a copy of the key with a given ID.
+func (this *Keyring) Get(id string) (*Key, error) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if k, ok := this.keys[id]; !ok {
+		return nil, ErrUnknownKey
+	} else {
+		kc := *k
+		return &kc, nil
+	}
+}
+
+// Keys returns copies of the keys enrolled for a host, or of all keys if
+// host is empty, ordered by creation time.
+func (this *Keyring) Keys(host string) (keys []*Key) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for _, k := range this.keys {
+		if host == `` || k.Host == host {
+			kc := *k
+			keys = append(keys, &kc)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) (bool) {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	return keys
+}
+
+// Enroll adds a key for a host that has no active key.
+func (this *Keyring) Enroll(k *Key) (error) {
+
+	if err := k.Verify(); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.keys[k.ID]; ok {
+		return ErrKeyExists
+	}
+
+	now := time.Now()
+
+	for _, ek := range this.keys {
+		if ek.Host == k.Host && ek.Active(now) {
+			return ErrHostEnrolled
+		}
+	}
+
+	return this.add(k)
+}
+
+// Rotate adds a key for the host of an active key and expires the old key
+// after a grace period, so that requests signed and spooled with it can
+// still be delivered.
+func (this *Keyring) Rotate(oldID string, k *Key, grace time.Duration) (error) {
+
+	if err := k.Verify(); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	old, ok := this.keys[oldID]
+
+	switch {
+	case !ok:
+		return ErrUnknownKey
+	case !old.Active(now):
+		return ErrKeyExpired
+	case old.Host != k.Host:
+		return fmt.Errorf(`key %s: host %q does not match %q`, k.ID, k.Host, old.Host)
+	}
+
+	if _, ok := this.keys[k.ID]; ok {
+		return ErrKeyExists
+	}
+
+	prev := old.Expires
+
+	if exp := now.Add(grace); prev.IsZero() || exp.Before(prev) {
+		old.Expires = exp
+	}
+
+	if err := this.add(k); err != nil {
+		old.Expires = prev
+		return err
+	}
+
+	return nil
+}
+
+// Revoke revokes a key immediately.
+func (this *Keyring) Revoke(id string) (error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	k, ok := this.keys[id]
+
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	k.Revoked = true
+
+	if err := this.save(); err != nil {
+		k.Revoked = false
+		return err
+	}
+
+	return nil
+}
+
+// add stores a new key and saves the keyring, undoing the addition if the
+// keyring cannot be saved. The caller must hold the lock.
+func (this *Keyring) add(k *Key) (error) {
+
+	kc := *k
+
+	if kc.Created.IsZero() {
+		kc.Created = time.Now()
+	}
+
+	this.keys[kc.ID] = &kc
+
+	if err := this.save(); err != nil {
+		delete(this.keys, kc.ID)
+		return err
+	}
+
+	return nil
+}
+
+// save writes the keyring to its file. The caller must hold the lock.
+func (this *Keyring) save() (error) {
+
+	if this.File == `` {
+		return nil
+	}
+
+	keys := make([]*Key, 0, len(this.keys))
+
+	for _, k := range this.keys {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) (bool) {
+		return keys[i].ID < keys[j].ID
+	})
+
+	j, err := json.MarshalIndent(keys, ``, "\t")
+
+	if err != nil {
+		return err
+	}
+
+	return writeSecret(this.File, j)
+}
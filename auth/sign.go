@@ -0,0 +1,127 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	`crypto/sha256`
+	`encoding/base64`
+	`encoding/hex`
+	`net/http`
+	`strconv`
+	`strings`
+	`time`
+)
+
+const (
+	HeaderHost		string	= `X-Cmdb-Host`
+	HeaderKeyID		string	= `X-Cmdb-Key-Id`
+	HeaderTimestamp		string	= `X-Cmdb-Timestamp`
+	HeaderSignature		string	= `X-Cmdb-Signature`
+
+	signatureVersion	string	= `cmdb-sig-v1`
+	idempotencyHeader	string	= `Idempotency-Key`
+)
+
+// Message returns the canonical form of a request that is signed. It
+// binds the method, path and query, the claimed host and key, the time of
+// signing, the idempotency key and a SHA-256 digest of the body as sent,
+// so a signed request cannot be altered, redirected to another resource
+// or attributed to another host.
+func Message(method, uri, host, keyID string, ts int64, idemKey string, body []byte) ([]byte) {
+
+	sum := sha256.Sum256(body)
+
+	return []byte(strings.Join([]string{
+		signatureVersion,
+		method,
+		uri,
+		host,
+		keyID,
+		strconv.FormatInt(ts, 10),
+		idemKey,
+		hex.EncodeToString(sum[:]),
+	}, "\n"))
+}
+
+// SignRequest adds signature headers to a request whose body, as it will
+// be sent, is body. The idempotency key header, if any, must already be
+// set.
+func (this *Identity) SignRequest(r *http.Request, body []byte) (error) {
+
+	ts := time.Now().Unix()
+
+	msg := Message(r.Method, r.URL.RequestURI(), this.Host, this.KeyID, ts,
+		r.Header.Get(idempotencyHeader), body)
+
+	sig, err := this.Sign(msg)
+
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set(HeaderHost, this.Host)
+	r.Header.Set(HeaderKeyID, this.KeyID)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	r.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// Signed reports whether a request carries a signature.
+func Signed(r *http.Request) (bool) {
+	return r.Header.Get(HeaderSignature) != ``
+}
+
+// signature holds the signature headers of a request.
+type signature struct {
+	host		string
+	keyID		string
+	ts		int64
+	sig		[]byte
+}
+
+// parseSignature reads the signature headers of a request.
+func parseSignature(r *http.Request) (*signature, error) {
+
+	this := &signature{
+		host:	r.Header.Get(HeaderHost),
+		keyID:	r.Header.Get(HeaderKeyID),
+	}
+
+	if this.host == `` || this.keyID == `` {
+		return nil, ErrBadSignature
+	}
+
+	if ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64); err != nil {
+		return nil, ErrBadSignature
+	} else {
+		this.ts = ts
+	}
+
+	if sig, err := base64.StdEncoding.DecodeString(r.Header.Get(HeaderSignature)); err != nil {
+		return nil, ErrBadSignature
+	} else {
+		this.sig = sig
+	}
+
+	return this, nil
+}
+
+// message returns the canonical form of a signed request.
+func (this *signature) message(r *http.Request, body []byte) ([]byte) {
+	return Message(r.Method, r.URL.RequestURI(), this.host, this.keyID, this.ts,
+		r.Header.Get(idempotencyHeader), body)
+}
+
@@ -0,0 +1,118 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	`crypto/tls`
+	`crypto/x509`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+)
+
+// ServerTLS returns a TLS configuration for a server certificate that
+// verifies client certificates issued by the CAs in caFile. If require is
+// false, clients without a certificate are still accepted.
+func ServerTLS(certFile, keyFile, caFile string, require bool) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &tls.Config{
+		Certificates:	[]tls.Certificate{cert},
+		MinVersion:	tls.VersionTLS12,
+	}
+
+	if caFile == `` {
+		return this, nil
+	}
+
+	if this.ClientCAs, err = loadPool(caFile); err != nil {
+		return nil, err
+	}
+
+	if require {
+		this.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		this.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return this, nil
+}
+
+// ClientTLS returns a TLS configuration that presents a client certificate,
+// if certFile is not empty, and verifies the server against the CAs in
+// caFile, if it is not empty, or the system roots.
+func ClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+
+	this := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != `` {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, err
+		} else {
+			this.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if caFile != `` {
+		if pool, err := loadPool(caFile); err != nil {
+			return nil, err
+		} else {
+			this.RootCAs = pool
+		}
+	}
+
+	return this, nil
+}
+
+// PeerHost returns the host named by a request's verified client
+// certificate: its first DNS name, or its common name if it has none. It
+// returns an empty string if the client presented no verified certificate.
+func PeerHost(r *http.Request) (string) {
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ``
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+
+	return cert.Subject.CommonName
+}
+
+// loadPool reads a PEM file of CA certificates.
+func loadPool(fn string) (*x509.CertPool, error) {
+
+	pem, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf(`%s: no certificates found`, fn)
+	}
+
+	return pool, nil
+}
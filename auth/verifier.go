@@ -0,0 +1,366 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	`bytes`
+	`context`
+	`crypto/subtle`
+	`encoding/base64`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`net/http`
+	`sync`
+	`time`
+)
+
+const (
+	DefaultSkew		time.Duration	= 5 * time.Minute
+	DefaultGrace		time.Duration	= 7 * 24 * time.Hour
+	DefaultMaxBody		int64		= 1 << 20
+
+	// Error codes sent with authentication failures that may succeed if
+	// the request is signed again later, once the clocks agree or the
+	// replay cache is back.
+	CodeStale		string		= `stale_signature`
+	CodeReplayed		string		= `replayed_signature`
+	CodeReplayCache		string		= `replay_cache_unavailable`
+)
+
+var (
+	ErrStale		= errors.New(`signature timestamp outside allowed skew`)
+	ErrReplayed		= errors.New(`signature already used`)
+	ErrHostMismatch		= errors.New(`signed host does not match client certificate`)
+	ErrUnauthorized		= errors.New(`authentication required`)
+	ErrForbidden		= errors.New(`not authorized for this host`)
+	ErrTooLarge		= errors.New(`request body too large`)
+)
+
+// Principal is the authenticated identity of a request: the host named by
+// a verified signature, a verified client certificate, or both.
+type Principal struct {
+	Host		string
+	KeyID		string
+	Certificate	bool
+}
+
+type principalKey struct{}
+
+// FromContext returns the principal of an authenticated request, or nil.
+func FromContext(ctx context.Context) (*Principal) {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// ReplayCache records the signatures a Verifier accepts. Remember records
+// a signature and reports whether it is new, that is, not recorded within
+// the last window. A cache that persists signatures keeps one captured
+// before a server restart from being accepted after it.
+type ReplayCache interface {
+	Remember(sig string, window time.Duration) (bool, error)
+}
+
+// Verifier authenticates requests signed with enrolled keys or made with
+// verified client certificates. Signatures must be made within Skew of
+// the server's clock and each signature is accepted only once, so a
+// captured request cannot be replayed. Accepted signatures are recorded
+// in Replay, or in memory if it is nil. Requests must be authenticated
+// unless AllowAnonymous is set. It also enrolls and rotates keys.
+type Verifier struct {
+	Keyring		*Keyring
+	Skew		time.Duration
+	Grace		time.Duration
+	MaxBody		int64
+	EnrollToken	string
+	AllowAnonymous	bool
+	Replay		ReplayCache
+
+	mu		sync.Mutex
+	seen		map[string]time.Time
+	pruned		time.Time
+}
+
+// replayError is returned when the replay cache fails, which says nothing
+// about the request itself.
+type replayError struct {
+	err		error
+}
+
+// Error implements the error interface.
+func (this *replayError) Error() (string) {
+	return fmt.Sprintf(`replay cache: %v`, this.err)
+}
+
+// NewVerifier instantiates a Verifier for a keyring.
+func NewVerifier(kr *Keyring) (*Verifier) {
+
+	return &Verifier{
+		Keyring:	kr,
+		Skew:		DefaultSkew,
+		Grace:		DefaultGrace,
+		MaxBody:	DefaultMaxBody,
+		seen:		make(map[string]time.Time),
+	}
+}
+
+// Handler wraps a handler so that requests are authenticated before they
+// reach it. Requests with a bad signature fail with 401 Unauthorized and
+// requests whose signature and certificate name different hosts fail with
+// 403 Forbidden. Unsigned requests are passed on without a principal
+// unless they present a client certificate; handlers that serve only
+// authenticated requests check them with Authenticated.
+func (this *Verifier) Handler(h http.Handler) (http.Handler) {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		p, err := this.Authenticate(r)
+
+		if _, ok := err.(*replayError); ok {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		switch err {
+
+		case nil:
+
+		case ErrHostMismatch:
+			writeError(w, http.StatusForbidden, err)
+			return
+
+		case ErrTooLarge:
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+
+		default:
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Authenticate returns the principal of a request, or nil if it is neither
+// signed nor made with a client certificate. The body of a signed request
+// is read and replaced so it can be read again.
+func (this *Verifier) Authenticate(r *http.Request) (*Principal, error) {
+
+	cn := PeerHost(r)
+
+	if !Signed(r) {
+		if cn == `` {
+			return nil, nil
+		}
+		return &Principal{Host: cn, Certificate: true}, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, this.MaxBody + 1))
+
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > this.MaxBody {
+		return nil, ErrTooLarge
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	k, err := this.Verify(r, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cn != `` && cn != k.Host {
+		return nil, ErrHostMismatch
+	}
+
+	return &Principal{Host: k.Host, KeyID: k.ID, Certificate: cn != ``}, nil
+}
+
+// Verify checks the signature of a request with a given body and returns
+// the key that signed it.
+func (this *Verifier) Verify(r *http.Request, body []byte) (*Key, error) {
+
+	sig, err := parseSignature(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ts := time.Unix(sig.ts, 0)
+
+	if ts.Before(now.Add(-this.Skew)) || ts.After(now.Add(this.Skew)) {
+		return nil, ErrStale
+	}
+
+	k, err := this.Keyring.Get(sig.keyID)
+
+	switch {
+	case err != nil:
+		return nil, err
+	case !k.Active(now):
+		return nil, ErrKeyExpired
+	case k.Host != sig.host:
+		return nil, ErrBadSignature
+	}
+
+	if err := k.Check(sig.message(r, body), sig.sig); err != nil {
+		return nil, err
+	}
+
+	if ok, err := this.remember(k.ID + `:` + base64.StdEncoding.EncodeToString(sig.sig), now); err != nil {
+		return nil, &replayError{err}
+	} else if !ok {
+		return nil, ErrReplayed
+	}
+
+	return k, nil
+}
+
+// Authenticated checks that a request has a principal, unless anonymous
+// requests are allowed.
+func (this *Verifier) Authenticated(r *http.Request) (error) {
+
+	if FromContext(r.Context()) == nil && !this.AllowAnonymous {
+		return ErrUnauthorized
+	}
+
+	return nil
+}
+
+// Authorize checks that the principal of a request may act for a host. An
+// unauthenticated request is allowed only if anonymous requests are.
+func (this *Verifier) Authorize(r *http.Request, host string) (error) {
+
+	p := FromContext(r.Context())
+
+	switch {
+	case p == nil:
+		return this.Authenticated(r)
+	case p.Host != host:
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// Enroll adds a key for the principal of a request. A request signed with
+// an active key for the same host rotates that key; one made with a client
+// certificate for the host, or carrying the enrollment token, enrolls the
+// first key of a host.
+func (this *Verifier) Enroll(r *http.Request, k *Key, token string) (error) {
+
+	if err := k.Verify(); err != nil {
+		return err
+	}
+
+	p := FromContext(r.Context())
+
+	switch {
+
+	case p != nil && p.KeyID != ``:
+		if p.Host != k.Host {
+			return ErrForbidden
+		}
+		return this.Keyring.Rotate(p.KeyID, k, this.Grace)
+
+	case p != nil && p.Certificate:
+		if p.Host != k.Host {
+			return ErrForbidden
+		}
+		return this.Keyring.Enroll(k)
+
+	case this.EnrollToken != `` && subtle.ConstantTimeCompare([]byte(token), []byte(this.EnrollToken)) == 1:
+		return this.Keyring.Enroll(k)
+
+	default:
+		return ErrUnauthorized
+	}
+}
+
+// remember records a signature, returning false if it was already seen.
+// Signatures are forgotten once their timestamps fall outside the skew.
+func (this *Verifier) remember(sig string, now time.Time) (bool, error) {
+
+	if this.Replay != nil {
+		return this.Replay.Remember(sig, 2 * this.Skew)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.seen == nil {
+		this.seen = make(map[string]time.Time)
+	}
+
+	if now.Sub(this.pruned) > this.Skew {
+		for s, t := range this.seen {
+			if now.Sub(t) > 2 * this.Skew {
+				delete(this.seen, s)
+			}
+		}
+		this.pruned = now
+	}
+
+	if _, ok := this.seen[sig]; ok {
+		return false, nil
+	}
+
+	this.seen[sig] = now
+
+	return true, nil
+}
+
+// writeError writes a JSON error response with the error code of the
+// error, if it has one.
+func writeError(w http.ResponseWriter, code int, err error) {
+
+	j, _ := json.Marshal(struct {
+		Error	string	`json:"error"`
+		Code	string	`json:"code,omitempty"`
+	}{err.Error(), errorCode(err)})
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+// errorCode returns the error code of an error, or an empty string.
+func errorCode(err error) (string) {
+
+	if _, ok := err.(*replayError); ok {
+		return CodeReplayCache
+	}
+
+	switch err {
+	case ErrStale:
+		return CodeStale
+	case ErrReplayed:
+		return CodeReplayed
+	default:
+		return ``
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	`bytes`
+	`crypto/tls`
+	`crypto/x509`
+	`encoding/base64`
+	`errors`
+	`net/http`
+	`net/http/httptest`
+	`strconv`
+	`strings`
+	`testing`
+	`time`
+)
+
+// failingCache is a replay cache that is unavailable.
+type failingCache struct{}
+
+func (failingCache) Remember(string, time.Duration) (bool, error) {
+	return false, errors.New(`unavailable`)
+}
+
+// testIdentity generates and enrolls an identity for a host.
+func testIdentity(t *testing.T, kr *Keyring, host, alg string) (*Identity) {
+
+	id, err := NewIdentity(host, alg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Enroll(id.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// signAt signs a request as if at a given time.
+func signAt(t *testing.T, id *Identity, r *http.Request, body []byte, ts time.Time) {
+
+	msg := Message(r.Method, r.URL.RequestURI(), id.Host, id.KeyID, ts.Unix(), ``, body)
+	sig, err := id.Sign(msg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set(HeaderHost, id.Host)
+	r.Header.Set(HeaderKeyID, id.KeyID)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	r.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(sig))
+}
+
+// withCert adds a verified client certificate for a host to a request.
+func withCert(r *http.Request, host string) (*http.Request) {
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{
+		{&x509.Certificate{DNSNames: []string{host}}},
+	}}
+
+	return r
+}
+
+// serve passes a request through the verifier to a handler that replies
+// with the host of the principal.
+func serve(v *Verifier, r *http.Request) (*httptest.ResponseRecorder) {
+
+	w := httptest.NewRecorder()
+
+	v.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Authenticated(r); err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+		} else {
+			w.Write([]byte(FromContext(r.Context()).Host))
+		}
+	})).ServeHTTP(w, r)
+
+	return w
+}
+
+func TestVerifier(t *testing.T) {
+
+	kr, err := NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ed := testIdentity(t, kr, `host1`, Ed25519)
+	mac := testIdentity(t, kr, `host2`, HMACSHA256)
+
+	v := NewVerifier(kr)
+	v.MaxBody = 64
+
+	body := []byte(`{"host_name":"host1"}`)
+	now := time.Now()
+
+	request := func(path string, b []byte) (*http.Request) {
+		return httptest.NewRequest(`POST`, path, bytes.NewReader(b))
+	}
+	signed := func(id *Identity, path string, b, sb []byte, ts time.Time) (*http.Request) {
+		r := request(path, b)
+		signAt(t, id, r, sb, ts)
+		return r
+	}
+
+	if w := serve(v, signed(ed, `/v1/checkin`, body, body, now)); w.Code != http.StatusOK {
+		t.Fatalf(`signed: status %d: %s`, w.Code, w.Body)
+	}
+
+	redirected := signed(ed, `/v1/checkin`, body, body, now.Add(-2 * time.Second))
+	redirected.URL.Path = `/v1/serials`
+
+	tests := []struct {
+		name		string
+		req		*http.Request
+		code		int
+		want		string
+	}{
+		{`ed25519`, signed(ed, `/v1/checkin`, body, body, now.Add(-time.Second)),
+			http.StatusOK, `host1`},
+		{`hmac`, signed(mac, `/v1/checkin`, body, body, now),
+			http.StatusOK, `host2`},
+		{`tampered body`, signed(ed, `/v1/checkin`, []byte(`{"host_name":"host3"}`), body, now),
+			http.StatusUnauthorized, ErrBadSignature.Error()},
+		{`tampered path`, redirected,
+			http.StatusUnauthorized, ErrBadSignature.Error()},
+		{`stale`, signed(ed, `/v1/checkin`, body, body, now.Add(-v.Skew - time.Minute)),
+			http.StatusUnauthorized, CodeStale},
+		{`future`, signed(ed, `/v1/checkin`, body, body, now.Add(v.Skew + time.Minute)),
+			http.StatusUnauthorized, CodeStale},
+		{`replayed`, signed(ed, `/v1/checkin`, body, body, now),
+			http.StatusUnauthorized, CodeReplayed},
+		{`unknown key`, signed(&Identity{KeyID: `unknown`, Host: `host1`, Algorithm: HMACSHA256,
+			Private: make([]byte, hmacKeySize)}, `/v1/checkin`, body, body, now),
+			http.StatusUnauthorized, ErrUnknownKey.Error()},
+		{`certificate`, withCert(request(`/v1/checkin`, body), `host3`),
+			http.StatusOK, `host3`},
+		{`certificate and signature`, withCert(signed(ed, `/v1/checkin`, body, body, now.Add(-3 * time.Second)), `host1`),
+			http.StatusOK, `host1`},
+		{`certificate host mismatch`, withCert(signed(ed, `/v1/checkin`, body, body, now.Add(-4 * time.Second)), `host2`),
+			http.StatusForbidden, ErrHostMismatch.Error()},
+		{`too large`, signed(ed, `/v1/checkin`, bytes.Repeat(body, 4), bytes.Repeat(body, 4), now),
+			http.StatusRequestEntityTooLarge, ErrTooLarge.Error()},
+		{`anonymous`, request(`/v1/checkin`, body),
+			http.StatusUnauthorized, ErrUnauthorized.Error()},
+	}
+
+	for _, tt := range tests {
+
+		w := serve(v, tt.req)
+
+		if w.Code != tt.code {
+			t.Errorf(`%s: status %d, want %d: %s`, tt.name, w.Code, tt.code, w.Body)
+		} else if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf(`%s: body %s, want %s`, tt.name, w.Body, tt.want)
+		}
+	}
+}
+
+func TestVerifierRotation(t *testing.T) {
+
+	kr, err := NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := testIdentity(t, kr, `host1`, Ed25519)
+	v := NewVerifier(kr)
+
+	body := []byte(`{}`)
+
+	rotate := func(grace time.Duration) (*Identity) {
+		id, err := NewIdentity(`host1`, Ed25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kr.Rotate(old.KeyID, id.Key(), grace); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	check := func(name string, id *Identity, ts time.Time, code int, want string) {
+		r := httptest.NewRequest(`POST`, `/v1/checkin`, bytes.NewReader(body))
+		signAt(t, id, r, body, ts)
+		if w := serve(v, r); w.Code != code {
+			t.Errorf(`%s: status %d, want %d: %s`, name, w.Code, code, w.Body)
+		} else if !strings.Contains(w.Body.String(), want) {
+			t.Errorf(`%s: body %s, want %s`, name, w.Body, want)
+		}
+	}
+
+	now := time.Now()
+	id := rotate(time.Hour)
+
+	check(`old key within grace`, old, now, http.StatusOK, `host1`)
+	check(`new key`, id, now, http.StatusOK, `host1`)
+
+	if err := kr.Rotate(old.KeyID, id.Key(), time.Hour); err != ErrKeyExists {
+		t.Errorf(`rotating to an enrolled key: got %v, want ErrKeyExists`, err)
+	}
+
+	rotate(-time.Second)
+
+	check(`old key after grace`, old, now.Add(-time.Second), http.StatusUnauthorized, ErrKeyExpired.Error())
+	check(`new key after grace`, id, now.Add(-time.Second), http.StatusOK, `host1`)
+
+	if err := kr.Revoke(id.KeyID); err != nil {
+		t.Fatal(err)
+	}
+
+	check(`revoked key`, id, now.Add(-2 * time.Second), http.StatusUnauthorized, ErrKeyExpired.Error())
+}
+
+func TestVerifierReplayCache(t *testing.T) {
+
+	kr, err := NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := testIdentity(t, kr, `host1`, Ed25519)
+
+	v := NewVerifier(kr)
+	v.Replay = failingCache{}
+
+	body := []byte(`{}`)
+	r := httptest.NewRequest(`POST`, `/v1/checkin`, bytes.NewReader(body))
+	signAt(t, id, r, body, time.Now())
+
+	if w := serve(v, r); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), CodeReplayCache) {
+		t.Errorf(`unavailable replay cache: status %d: %s`, w.Code, w.Body)
+	}
+}
@@ -15,6 +15,7 @@
 package usb
 
 import (
+	`errors`
 	`fmt`
 
 	`github.com/google/gousb`
@@ -49,6 +50,10 @@ const (
 	ConfigDescSize		int	= 9
 )
 
+// ErrNoDevice is returned by methods that communicate with the device when
+// the object has no gousb device handle, such as a copy made by DeepCopy.
+var ErrNoDevice = errors.New(`no device handle`)
+
 // Device decorates a gousb.Device with additional methods and properties.
 type Device struct {
 	*gousb.Device `json:"-" xml:"-" csv:"-" nvp:"-" cmp:"-"`
@@ -77,19 +82,21 @@ func NewDevice(i interface{}) (this *Device, err error) {
 			return nil, err
 		}
 
+		this.DescriptorSN = this.SerialNum
+
 	case *gousb.DeviceDesc:
 
-		this = &Device{Device: &gousb.Device{Desc: t}}
+		this = &Device{}
 
-		if this.DeviceInfo, err = usb.NewDeviceInfo(this.Desc); err != nil {
+		if this.DeviceInfo, err = usb.NewDeviceInfo(t); err != nil {
 			return nil, err
 		}
 
 	case nil:
 
-		this = &Device{Device: &gousb.Device{Desc: nil}}
+		this = &Device{}
 
-		if this.DeviceInfo, err = usb.NewDeviceInfo(this.Desc); err != nil {
+		if this.DeviceInfo, err = usb.NewDeviceInfo(nil); err != nil {
 			return nil, err
 		}
 
@@ -108,9 +115,23 @@ func (this *Device) Zero() {
 	this.DeviceInfo = &usb.DeviceInfo{}
 }
 
-// Clone returns an empty instance of the device as an interface type.
+// Clone returns a deep copy of the device as an interface type.
 func (this *Device) Clone() (interface{}) {
-	return interface{}(new(Device))
+	return interface{}(this.DeepCopy())
+}
+
+// DeepCopy returns a copy of the device with a deep copy of its DeviceInfo.
+// The copy is data-only: it has no gousb device handle, and methods that
+// communicate with the device return ErrNoDevice.
+func (this *Device) DeepCopy() (*Device) {
+
+	that := &Device{}
+
+	if this.DeviceInfo != nil {
+		that.DeviceInfo = this.DeviceInfo.DeepCopy()
+	}
+
+	return that
 }
 
 // GetInfo detaches and returns just the DeviceInfo object.
@@ -118,9 +139,23 @@ func (this *Device) GetInfo() (*usb.DeviceInfo) {
 	return this.DeviceInfo
 }
 
+// Reset performs a USB port reset of the device.
+func (this *Device) Reset() (error) {
+
+	if this.Device == nil {
+		return ErrNoDevice
+	}
+
+	return this.Device.Reset()
+}
+
 // controlSetReport performs a SetReport control transfer.
 func (this *Device) controlSetReport(data []byte) (n int, err error) {
 
+	if this.Device == nil {
+		return 0, ErrNoDevice
+	}
+
 	return this.Control(
 		ReqDirectionOut | ReqTypeClass | ReqRecipInterface,
 		ReqSetReport,
@@ -130,9 +165,13 @@ func (this *Device) controlSetReport(data []byte) (n int, err error) {
 	)
 }
 
-// controlSetReport performs a SetReport control transfer.
+// controlGetReport performs a GetReport control transfer.
 func (this *Device) controlGetReport(data []byte) (n int, err error) {
 
+	if this.Device == nil {
+		return 0, ErrNoDevice
+	}
+
 	return this.Control(
 		ReqDirectionIn | ReqTypeClass | ReqRecipInterface,
 		ReqGetReport,
@@ -0,0 +1,46 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import `github.com/google/gousb`
+
+// NewObject instantiates the most specific wrapper for a gousb Device:
+// Magtek or IDTech for supported card readers and Generic otherwise.
+func NewObject(dev *gousb.Device) (Auditer, error) {
+
+	switch {
+
+	case IsMagtek(dev.Desc.Vendor, dev.Desc.Product):
+		if d, err := NewMagtek(dev); err != nil {
+			return nil, err
+		} else {
+			return d, nil
+		}
+
+	case IsIDTech(dev.Desc.Vendor, dev.Desc.Product):
+		if d, err := NewIDTech(dev); err != nil {
+			return nil, err
+		} else {
+			return d, nil
+		}
+
+	default:
+		if d, err := NewGeneric(dev); err != nil {
+			return nil, err
+		} else {
+			return d, nil
+		}
+	}
+}
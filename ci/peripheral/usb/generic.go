@@ -31,6 +31,18 @@ func NewGeneric(i interface{}) (this *Generic, err error) {
 	}
 
 	this.ObjectType = fmt.Sprintf(`%T`, this)
+	this.Fingerprint = this.MakeFingerprint()
 
 	return this, nil
 }
+
+// Clone returns a deep copy of the device as an interface type.
+func (this *Generic) Clone() (interface{}) {
+	return interface{}(this.DeepCopy())
+}
+
+// DeepCopy returns a data-only copy of the device that shares neither its
+// DeviceInfo nor the underlying gousb device handle.
+func (this *Generic) DeepCopy() (*Generic) {
+	return &Generic{this.Device.DeepCopy()}
+}
@@ -19,7 +19,9 @@ import (
 	`fmt`
 	`io`
 	`time`
+
 	`github.com/google/gousb`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
 )
 
 // SETTING COMMAND
@@ -95,6 +97,7 @@ const (
 	idtechPropFirmwareVer	= 0x22
 
 	idtechBufSizeSecureMag	= 8
+	idtechMaxSettingLen	= 0xff
 )
 
 // idtechRespCode represents the response code from control transfer
@@ -185,6 +188,17 @@ func NewIDTech(i interface{}) (this *IDTech, err error) {
 	return this, nil
 }
 
+// Clone returns a deep copy of the device as an interface type.
+func (this *IDTech) Clone() (interface{}) {
+	return interface{}(this.DeepCopy())
+}
+
+// DeepCopy returns a data-only copy of the device that shares neither its
+// DeviceInfo nor the underlying gousb device handle.
+func (this *IDTech) DeepCopy() (*IDTech) {
+	return &IDTech{this.Device.DeepCopy()}
+}
+
 // Refresh updates API properties whose values may have changed.
 func (this *IDTech) Refresh() (err error) {
 
@@ -196,6 +210,7 @@ func (this *IDTech) Refresh() (err error) {
 	}
 
 	this.SerialNum = this.DeviceSN
+	this.Fingerprint = this.MakeFingerprint()
 
 	return err
 }
@@ -212,9 +227,54 @@ func (this *IDTech) GetDeviceSN() (v string, err error) {
 
 // SetDeviceSN sets the device configurable serial number in NVRAM.
 func (this *IDTech) SetDeviceSN(v string) (error) {
+
+	if err := this.ValidateSN(v); err != nil {
+		return err
+	}
+
 	return this.setProperty(idtechPropDeviceSN, v)
 }
 
+// IssueDeviceSN obtains a serial number from an issuer and sets it as the
+// device configurable serial number in NVRAM.
+func (this *IDTech) IssueDeviceSN(i SNIssuer) (error) {
+
+	if v, err := i.IssueSN(this.VID(), this.PID(), this.Host(), this.FP()); err != nil {
+		return err
+	} else {
+		return this.SetDeviceSN(v)
+	}
+}
+
+// ValidateSN checks that a serial number is not empty, its character set
+// and that its length fits in the one-byte length field of the setting
+// command.
+func (this *IDTech) ValidateSN(v string) (error) {
+
+	if err := usb.ValidateSN(v); err != nil {
+		return err
+	}
+	if len(v) > idtechMaxSettingLen {
+		return fmt.Errorf(`serial number %q exceeds maximum length %d`, v, idtechMaxSettingLen)
+	}
+
+	return nil
+}
+
+// Validate checks the device information and the configurable serial
+// number.
+func (this *IDTech) Validate() (error) {
+
+	if err := this.DeviceInfo.Validate(); err != nil {
+		return err
+	}
+	if this.DeviceSN == `` {
+		return nil
+	}
+
+	return this.ValidateSN(this.DeviceSN)
+}
+
 // SetDefaultSN is a NOOP function to comply with the Serializer interface.
 func (this *IDTech) SetDefaultSN() (error) {
 	return nil
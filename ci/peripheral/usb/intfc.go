@@ -14,6 +14,8 @@
 
 package usb
 
+import `github.com/jscherff/cmdb/meta/peripheral/usb`
+
 type Resetter interface {
 	Reset() (error)
 }
@@ -21,6 +23,7 @@ type Resetter interface {
 type Identifier interface {
 	Resetter
 	ID() (string)
+	FP() (string)
 	SN() (string)
 	VID() (string)
 	PID() (string)
@@ -42,6 +45,9 @@ type Reporter interface {
 	JSON() ([]byte, error)
 	PrettyXML() ([]byte, error)
 	PrettyJSON() ([]byte, error)
+	CSVWith(*usb.Profile) ([]byte, error)
+	NVPWith(*usb.Profile) ([]byte, error)
+	JSONWith(*usb.Profile) ([]byte, error)
 }
 
 type Updater interface {
@@ -60,6 +66,8 @@ type Updater interface {
 
 type Auditer interface {
 	Reporter
+	GetInfo() (*usb.DeviceInfo)
+	Validate() (error)
 	Zero()
 	Clone() (interface{})
 	Save(string) (error)
@@ -69,19 +77,36 @@ type Auditer interface {
 	CompareJSON([]byte) ([][]string, error)
 	AuditFile(string) (error)
 	AuditJSON([]byte) (error)
+	CompareFileWith(string, *usb.Profile) ([][]string, error)
+	CompareJSONWith([]byte, *usb.Profile) ([][]string, error)
+	AuditFileWith(string, *usb.Profile) (error)
+	AuditJSONWith([]byte, *usb.Profile) (error)
+	SaveStore(usb.Store) (error)
+	RestoreStore(usb.Store, string) (error)
+	CompareStore(usb.Store) ([][]string, error)
+	AuditStore(usb.Store) (error)
 	SetChanges([][]string)
 	GetChanges() ([][]string)
+	SetChangeRecords(usb.Changes)
+	GetChangeRecords() (usb.Changes)
+	GetChangeLog() (*usb.ChangeLog)
 }
 
 type Serializer interface {
 	Auditer
 	GetDeviceSN() (string, error)
 	SetDeviceSN(string) (error)
+	IssueDeviceSN(SNIssuer) (error)
+	ValidateSN(string) (error)
 	SetDefaultSN() (error)
 	EraseDeviceSN() (error)
 	Refresh() (error)
 }
 
+type SNIssuer interface {
+	IssueSN(vid, pid, host, fp string) (string, error)
+}
+
 type FactorySerializer interface {
 	Serializer
 	GetFactorySN() (string, error)
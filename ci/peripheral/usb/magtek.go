@@ -19,6 +19,7 @@ import (
 	`time`
 
 	`github.com/google/gousb`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
 )
 
 const (
@@ -47,6 +48,12 @@ const (
 	magtekBufSizeMagnesafe	= 60
 
 	magtekDefaultSNLength	= 7
+	magtekCmdHeaderSize	= 3
+
+	// magtekMaxSNLength is the longest serial number that fits in the
+	// smallest control transfer buffer, used if the buffer size of the
+	// device is unknown.
+	magtekMaxSNLength	= magtekBufSizeSureswipe - magtekCmdHeaderSize
 )
 
 var magtekBufferSizes = []int{24, 60}
@@ -237,6 +244,17 @@ func NewMagtek(i interface{}) (this *Magtek, err error) {
 	return this, nil
 }
 
+// Clone returns a deep copy of the device as an interface type.
+func (this *Magtek) Clone() (interface{}) {
+	return interface{}(this.DeepCopy())
+}
+
+// DeepCopy returns a data-only copy of the device that shares neither its
+// DeviceInfo nor the underlying gousb device handle.
+func (this *Magtek) DeepCopy() (*Magtek) {
+	return &Magtek{this.Device.DeepCopy()}
+}
+
 // Refresh updates API properties whose values may have changed.
 func (this *Magtek) Refresh() (err error) {
 
@@ -251,6 +269,7 @@ func (this *Magtek) Refresh() (err error) {
 	}
 
 	this.SerialNum = this.DeviceSN
+	this.Fingerprint = this.MakeFingerprint()
 
 	return err
 }
@@ -279,9 +298,62 @@ func (this *Magtek) GetDeviceSN() (string, error) {
 
 // SetDeviceSN sets the configurable serial number in NVRAM.
 func (this *Magtek) SetDeviceSN(s string) (error) {
+
+	if err := this.ValidateSN(s); err != nil {
+		return err
+	}
+
 	return this.setProperty(magtekPropDeviceSN, s)
 }
 
+// IssueDeviceSN obtains a serial number from an issuer and sets it as the
+// configurable serial number in NVRAM.
+func (this *Magtek) IssueDeviceSN(i SNIssuer) (error) {
+
+	if s, err := i.IssueSN(this.VID(), this.PID(), this.Host(), this.FP()); err != nil {
+		return err
+	} else {
+		return this.SetDeviceSN(s)
+	}
+}
+
+// ValidateSN checks that a serial number is not empty, its character set
+// and that it fits in the control transfer buffer alongside the command
+// header. If the buffer size is unknown, as it is for objects restored
+// from JSON, the smallest Magtek buffer size is assumed.
+func (this *Magtek) ValidateSN(s string) (error) {
+
+	if err := usb.ValidateSN(s); err != nil {
+		return err
+	}
+
+	max := magtekMaxSNLength
+
+	if this.BufferSize > magtekCmdHeaderSize {
+		max = this.BufferSize - magtekCmdHeaderSize
+	}
+
+	if len(s) > max {
+		return fmt.Errorf(`serial number %q exceeds maximum length %d`, s, max)
+	}
+
+	return nil
+}
+
+// Validate checks the device information and the configurable serial
+// number.
+func (this *Magtek) Validate() (error) {
+
+	if err := this.DeviceInfo.Validate(); err != nil {
+		return err
+	}
+	if this.DeviceSN == `` {
+		return nil
+	}
+
+	return this.ValidateSN(this.DeviceSN)
+}
+
 // SetDefaultSN copies default-length characters from the factory
 // serial number to the configurable serial number in NVRAM.
 func (this *Magtek) SetDefaultSN() (error) {
@@ -308,6 +380,11 @@ func (this *Magtek) GetFactorySN() (string, error) {
 // SetFactorySN sets the factory device serial number in NVRAM. This
 // will fail with result code 07 if serial number is already set.
 func (this *Magtek) SetFactorySN(s string) (error) {
+
+	if err := this.ValidateSN(s); err != nil {
+		return err
+	}
+
 	return this.setProperty(magtekPropFactorySN, s)
 }
 
@@ -319,6 +396,8 @@ func (this *Magtek) CopyFactorySN(n int) (error) {
 		return err
 	} else if s == `` {
 		return fmt.Errorf(`no factory serial number`)
+	} else if n < 1 || n > len(s) {
+		return fmt.Errorf(`length %d out of range for factory serial number %q`, n, s)
 	} else {
 		return this.SetDeviceSN(s[:n])
 	}
@@ -419,7 +498,7 @@ func (this *Magtek) setProperty(p byte, v string) (error) {
 
 	vlen := len(v)
 
-	if this.BufferSize < 3 + vlen {
+	if this.BufferSize < magtekCmdHeaderSize + vlen {
 		return fmt.Errorf(`buffer size %d < %d`, this.BufferSize, vlen)
 	}
 
@@ -0,0 +1,318 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`fmt`
+	`reflect`
+	`strings`
+	`text/tabwriter`
+
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+// Report builds tabular reports from multiple devices. Columns are selected
+// and ordered by the JSON tag names of the underlying DeviceInfo fields.
+// If Redact is set, every output format reports redacted values.
+type Report struct {
+	Columns []string
+	Objects []Reporter
+	Redact *usb.RedactPolicy
+}
+
+// NewReport instantiates a Report with the given columns. If no columns are
+// given, the report includes every field not excluded from CSV output.
+func NewReport(cols ...string) (this *Report, err error) {
+
+	this = &Report{}
+
+	if len(cols) == 0 {
+		cols = DefaultColumns()
+	}
+
+	if err = this.SetColumns(cols...); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// DefaultColumns returns the tag names of all DeviceInfo fields not
+// excluded from CSV output, in struct order.
+func DefaultColumns() (cols []string) {
+
+	t := reflect.TypeOf(usb.DeviceInfo{})
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get(`csv`) == `-` {
+			continue
+		}
+		if name := usb.TagName(t.Field(i)); name != `` {
+			cols = append(cols, name)
+		}
+	}
+
+	return cols
+}
+
+// SetColumns selects and orders the columns of the report.
+func (this *Report) SetColumns(cols ...string) (error) {
+
+	known := make(map[string]bool)
+	t := reflect.TypeOf(usb.DeviceInfo{})
+
+	for i := 0; i < t.NumField(); i++ {
+		if name := usb.TagName(t.Field(i)); name != `` {
+			known[name] = true
+		}
+	}
+
+	for _, col := range cols {
+		if !known[col] {
+			return fmt.Errorf(`unknown column %q`, col)
+		}
+	}
+
+	this.Columns = cols
+
+	return nil
+}
+
+// SetProfile selects and orders the columns of the report using a named
+// field profile.
+func (this *Report) SetProfile(name string) (error) {
+
+	if p, err := usb.GetProfile(name); err != nil {
+		return err
+	} else {
+		return this.SetColumns(p.Fields...)
+	}
+}
+
+// Add appends one or more devices to the report.
+func (this *Report) Add(objs ...Reporter) {
+	this.Objects = append(this.Objects, objs...)
+}
+
+// CSV reports the selected columns of all devices in CSV format with
+// a header row.
+func (this *Report) CSV() ([]byte, error) {
+
+	rows, err := this.rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+
+	if err := w.Write(this.Columns); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if err := w.Write(this.values(row)); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+// Table reports the selected columns of all devices as an aligned text
+// table with a header row.
+func (this *Report) Table() ([]byte, error) {
+
+	rows, err := this.rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, strings.Join(this.Columns, "\t"))
+
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(this.values(row), "\t"))
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// JSON reports the selected columns of all devices as a JSON array.
+func (this *Report) JSON() ([]byte, error) {
+
+	rows, err := this.rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('[')
+
+	for i, row := range rows {
+
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if j, err := this.object(row); err != nil {
+			return nil, err
+		} else {
+			b.Write(j)
+		}
+	}
+
+	b.WriteByte(']')
+
+	return b.Bytes(), nil
+}
+
+// NDJSON reports the selected columns of all devices as newline-delimited
+// JSON, one object per line.
+func (this *Report) NDJSON() ([]byte, error) {
+
+	rows, err := this.rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	for _, row := range rows {
+
+		if j, err := this.object(row); err != nil {
+			return nil, err
+		} else {
+			b.Write(j)
+			b.WriteByte('\n')
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// rows converts each device to a map of field values keyed by tag name.
+func (this *Report) rows() (rows []map[string]interface{}, err error) {
+
+	for _, obj := range this.Objects {
+
+		j, err := obj.JSON()
+
+		if err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{})
+		dec := json.NewDecoder(bytes.NewReader(j))
+		dec.UseNumber()
+
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+
+		if err := this.redact(row); err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// redact replaces the values of a row with redacted values according to
+// the report's redaction policy, if any.
+func (this *Report) redact(row map[string]interface{}) (error) {
+
+	if this.Redact == nil {
+		return nil
+	}
+
+	for name := range this.Redact.Fields {
+
+		if s, ok := row[name].(string); !ok {
+			continue
+		} else if v, err := this.Redact.Value(name, s); err != nil {
+			return err
+		} else {
+			row[name] = v
+		}
+	}
+
+	return nil
+}
+
+// values returns the selected column values of a row as strings.
+func (this *Report) values(row map[string]interface{}) (ss []string) {
+
+	for _, col := range this.Columns {
+		if v, ok := row[col]; !ok || v == nil {
+			ss = append(ss, ``)
+		} else {
+			ss = append(ss, fmt.Sprint(v))
+		}
+	}
+
+	return ss
+}
+
+// object returns the selected column values of a row as a JSON object,
+// preserving column order.
+func (this *Report) object(row map[string]interface{}) ([]byte, error) {
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+
+	for i, col := range this.Columns {
+
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		k, err := json.Marshal(col)
+
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := json.Marshal(row[col])
+
+		if err != nil {
+			return nil, err
+		}
+
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
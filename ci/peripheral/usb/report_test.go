@@ -0,0 +1,88 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`strings`
+	`testing`
+
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+// testReporter is a Reporter backed by a DeviceInfo without a device.
+type testReporter struct {
+	*usb.DeviceInfo
+}
+
+func (this *testReporter) Reset() (error) {
+	return nil
+}
+
+func TestReportRedact(t *testing.T) {
+
+	rp, err := usb.NewRedactPolicy([]byte(`0123456789abcdef0123456789abcdef`),
+		map[string]usb.RedactMode{
+			`host_name`:		usb.RedactHash,
+			`serial_number`:	usb.RedactToken,
+			`custom_01`:		usb.RedactMask,
+		},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReport(`host_name`, `vendor_id`, `serial_number`, `vendor_name`, `custom_01`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Redact = rp
+
+	r.Add(&testReporter{&usb.DeviceInfo{
+		HostName:	`secret-host-01`,
+		VendorID:	`0801`,
+		SerialNum:	`SECRETSERIAL42`,
+		VendorName:	`Mag-Tek`,
+		Custom01:	`secret-custom-attr`,
+	}})
+
+	outputs := map[string]func() ([]byte, error){
+		`CSV`:		r.CSV,
+		`Table`:	r.Table,
+		`JSON`:		r.JSON,
+		`NDJSON`:	r.NDJSON,
+	}
+
+	for name, fn := range outputs {
+
+		b, err := fn()
+
+		if err != nil {
+			t.Fatalf(`%s: %v`, name, err)
+		}
+
+		for _, s := range []string{`secret-host-01`, `SECRETSERIAL42`, `secret-custom-attr`} {
+			if strings.Contains(string(b), s) {
+				t.Errorf(`%s: output contains %q`, name, s)
+			}
+		}
+
+		if !strings.Contains(string(b), `Mag-Tek`) {
+			t.Errorf(`%s: unredacted column missing: %s`, name, b)
+		}
+	}
+}
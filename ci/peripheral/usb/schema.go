@@ -0,0 +1,39 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import `github.com/jscherff/cmdb/meta/peripheral/usb`
+
+// Schemas returns JSON Schema documents for DeviceInfo and each device
+// type, keyed by type name.
+func Schemas() (map[string]*usb.Schema, error) {
+
+	schemas := make(map[string]*usb.Schema)
+
+	for _, i := range []interface{}{
+		usb.DeviceInfo{},
+		Generic{},
+		Magtek{},
+		IDTech{},
+	} {
+		if s, err := usb.NewSchema(i); err != nil {
+			return nil, err
+		} else {
+			schemas[s.Title] = s
+		}
+	}
+
+	return schemas, nil
+}
@@ -0,0 +1,518 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	`bytes`
+	`compress/gzip`
+	`encoding/json`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`math/rand`
+	`net/http`
+	`net/url`
+	`strconv`
+	`strings`
+	`time`
+
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+	`github.com/jscherff/cmdb/serial`
+	`github.com/jscherff/cmdb/server`
+	`github.com/jscherff/cmdb/spool`
+)
+
+const (
+	DefaultTimeout		time.Duration	= 30 * time.Second
+	DefaultRetries		int		= 3
+	DefaultBackoff		time.Duration	= 500 * time.Millisecond
+	DefaultMaxBackoff	time.Duration	= 30 * time.Second
+	UserAgent		string		= `cmdb-agent/1.0`
+)
+
+// Client submits device records, change sets and serial number requests
+// to a CMDB server. Requests that fail with a network error or a
+// temporary server error are retried with exponential backoff and jitter.
+// Requests are signed with the Identity once it is enrolled.
+type Client struct {
+	BaseURL		*url.URL
+	HTTP		*http.Client
+	Retries		int
+	Backoff		time.Duration
+	MaxBackoff	time.Duration
+	Gzip		bool
+	Identity	*auth.Identity
+}
+
+// NewClient instantiates a Client for the server at a base URL, such as
+// 'https://cmdb.example.com'.
+func NewClient(base string) (*Client, error) {
+
+	u, err := url.Parse(base)
+
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != `http` && u.Scheme != `https` {
+		return nil, fmt.Errorf(`invalid server URL %q`, base)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, `/`) + server.APIPrefix
+
+	return &Client{
+		BaseURL:	u,
+		HTTP:		&http.Client{Timeout: DefaultTimeout},
+		Retries:	DefaultRetries,
+		Backoff:	DefaultBackoff,
+		MaxBackoff:	DefaultMaxBackoff,
+		Gzip:		true,
+	}, nil
+}
+
+// Checkin submits a device record as the device's last-known record.
+func (this *Client) Checkin(di *usb.DeviceInfo) (*server.CheckinResponse, error) {
+
+	resp := &server.CheckinResponse{}
+
+	if err := this.Do(http.MethodPost, `/checkin`, di, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// BaselineJSON fetches the last-known record of a device in a form
+// suitable for DeviceInfo.AuditJSON.
+func (this *Client) BaselineJSON(fp string) ([]byte, error) {
+
+	var j json.RawMessage
+
+	if err := this.Do(http.MethodGet, `/devices/` + url.PathEscape(fp), nil, &j); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Baseline fetches the last-known record of a device.
+func (this *Client) Baseline(fp string) (*usb.DeviceInfo, error) {
+
+	j, err := this.BaselineJSON(fp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	di := &usb.DeviceInfo{}
+
+	if err := di.RestoreJSON(j); err != nil {
+		return nil, err
+	}
+
+	return di, nil
+}
+
+// Audit compares a device with its last-known record on the server and
+// stores the changes in the device.
+func (this *Client) Audit(di *usb.DeviceInfo) (error) {
+
+	if j, err := this.BaselineJSON(di.FP()); err != nil {
+		return err
+	} else {
+		return di.AuditJSON(j)
+	}
+}
+
+// History fetches every stored revision of a device record.
+func (this *Client) History(fp string) (revs []*usb.Revision, err error) {
+	err = this.Do(http.MethodGet, `/devices/` + url.PathEscape(fp) + `/history`, nil, &revs)
+	return revs, err
+}
+
+// ReportChanges submits the change records of an audit of a device.
+func (this *Client) ReportChanges(fp string, c usb.Changes) (error) {
+
+	if c == nil {
+		c = usb.Changes{}
+	}
+
+	return this.Do(http.MethodPost, `/devices/` + url.PathEscape(fp) + `/changes`, c, nil)
+}
+
+// Devices queries the inventory for device records that match a filter.
+func (this *Client) Devices(f *usb.Filter) (dis []*usb.DeviceInfo, err error) {
+
+	q := url.Values{}
+
+	if f != nil {
+		for k, v := range map[string]string{
+			`host_name`:		f.HostName,
+			`vendor_id`:		f.VendorID,
+			`product_id`:		f.ProductID,
+			`serial_number`:	f.SerialNum,
+			`object_type`:		f.ObjectType,
+		} {
+			if v != `` {
+				q.Set(k, v)
+			}
+		}
+	}
+
+	path := `/devices`
+
+	if len(q) > 0 {
+		path += `?` + q.Encode()
+	}
+
+	err = this.Do(http.MethodGet, path, nil, &dis)
+
+	return dis, err
+}
+
+// SerialReport fetches the fleet-wide serial number report for the devices
+// that match a filter. Only the vendor ID, product ID and object type of
+// the filter are used.
+func (this *Client) SerialReport(f *usb.Filter) (*serial.Report, error) {
+
+	q := url.Values{}
+
+	if f != nil {
+		for k, v := range map[string]string{
+			`vendor_id`:	f.VendorID,
+			`product_id`:	f.ProductID,
+			`object_type`:	f.ObjectType,
+		} {
+			if v != `` {
+				q.Set(k, v)
+			}
+		}
+	}
+
+	path := `/reports/serials`
+
+	if len(q) > 0 {
+		path += `?` + q.Encode()
+	}
+
+	rpt := &serial.Report{}
+
+	if err := this.Do(http.MethodGet, path, nil, rpt); err != nil {
+		return nil, err
+	}
+
+	return rpt, nil
+}
+
+// ClaimSerial records a serial number assigned to a device by the agent.
+func (this *Client) ClaimSerial(sn string, req *server.SerialRequest) (*serial.Assignment, error) {
+
+	a := &serial.Assignment{}
+
+	if err := this.Do(http.MethodPut, `/serials/` + url.PathEscape(sn), req, a); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// RequestSerial requests a new serial number for a device.
+func (this *Client) RequestSerial(req *server.SerialRequest) (*serial.Assignment, error) {
+
+	a := &serial.Assignment{}
+
+	if err := this.Do(http.MethodPost, `/serials`, req, a); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// IssueSN requests a new serial number and returns it as a string. It
+// allows a Client to be used directly by device drivers.
+func (this *Client) IssueSN(vid, pid, host, fp string) (string, error) {
+
+	a, err := this.RequestSerial(&server.SerialRequest{
+		VendorID:	vid,
+		ProductID:	pid,
+		HostName:	host,
+		Fingerprint:	fp,
+	})
+
+	if err != nil {
+		return ``, err
+	}
+
+	return a.Serial, nil
+}
+
+// Enroll enrolls the key of an identity for its host, using an enrollment
+// token or the client certificate, and marks the identity enrolled.
+func (this *Client) Enroll(id *auth.Identity, token string) (error) {
+
+	req := &server.EnrollRequest{Key: id.Key(), Token: token}
+
+	if err := this.Do(http.MethodPost, `/keys`, req, nil); err != nil {
+		return err
+	}
+
+	id.Enrolled = true
+
+	return nil
+}
+
+// Rotate enrolls the key of a new identity with a request signed by the
+// current one and makes it the client's identity. The server keeps
+// accepting the old key for a grace period.
+func (this *Client) Rotate(next *auth.Identity) (error) {
+
+	if this.Identity == nil || !this.Identity.Enrolled {
+		return fmt.Errorf(`rotating key: no enrolled identity`)
+	}
+
+	if err := this.Enroll(next, ``); err != nil {
+		return err
+	}
+
+	this.Identity = next
+
+	return nil
+}
+
+// CheckinEntry builds a spool entry for a checkin targeting the device's
+// fingerprint, so that it replaces a queued checkin of the same device.
+func (this *Client) CheckinEntry(di *usb.DeviceInfo) (*spool.Entry, error) {
+	return this.Entry(spool.KindCheckin, di.FP(), http.MethodPost, `/checkin`, di)
+}
+
+// ChangesEntry builds a spool entry for a change report.
+func (this *Client) ChangesEntry(fp string, c usb.Changes) (*spool.Entry, error) {
+
+	if c == nil {
+		c = usb.Changes{}
+	}
+
+	return this.Entry(spool.KindChanges, fp, http.MethodPost, `/devices/` + url.PathEscape(fp) + `/changes`, c)
+}
+
+// ClaimEntry builds a spool entry for a serial number claim.
+func (this *Client) ClaimEntry(sn string, req *server.SerialRequest) (*spool.Entry, error) {
+	return this.Entry(spool.KindSerial, sn, http.MethodPut, `/serials/` + url.PathEscape(sn), req)
+}
+
+// Entry builds a spool entry for a request with a JSON body that applies
+// to a given target.
+func (this *Client) Entry(kind, target, method, path string, in interface{}) (*spool.Entry, error) {
+
+	j, err := json.Marshal(in)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := spool.NewEntry(kind, method, path, j)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.Target = target
+
+	return e, nil
+}
+
+// Replay sends a spooled request with its original idempotency key. It
+// can be passed directly to spool.Spool.Replay.
+func (this *Client) Replay(e *spool.Entry) (error) {
+	return this.DoKey(e.Method, e.Path, e.Key, e.Body, nil)
+}
+
+// Do sends a request with an optional JSON body and decodes an optional
+// JSON response into out, retrying temporary failures. POST and PUT
+// requests carry a new idempotency key that is reused on every retry.
+func (this *Client) Do(method, path string, in, out interface{}) (error) {
+
+	var key string
+
+	if method == http.MethodPost || method == http.MethodPut {
+
+		var err error
+
+		if key, err = spool.NewKey(); err != nil {
+			return err
+		}
+	}
+
+	return this.DoKey(method, path, key, in, out)
+}
+
+// DoKey sends a request like Do with a given idempotency key.
+func (this *Client) DoKey(method, path, key string, in, out interface{}) (error) {
+
+	var body []byte
+
+	if in != nil {
+
+		j, err := json.Marshal(in)
+
+		if err != nil {
+			return err
+		}
+
+		if body, err = this.encode(j); err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+
+		if err = this.do(method, path, key, body, out); err == nil {
+			return nil
+		}
+		if attempt >= this.Retries || !IsTemporary(err) {
+			return err
+		}
+
+		time.Sleep(this.delay(attempt, err))
+	}
+}
+
+// do sends a single request.
+func (this *Client) do(method, path, key string, body []byte, out interface{}) (error) {
+
+	var rd io.Reader
+
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, this.BaseURL.String() + path, rd)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(`Accept`, `application/json`)
+	req.Header.Set(`User-Agent`, UserAgent)
+
+	if key != `` {
+		req.Header.Set(server.IdempotencyHeader, key)
+	}
+
+	if body != nil {
+		req.Header.Set(`Content-Type`, `application/json`)
+		if this.Gzip {
+			req.Header.Set(`Content-Encoding`, `gzip`)
+		}
+	}
+
+	if this.Identity != nil && this.Identity.Enrolled {
+		if err := this.Identity.SignRequest(req, body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := this.HTTP.Do(req)
+
+	if err != nil {
+		return &NetError{Err: err}
+	}
+
+	defer resp.Body.Close()
+
+	j, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return &NetError{Err: err}
+	}
+
+	if resp.StatusCode >= 300 {
+		return newAPIError(resp, j)
+	}
+
+	if out != nil && len(j) > 0 {
+		if err := json.Unmarshal(j, out); err != nil {
+			return fmt.Errorf(`decoding response: %v`, err)
+		}
+	}
+
+	return nil
+}
+
+// encode compresses a request body if gzip is enabled.
+func (this *Client) encode(j []byte) ([]byte, error) {
+
+	if !this.Gzip {
+		return j, nil
+	}
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+
+	if _, err := zw.Write(j); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// delay returns the time to wait before a retry: the server's Retry-After
+// value if it sent one, otherwise exponential backoff with full jitter.
+func (this *Client) delay(attempt int, err error) (time.Duration) {
+
+	if e, ok := err.(*APIError); ok && e.retryAfter > 0 {
+		return e.retryAfter
+	}
+
+	d := this.Backoff << uint(attempt)
+
+	if d <= 0 || d > this.MaxBackoff {
+		d = this.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// newAPIError builds an APIError from an error response.
+func newAPIError(resp *http.Response, j []byte) (*APIError) {
+
+	e := &APIError{StatusCode: resp.StatusCode}
+
+	var er struct {
+		Error	string			`json:"error"`
+		Code	string			`json:"code"`
+		Details	[]*usb.SchemaError	`json:"details"`
+	}
+
+	if err := json.Unmarshal(j, &er); err == nil && er.Error != `` {
+		e.Message, e.Code, e.Details = er.Error, er.Code, er.Details
+	} else {
+		e.Message = strings.TrimSpace(string(j))
+	}
+
+	if s, err := strconv.Atoi(resp.Header.Get(`Retry-After`)); err == nil && s > 0 {
+		e.retryAfter = time.Duration(s) * time.Second
+	}
+
+	return e
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	`fmt`
+	`net/http`
+	`time`
+
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+// APIError is an error response from the CMDB server. Code is the
+// server's error code, if it sent one.
+type APIError struct {
+	StatusCode	int
+	Message		string
+	Code		string
+	Details		[]*usb.SchemaError
+
+	retryAfter	time.Duration
+}
+
+// Error implements the error interface for APIError.
+func (this *APIError) Error() (string) {
+	return fmt.Sprintf(`cmdb server: %d %s: %s`,
+		this.StatusCode, http.StatusText(this.StatusCode), this.Message)
+}
+
+// Temporary reports whether the request may succeed if retried: server
+// errors other than 501 Not Implemented, including 503 Service Unavailable
+// when the server's replay cache fails, 429 Too Many Requests, 401
+// Unauthorized for a signature outside the server's clock skew or one
+// already used, since the request is signed again when it is retried, and
+// any response that asks the client to retry later.
+func (this *APIError) Temporary() (bool) {
+
+	switch {
+	case this.retryAfter > 0:
+		return true
+	case this.StatusCode == http.StatusTooManyRequests:
+		return true
+	case this.StatusCode == http.StatusUnauthorized:
+		return this.Code == auth.CodeStale || this.Code == auth.CodeReplayed
+	case this.StatusCode == http.StatusNotImplemented:
+		return false
+	default:
+		return this.StatusCode >= http.StatusInternalServerError
+	}
+}
+
+// NetError wraps a failure to reach the CMDB server.
+type NetError struct {
+	Err	error
+}
+
+// Error implements the error interface for NetError.
+func (this *NetError) Error() (string) {
+	return fmt.Sprintf(`cmdb server unreachable: %v`, this.Err)
+}
+
+// Temporary reports whether the request may succeed if retried. Network
+// errors are always considered temporary.
+func (this *NetError) Temporary() (bool) {
+	return true
+}
+
+// IsNotFound reports whether an error is a 404 Not Found response.
+func IsNotFound(err error) (bool) {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// IsInvalid reports whether an error is a validation failure.
+func IsInvalid(err error) (bool) {
+	code := statusCode(err)
+	return code == http.StatusBadRequest || code == http.StatusUnprocessableEntity
+}
+
+// IsTemporary reports whether an error is a network failure or a response
+// that may succeed if retried.
+func IsTemporary(err error) (bool) {
+	t, ok := err.(interface{ Temporary() (bool) })
+	return ok && t.Temporary()
+}
+
+// statusCode returns the HTTP status code of an APIError, or zero.
+func statusCode(err error) (int) {
+
+	if e, ok := err.(*APIError); ok {
+		return e.StatusCode
+	}
+
+	return 0
+}
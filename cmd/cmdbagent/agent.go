@@ -0,0 +1,313 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`fmt`
+	`log`
+	`os`
+	`time`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/client`
+	`github.com/jscherff/cmdb/config`
+	`github.com/jscherff/cmdb/meta/peripheral`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+	`github.com/jscherff/cmdb/spool`
+
+	ci `github.com/jscherff/cmdb/ci/peripheral/usb`
+)
+
+// Agent enumerates USB devices, audits them against their baselines and
+// reports the results. Baselines are kept in a local store so audits work
+// while the server is unreachable; reports go through the spool, when one
+// is configured, so they are delivered in order once it is back. Devices
+// that do not pass the filters are skipped, and missing vendor and product
+// names are looked up in the USB metadata when it is available. When the
+// client has a signing identity, spooled requests are held until it is
+// enrolled so that they are not rejected as unauthenticated.
+type Agent struct {
+	Client		*client.Client
+	IdentityFile	string
+	EnrollToken	string
+	Rotate		time.Duration
+	Spool		*spool.Spool
+	Store		usb.Store
+	Policy		*usb.AuditPolicy
+	Filters		*config.Filters
+	Meta		*peripheral.Usb
+	Profile		*usb.Profile
+	Severity	usb.Severity
+	LogSeverity	usb.Severity
+	Log		*log.Logger
+}
+
+// Scan enumerates and processes every attached USB device. Devices whose
+// vendor and product IDs fail the filters are not opened.
+func (this *Agent) Scan(ctx *gousb.Context) (error) {
+
+	host, _ := os.Hostname()
+
+	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) (bool) {
+		return this.Filters == nil ||
+			this.Filters.MatchIDs(host, desc.Vendor.String(), desc.Product.String())
+	})
+
+	defer func() {
+		for _, dev := range devs {
+			dev.Close()
+		}
+	}()
+
+	if err != nil {
+		if len(devs) == 0 {
+			return err
+		}
+		this.Log.Printf(`enumeration incomplete: %v`, err)
+	}
+
+	this.Authenticate()
+	this.Flush()
+
+	for _, dev := range devs {
+
+		obj, err := ci.NewObject(dev)
+
+		if err != nil {
+			this.Log.Printf(`device %s:%s: %v`, dev.Desc.Vendor, dev.Desc.Product, err)
+			continue
+		}
+
+		this.Process(obj)
+	}
+
+	this.Flush()
+
+	return nil
+}
+
+// Process audits a device, reports it and saves it as the new baseline.
+// The baseline is kept if the report could be neither sent nor spooled,
+// so that the same changes are detected and reported on the next scan.
+func (this *Agent) Process(obj ci.Auditer) {
+
+	di := obj.GetInfo()
+	fp := di.FP()
+
+	if this.Filters != nil && !this.Filters.Match(di) {
+		return
+	}
+
+	this.lookupNames(di)
+
+	err := di.AuditStore(this.Store)
+
+	if err == usb.ErrNotFound && this.Client != nil {
+		err = this.Client.Audit(di)
+		if client.IsNotFound(err) {
+			err = usb.ErrNotFound
+		}
+	}
+
+	switch {
+
+	case err == usb.ErrNotFound:
+		this.Log.Printf(`%s %s: new device%s`, obj.Type(), fp, this.describe(di))
+
+	case err != nil:
+		this.Log.Printf(`%s %s: audit failed: %v`, obj.Type(), fp, err)
+
+	default:
+		this.Policy.Apply(di)
+		for _, c := range di.GetChangeRecords().AtLeast(this.LogSeverity) {
+			this.Log.Printf(`%s %s: %s: %s %q -> %q`, obj.Type(), fp,
+				c.Severity, c.Field, c.OldValue, c.NewValue)
+		}
+	}
+
+	if err := this.Report(di); err != nil {
+		this.Log.Printf(`%s %s: baseline kept: %v`, obj.Type(), fp, err)
+		return
+	}
+
+	if err := this.Store.Put(di); err != nil {
+		this.Log.Printf(`%s %s: saving baseline: %v`, obj.Type(), fp, err)
+	}
+}
+
+// Report submits a checkin and any reportable changes for a device. With
+// a spool, requests are queued and delivered on the next flush; without
+// one they are sent directly. It returns the first error that kept a
+// request from being sent or queued, such as spool.ErrFull.
+func (this *Agent) Report(di *usb.DeviceInfo) (error) {
+
+	if this.Client == nil {
+		return nil
+	}
+
+	fp := di.FP()
+	changes := di.GetChangeRecords().AtLeast(this.Severity)
+
+	if this.Spool == nil {
+
+		if _, err := this.Client.Checkin(di); err != nil {
+			return fmt.Errorf(`checkin failed: %v`, err)
+		}
+		if len(changes) > 0 {
+			if err := this.Client.ReportChanges(fp, changes); err != nil {
+				return fmt.Errorf(`change report failed: %v`, err)
+			}
+		}
+
+		return nil
+	}
+
+	if e, err := this.Client.CheckinEntry(di); err != nil {
+		return err
+	} else if err := this.Spool.Enqueue(e); err != nil {
+		return fmt.Errorf(`spooling checkin: %v`, err)
+	}
+
+	if len(changes) > 0 {
+		if e, err := this.Client.ChangesEntry(fp, changes); err != nil {
+			return err
+		} else if err := this.Spool.Enqueue(e); err != nil {
+			return fmt.Errorf(`spooling changes: %v`, err)
+		}
+	}
+
+	return nil
+}
+
+// Flush delivers spooled requests in order until the spool is empty or
+// the server is unreachable.
+func (this *Agent) Flush() {
+
+	if this.Client == nil || this.Spool == nil {
+		return
+	}
+
+	if id := this.Client.Identity; id != nil && !id.Enrolled {
+		return
+	}
+
+	n, err := this.Spool.Replay(func(e *spool.Entry) (error) {
+
+		err := this.Client.Replay(e)
+
+		if err != nil && !client.IsTemporary(err) {
+			this.Log.Printf(`spooled %s %s rejected: %v`, e.Kind, e.Key, err)
+		}
+
+		return err
+	})
+
+	if n > 0 {
+		this.Log.Printf(`delivered %d spooled requests`, n)
+	}
+	if err != nil && client.IsTemporary(err) {
+		if pending, _ := this.Spool.Len(); pending > 0 {
+			this.Log.Printf(`server unavailable, %d requests spooled: %v`, pending, err)
+		}
+	}
+}
+
+// lookupNames fills in missing vendor and product names from the USB
+// metadata.
+func (this *Agent) lookupNames(di *usb.DeviceInfo) {
+
+	if this.Meta == nil {
+		return
+	}
+
+	v, err := this.Meta.GetVendor(di.VendorID)
+
+	if err != nil {
+		return
+	}
+
+	if di.VendorName == `` {
+		di.SetVendorName(v.String())
+	}
+
+	if p, err := v.GetProduct(di.ProductID); err == nil && di.ProductName == `` {
+		di.SetProductName(p.String())
+	}
+}
+
+// describe returns the report profile fields of a device as a log suffix.
+func (this *Agent) describe(di *usb.DeviceInfo) (string) {
+
+	if this.Profile == nil {
+		return ``
+	}
+
+	if j, err := di.JSONWith(this.Profile); err != nil {
+		return ``
+	} else {
+		return `: ` + string(j)
+	}
+}
+
+// Authenticate enrolls the client's identity if it is not yet enrolled and
+// rotates it once it is older than the rotation period. The identity file
+// is updated after the server accepts the key.
+func (this *Agent) Authenticate() {
+
+	if this.Client == nil || this.Client.Identity == nil {
+		return
+	}
+
+	id := this.Client.Identity
+
+	if !id.Enrolled {
+
+		if err := this.Client.Enroll(id, this.EnrollToken); err != nil {
+			this.Log.Printf(`key %s: enrollment failed: %v`, id.KeyID, err)
+			return
+		}
+
+		this.Log.Printf(`key %s: enrolled for %s`, id.KeyID, id.Host)
+
+		if err := id.Save(this.IdentityFile); err != nil {
+			this.Log.Printf(`key %s: saving identity: %v`, id.KeyID, err)
+		}
+
+		return
+	}
+
+	if this.Rotate <= 0 || time.Since(id.Created) < this.Rotate {
+		return
+	}
+
+	next, err := auth.NewIdentity(id.Host, id.Algorithm)
+
+	if err != nil {
+		this.Log.Printf(`key %s: rotation failed: %v`, id.KeyID, err)
+		return
+	}
+
+	if err := this.Client.Rotate(next); err != nil {
+		this.Log.Printf(`key %s: rotation failed: %v`, id.KeyID, err)
+		return
+	}
+
+	this.Log.Printf(`key %s: rotated to %s`, id.KeyID, next.KeyID)
+
+	if err := next.Save(this.IdentityFile); err != nil {
+		this.Log.Printf(`key %s: saving identity: %v; the old key expires after the grace period`, next.KeyID, err)
+	}
+}
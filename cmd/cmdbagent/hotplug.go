@@ -0,0 +1,73 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`fmt`
+	`sort`
+	`strings`
+	`time`
+
+	`github.com/google/gousb`
+)
+
+// watchHotplug signals on trigger whenever the set of attached USB devices
+// changes. gousb has no hotplug callbacks, so it compares device
+// descriptors, which can be read without opening the devices, at each
+// interval. It returns when stop is closed.
+func watchHotplug(ctx *gousb.Context, interval time.Duration, trigger chan<- struct{}, stop <-chan struct{}) {
+
+	last := snapshot(ctx)
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-stop:
+			return
+
+		case <-ticker.C:
+
+			if cur := snapshot(ctx); cur != last {
+
+				last = cur
+
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// snapshot returns a string identifying the attached USB devices by bus,
+// address, vendor and product.
+func snapshot(ctx *gousb.Context) (string) {
+
+	var ids []string
+
+	ctx.OpenDevices(func(desc *gousb.DeviceDesc) (bool) {
+		ids = append(ids, fmt.Sprintf(`%d.%d:%s:%s`,
+			desc.Bus, desc.Address, desc.Vendor, desc.Product))
+		return false
+	})
+
+	sort.Strings(ids)
+
+	return strings.Join(ids, ` `)
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command cmdbagent periodically inventories the USB devices attached to a
+// host, audits them against their baselines and reports the results to a
+// CMDB server, spooling reports while the server is unreachable. A scan
+// also runs when devices are attached or removed and on SIGHUP; SIGINT and
+// SIGTERM stop the agent after the scan in progress.
+//
+// Settings are read from the built-in defaults, the file named by -config,
+// CMDB_* environment variables and command-line flags, each overriding the
+// ones before it.
+package main
+
+import (
+	`flag`
+	`log`
+	`math/rand`
+	`os`
+	`os/signal`
+	`sync`
+	`syscall`
+	`time`
+
+	`github.com/google/gousb`
+	`github.com/jscherff/cmdb/config`
+)
+
+var (
+	defaults	= config.Default()
+
+	fConfig		= flag.String(`config`, ``, `configuration file; CMDB_* environment variables override it`)
+	fServer		= flag.String(`server`, defaults.Server.URL, `CMDB server URL; empty to audit locally only`)
+	fStore		= flag.String(`store`, defaults.Store.Path, `baseline store path`)
+	fSpool		= flag.String(`spool`, defaults.Spool.Dir, `spool directory; empty to disable spooling`)
+	fPolicy		= flag.String(`policy`, defaults.Policy.File, `audit policy file; empty for the configured policy`)
+	fUsbIDs		= flag.String(`usbids`, defaults.UsbIDs, `usb.ids cache file; empty to skip name lookups`)
+	fInterval	= flag.Duration(`interval`, time.Duration(defaults.Interval), `time between scans`)
+	fJitter		= flag.Duration(`jitter`, time.Duration(defaults.Jitter), `maximum random delay added to each interval`)
+	fHotplug	= flag.Duration(`hotplug`, time.Duration(defaults.Hotplug), `device change polling interval; 0 to disable`)
+	fOnce		= flag.Bool(`once`, false, `scan once and exit`)
+)
+
+func main() {
+
+	flag.Parse()
+
+	logger := log.New(os.Stderr, `cmdbagent: `, log.LstdFlags)
+	rand.Seed(time.Now().UnixNano())
+
+	cfg, err := loadConfig()
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	agent, err := newAgent(cfg, logger)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	defer agent.Store.Close()
+
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	if *fOnce {
+		if err := agent.Scan(ctx); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	run(agent, cfg, ctx, logger)
+}
+
+// loadConfig builds the configuration from the defaults, the configuration
+// file, the environment and the flags set on the command line, in that
+// order of precedence.
+func loadConfig() (*config.Config, error) {
+
+	cfg := config.Default()
+
+	if *fConfig != `` {
+		if err := cfg.LoadFile(*fConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case `server`:
+			cfg.Server.URL = *fServer
+		case `store`:
+			cfg.Store.Path = *fStore
+		case `spool`:
+			cfg.Spool.Dir = *fSpool
+		case `policy`:
+			cfg.Policy.File, cfg.Policy.Rules = *fPolicy, nil
+		case `usbids`:
+			cfg.UsbIDs = *fUsbIDs
+		case `interval`:
+			cfg.Interval = config.Duration(*fInterval)
+		case `jitter`:
+			cfg.Jitter = config.Duration(*fJitter)
+		case `hotplug`:
+			cfg.Hotplug = config.Duration(*fHotplug)
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// newAgent instantiates an Agent from the configuration.
+func newAgent(cfg *config.Config, logger *log.Logger) (agent *Agent, err error) {
+
+	agent = &Agent{
+		Filters:	&cfg.Filters,
+		Severity:	cfg.Report.Severity,
+		LogSeverity:	cfg.Report.LogSeverity,
+		Log:		logger,
+	}
+
+	if agent.Policy, err = cfg.AuditPolicy(); err != nil {
+		return nil, err
+	}
+	if cfg.Report.Profile != `` {
+		if agent.Profile, err = cfg.Profile(); err != nil {
+			return nil, err
+		}
+	}
+	if agent.Meta, err = cfg.UsbMeta(); err != nil {
+		logger.Printf(`usb.ids unavailable, skipping name lookups: %v`, err)
+	}
+	if agent.Store, err = cfg.OpenStore(); err != nil {
+		return nil, err
+	}
+	if agent.Client, err = cfg.NewClient(); err != nil {
+		return nil, err
+	}
+	if agent.Client == nil {
+		return agent, nil
+	}
+
+	agent.IdentityFile = cfg.Auth.Identity
+	agent.EnrollToken = cfg.Auth.EnrollToken
+	agent.Rotate = time.Duration(cfg.Auth.Rotate)
+
+	if agent.Spool, err = cfg.OpenSpool(); err != nil {
+		return nil, err
+	}
+	if agent.Spool != nil {
+		agent.Spool.Log = logger
+	}
+
+	return agent, nil
+}
+
+// run scans on a schedule, on device changes and on SIGHUP until SIGINT
+// or SIGTERM is received. The first scan is delayed by a random jitter so
+// that agents started together do not report together.
+func run(agent *Agent, cfg *config.Config, ctx *gousb.Context, logger *log.Logger) {
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	rescan := make(chan struct{}, 1)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+	defer close(stop)
+
+	if cfg.Hotplug > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchHotplug(ctx, time.Duration(cfg.Hotplug), rescan, stop)
+		}()
+	}
+
+	timer := time.NewTimer(jitter(time.Duration(cfg.Jitter)))
+	defer timer.Stop()
+
+	for {
+		select {
+
+		case sig := <-sigs:
+
+			if sig != syscall.SIGHUP {
+				logger.Printf(`received %s, shutting down`, sig)
+				return
+			}
+
+			logger.Print(`received SIGHUP, rescanning`)
+
+		case <-rescan:
+			logger.Print(`device change detected, rescanning`)
+
+		case <-timer.C:
+		}
+
+		if err := agent.Scan(ctx); err != nil {
+			logger.Printf(`scan failed: %v`, err)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(time.Duration(cfg.Interval) + jitter(time.Duration(cfg.Jitter)))
+	}
+}
+
+// jitter returns a random duration in [0, max).
+func jitter(max time.Duration) (time.Duration) {
+
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,567 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	`fmt`
+	`net/http`
+	`net/url`
+	`os`
+	`path`
+	`strings`
+	`time`
+
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/client`
+	`github.com/jscherff/cmdb/meta/peripheral`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+	`github.com/jscherff/cmdb/spool`
+	`github.com/jscherff/cmdb/store`
+)
+
+const (
+	StoreFile	string	= `file`
+	StoreBolt	string	= `bolt`
+	EnvPrefix	string	= `CMDB_`
+)
+
+// Config is the configuration of the agent and command-line tools. It is
+// built from Default, overlaid with a JSON file and then with environment
+// variables. A file sets only the keys it contains, for example:
+//
+//	{
+//		"server": {"url": "https://cmdb.example.com"},
+//		"auth": {"identity": "/var/lib/cmdbagent/identity"},
+//		"store": {"type": "bolt", "path": "/var/lib/cmdbagent/store.db"},
+//		"interval": "30m",
+//		"policy": {"rules": [{"field": "FirmwareVer", "severity": "alert"}]},
+//		"filters": {"exclude": [{"vendor_id": "1d6b"}]}
+//	}
+//
+// Each scalar key can also be set by an environment variable named after
+// its path, such as CMDB_SERVER_URL or CMDB_INTERVAL.
+type Config struct {
+	Server		Server		`json:"server"`
+	Auth		Auth		`json:"auth"`
+	Store		Store		`json:"store"`
+	Spool		Spool		`json:"spool"`
+	UsbIDs		string		`json:"usb_ids"`
+	Interval	Duration	`json:"interval"`
+	Jitter		Duration	`json:"jitter"`
+	Hotplug		Duration	`json:"hotplug"`
+	Report		Report		`json:"report"`
+	Policy		Policy		`json:"policy"`
+	Filters		Filters		`json:"filters"`
+}
+
+// Server configures the CMDB server connection. An empty URL disables
+// reporting.
+type Server struct {
+	URL		string		`json:"url"`
+	Timeout		Duration	`json:"timeout"`
+	Retries		int		`json:"retries"`
+	Gzip		bool		`json:"gzip"`
+}
+
+// Auth configures request signing and client certificates. An empty
+// identity file disables signing; otherwise an identity is generated on
+// first use, enrolled with the enrollment token or client certificate and
+// rotated after the rotation period, if it is not zero.
+type Auth struct {
+	Identity	string		`json:"identity"`
+	Algorithm	string		`json:"algorithm"`
+	EnrollToken	string		`json:"enroll_token"`
+	Rotate		Duration	`json:"rotate"`
+	Cert		string		`json:"cert"`
+	Key		string		`json:"key"`
+	CA		string		`json:"ca"`
+}
+
+// Store configures the local baseline store.
+type Store struct {
+	Type		string		`json:"type"`
+	Path		string		`json:"path"`
+}
+
+// Spool configures the offline spool. An empty directory disables
+// spooling. Requests older than the maximum age are not delivered; it
+// must not exceed the server's idempotency TTL.
+type Spool struct {
+	Dir		string		`json:"dir"`
+	MaxBytes	int64		`json:"max_bytes"`
+	MaxEntries	int		`json:"max_entries"`
+	MaxAge		Duration	`json:"max_age"`
+}
+
+// Report selects the profile used to describe devices, an optional file
+// of additional profiles, the minimum severity of changes sent to the
+// server and the minimum severity of changes logged.
+type Report struct {
+	Profile		string		`json:"profile"`
+	ProfilesFile	string		`json:"profiles_file"`
+	Severity	usb.Severity	`json:"severity"`
+	LogSeverity	usb.Severity	`json:"log_severity"`
+}
+
+// Policy configures the audit policy, either from a policy file or from
+// inline rules and a default severity.
+type Policy struct {
+	File		string		`json:"file"`
+	Default		usb.Severity	`json:"default"`
+	Rules		[]*usb.AuditRule `json:"rules"`
+}
+
+// Filters select the devices to process. A device is processed if it
+// matches any include filter, or there are none, and no exclude filter.
+type Filters struct {
+	Include		[]*usb.Filter	`json:"include"`
+	Exclude		[]*usb.Filter	`json:"exclude"`
+}
+
+// Duration is a time.Duration represented in JSON and the environment as
+// a string such as '90s' or '1h30m'.
+type Duration time.Duration
+
+// Default returns the built-in configuration.
+func Default() (*Config) {
+
+	return &Config{
+		Server: Server{
+			Timeout:	Duration(client.DefaultTimeout),
+			Retries:	client.DefaultRetries,
+			Gzip:		true,
+		},
+		Auth: Auth{
+			Algorithm:	auth.Ed25519,
+			Rotate:		Duration(30 * 24 * time.Hour),
+		},
+		Store: Store{
+			Type:		StoreFile,
+			Path:		`/var/lib/cmdbagent/baselines`,
+		},
+		Spool: Spool{
+			Dir:		`/var/lib/cmdbagent/spool`,
+			MaxBytes:	spool.DefaultMaxBytes,
+			MaxEntries:	spool.DefaultMaxEntries,
+			MaxAge:		Duration(spool.DefaultMaxAge),
+		},
+		Interval:	Duration(time.Hour),
+		Jitter:		Duration(5 * time.Minute),
+		Hotplug:	Duration(5 * time.Second),
+		Report: Report{
+			Profile:	`summary`,
+			Severity:	usb.SeverityInfo,
+			LogSeverity:	usb.SeverityWarn,
+		},
+		Policy: Policy{
+			Default:	usb.SeverityInfo,
+		},
+	}
+}
+
+// Load returns the default configuration overlaid with a file, if fn is
+// not empty, and with the environment, after validating the result.
+func Load(fn string) (*Config, error) {
+
+	this := Default()
+
+	if fn != `` {
+		if err := this.LoadFile(fn); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := this.LoadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Validate checks the configuration and returns Errors naming every
+// offending key, or nil.
+func (this *Config) Validate() (error) {
+
+	var errs Errors
+
+	add := func(key, format string, a ...interface{}) {
+		errs = append(errs, &KeyError{key, fmt.Sprintf(format, a...)})
+	}
+
+	if this.Server.URL != `` {
+		if u, err := url.Parse(this.Server.URL); err != nil {
+			add(`server.url`, `invalid URL: %v`, err)
+		} else if u.Scheme != `http` && u.Scheme != `https` {
+			add(`server.url`, `scheme must be http or https`)
+		} else if u.Host == `` {
+			add(`server.url`, `missing host`)
+		}
+	}
+	if this.Server.Timeout <= 0 {
+		add(`server.timeout`, `must be positive`)
+	}
+	if this.Server.Retries < 0 {
+		add(`server.retries`, `must not be negative`)
+	}
+
+	switch this.Auth.Algorithm {
+	case auth.Ed25519, auth.HMACSHA256:
+	default:
+		add(`auth.algorithm`, `must be %q or %q`, auth.Ed25519, auth.HMACSHA256)
+	}
+	if this.Auth.Rotate < 0 {
+		add(`auth.rotate`, `must not be negative`)
+	}
+	if (this.Auth.Cert == ``) != (this.Auth.Key == ``) {
+		add(`auth.key`, `auth.cert and auth.key must be set together`)
+	}
+	if this.Auth.Cert != `` && !strings.HasPrefix(this.Server.URL, `https://`) {
+		add(`auth.cert`, `requires an https server.url`)
+	}
+	if this.Auth.CA != `` && !strings.HasPrefix(this.Server.URL, `https://`) {
+		add(`auth.ca`, `requires an https server.url`)
+	}
+
+	switch this.Store.Type {
+	case StoreFile, StoreBolt:
+	default:
+		add(`store.type`, `must be %q or %q`, StoreFile, StoreBolt)
+	}
+	if this.Store.Path == `` {
+		add(`store.path`, `must not be empty`)
+	}
+
+	if this.Spool.MaxBytes < 0 {
+		add(`spool.max_bytes`, `must not be negative`)
+	}
+	if this.Spool.MaxEntries < 0 {
+		add(`spool.max_entries`, `must not be negative`)
+	}
+	if this.Spool.MaxAge < 0 {
+		add(`spool.max_age`, `must not be negative`)
+	}
+
+	if this.Interval <= 0 {
+		add(`interval`, `must be positive`)
+	}
+	if this.Jitter < 0 {
+		add(`jitter`, `must not be negative`)
+	}
+	if this.Hotplug < 0 {
+		add(`hotplug`, `must not be negative`)
+	}
+
+	if this.Report.ProfilesFile != `` {
+		if err := usb.LoadProfiles(this.Report.ProfilesFile); err != nil {
+			add(`report.profiles_file`, `%v`, err)
+		}
+	}
+	if this.Report.Profile != `` {
+		if _, err := usb.GetProfile(this.Report.Profile); err != nil {
+			add(`report.profile`, `unknown profile %q`, this.Report.Profile)
+		}
+	}
+	if !this.Report.Severity.Valid() {
+		add(`report.severity`, `unknown severity %q`, this.Report.Severity)
+	}
+	if !this.Report.LogSeverity.Valid() {
+		add(`report.log_severity`, `unknown severity %q`, this.Report.LogSeverity)
+	}
+
+	if this.Policy.File != `` && len(this.Policy.Rules) > 0 {
+		add(`policy.rules`, `must be empty when policy.file is set`)
+	}
+	if !this.Policy.Default.Valid() {
+		add(`policy.default`, `unknown severity %q`, this.Policy.Default)
+	}
+
+	for i, r := range this.Policy.Rules {
+
+		key := fmt.Sprintf(`policy.rules[%d]`, i)
+
+		if r == nil {
+			add(key, `must not be null`)
+			continue
+		}
+		if !r.Severity.Valid() {
+			add(key + `.severity`, `unknown severity %q`, r.Severity)
+		}
+
+		for k, p := range map[string]string{`field`: r.Field, `host`: r.Host, `type`: r.Type} {
+			if _, err := path.Match(p, ``); err != nil {
+				add(key + `.` + k, `bad pattern %q`, p)
+			}
+		}
+	}
+
+	for name, fs := range map[string][]*usb.Filter{`include`: this.Filters.Include, `exclude`: this.Filters.Exclude} {
+
+		for i, f := range fs {
+
+			key := fmt.Sprintf(`filters.%s[%d]`, name, i)
+
+			if f == nil {
+				add(key, `must not be null`)
+				continue
+			}
+
+			for k, p := range map[string]string{
+				`host_name`:		f.HostName,
+				`vendor_id`:		f.VendorID,
+				`product_id`:		f.ProductID,
+				`serial_number`:	f.SerialNum,
+				`object_type`:		f.ObjectType,
+			} {
+				if _, err := path.Match(p, ``); err != nil {
+					add(key + `.` + k, `bad pattern %q`, p)
+				}
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	errs.sort()
+
+	return errs
+}
+
+// AuditPolicy returns the configured audit policy: the policy file if one
+// is set, the inline rules if there are any, or the default policy.
+func (this *Config) AuditPolicy() (*usb.AuditPolicy, error) {
+
+	switch {
+
+	case this.Policy.File != ``:
+		return usb.LoadAuditPolicy(this.Policy.File)
+
+	case len(this.Policy.Rules) > 0:
+		return usb.NewAuditPolicy(this.Policy.Default, this.Policy.Rules...)
+
+	default:
+		return usb.DefaultAuditPolicy(), nil
+	}
+}
+
+// Profile returns the configured report profile.
+func (this *Config) Profile() (*usb.Profile, error) {
+	return usb.GetProfile(this.Report.Profile)
+}
+
+// OpenStore opens the configured baseline store.
+func (this *Config) OpenStore() (usb.Store, error) {
+
+	switch this.Store.Type {
+
+	case StoreBolt:
+		return store.NewBoltStore(this.Store.Path)
+
+	case StoreFile:
+		return store.NewFileStore(this.Store.Path)
+
+	default:
+		return nil, &KeyError{`store.type`, fmt.Sprintf(`unknown store type %q`, this.Store.Type)}
+	}
+}
+
+// OpenSpool opens the configured spool, or returns nil if spooling is
+// disabled.
+func (this *Config) OpenSpool() (*spool.Spool, error) {
+
+	if this.Spool.Dir == `` {
+		return nil, nil
+	}
+
+	s, err := spool.Open(this.Spool.Dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.MaxBytes, s.MaxEntries = this.Spool.MaxBytes, this.Spool.MaxEntries
+	s.MaxAge = time.Duration(this.Spool.MaxAge)
+
+	return s, nil
+}
+
+// NewClient returns a client for the configured server, or nil if no
+// server is configured.
+func (this *Config) NewClient() (*client.Client, error) {
+
+	if this.Server.URL == `` {
+		return nil, nil
+	}
+
+	c, err := client.NewClient(this.Server.URL)
+
+	if err != nil {
+		return nil, &KeyError{`server.url`, err.Error()}
+	}
+
+	c.HTTP.Timeout = time.Duration(this.Server.Timeout)
+	c.Retries, c.Gzip = this.Server.Retries, this.Server.Gzip
+
+	if this.Auth.Cert != `` || this.Auth.CA != `` {
+
+		tc, err := auth.ClientTLS(this.Auth.Cert, this.Auth.Key, this.Auth.CA)
+
+		if err != nil {
+			return nil, &KeyError{`auth.cert`, err.Error()}
+		}
+
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = tc
+		c.HTTP.Transport = tr
+	}
+
+	if c.Identity, err = this.Identity(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Identity loads the agent's signing identity, generating and saving a
+// new one for the host if the file does not exist. It returns nil if
+// signing is disabled.
+func (this *Config) Identity() (*auth.Identity, error) {
+
+	if this.Auth.Identity == `` {
+		return nil, nil
+	}
+
+	id, err := auth.LoadIdentity(this.Auth.Identity)
+
+	if !os.IsNotExist(err) {
+		return id, err
+	}
+
+	host, err := os.Hostname()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if id, err = auth.NewIdentity(host, this.Auth.Algorithm); err != nil {
+		return nil, err
+	}
+
+	return id, id.Save(this.Auth.Identity)
+}
+
+// UsbMeta loads the USB vendor and product names from the configured
+// usb.ids cache, or returns nil if no cache is configured.
+func (this *Config) UsbMeta() (*peripheral.Usb, error) {
+
+	if this.UsbIDs == `` {
+		return nil, nil
+	}
+
+	return peripheral.NewUsb(this.UsbIDs)
+}
+
+// Match reports whether a device passes the filters.
+func (this *Filters) Match(di *usb.DeviceInfo) (bool) {
+
+	for _, f := range this.Exclude {
+		if f.Match(di) {
+			return false
+		}
+	}
+
+	if len(this.Include) == 0 {
+		return true
+	}
+
+	for _, f := range this.Include {
+		if f.Match(di) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchIDs reports whether a device on a host with the given vendor and
+// product IDs may be processed, judging by those fields alone. Filters on
+// other fields are assumed to match an include filter and not to match an
+// exclude filter, so a device rejected here is also rejected by Match and
+// need not be opened.
+func (this *Filters) MatchIDs(host, vid, pid string) (bool) {
+
+	di := &usb.DeviceInfo{HostName: host, VendorID: vid, ProductID: pid}
+
+	for _, f := range this.Exclude {
+		if f.SerialNum == `` && f.ObjectType == `` && f.Match(di) {
+			return false
+		}
+	}
+
+	if len(this.Include) == 0 {
+		return true
+	}
+
+	for _, f := range this.Include {
+
+		ids := *f
+		ids.SerialNum, ids.ObjectType = ``, ``
+
+		if ids.Match(di) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the duration in time.Duration format.
+func (this Duration) String() (string) {
+	return time.Duration(this).String()
+}
+
+// MarshalJSON encodes the duration as a string.
+func (this Duration) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + this.String() + `"`), nil
+}
+
+// UnmarshalJSON decodes a duration string.
+func (this *Duration) UnmarshalJSON(j []byte) (error) {
+
+	s := string(j)
+
+	if len(s) < 2 || !strings.HasPrefix(s, `"`) || !strings.HasSuffix(s, `"`) {
+		return fmt.Errorf(`duration must be a string such as "90s"`)
+	}
+
+	return this.Set(s[1:len(s) - 1])
+}
+
+// Set parses a duration string.
+func (this *Duration) Set(s string) (error) {
+
+	if d, err := time.ParseDuration(s); err != nil {
+		return fmt.Errorf(`invalid duration %q`, s)
+	} else {
+		*this = Duration(d)
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`reflect`
+	`sort`
+	`strconv`
+	`strings`
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// KeyError is a configuration error for a key, given by its dotted path
+// such as 'server.url' or by its environment variable name.
+type KeyError struct {
+	Key		string
+	Message		string
+}
+
+// Error implements the error interface.
+func (this *KeyError) Error() (string) {
+	return this.Key + `: ` + this.Message
+}
+
+// Errors is a list of configuration errors.
+type Errors []*KeyError
+
+// Error implements the error interface.
+func (this Errors) Error() (string) {
+
+	ss := make([]string, len(this))
+
+	for i, e := range this {
+		ss[i] = e.Error()
+	}
+
+	return strings.Join(ss, `; `)
+}
+
+// sort orders the errors by key.
+func (this Errors) sort() {
+	sort.SliceStable(this, func(i, j int) (bool) {
+		return this[i].Key < this[j].Key
+	})
+}
+
+// LoadFile overlays the configuration with the keys set in a JSON file.
+// Keys the file does not set keep their current values; unknown keys and
+// values of the wrong type are reported as Errors.
+func (this *Config) LoadFile(fn string) (error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]interface{})
+
+	if err := json.Unmarshal(j, &m); err != nil {
+		return fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	var errs Errors
+
+	overlay(``, reflect.ValueOf(this).Elem(), m, &errs)
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	errs.sort()
+
+	return errs
+}
+
+// LoadEnv overlays the configuration with environment variables.
+func (this *Config) LoadEnv() (error) {
+	return this.LoadEnvFunc(os.LookupEnv)
+}
+
+// LoadEnvFunc overlays the configuration with variables returned by a
+// lookup function. The variable for a key is EnvPrefix followed by the
+// key path in upper case with dots replaced by underscores, so that
+// 'server.url' is set by CMDB_SERVER_URL. Only string, number, boolean
+// and duration keys can be set this way.
+func (this *Config) LoadEnvFunc(lookup func(string) (string, bool)) (error) {
+
+	var errs Errors
+
+	walk(``, reflect.ValueOf(this).Elem(), func(key string, v reflect.Value) {
+
+		name := EnvVar(key)
+		s, ok := lookup(name)
+
+		if !ok {
+			return
+		}
+
+		if err := setString(v, s); err != nil {
+			errs = append(errs, &KeyError{name, err.Error()})
+		}
+	})
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	errs.sort()
+
+	return errs
+}
+
+// EnvVar returns the environment variable name for a key path.
+func EnvVar(key string) (string) {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, `.`, `_`, -1))
+}
+
+// Keys returns the paths of the keys that can be set by environment
+// variables.
+func Keys() (keys []string) {
+
+	walk(``, reflect.ValueOf(Default()).Elem(), func(key string, v reflect.Value) {
+		keys = append(keys, key)
+	})
+
+	return keys
+}
+
+// overlay decodes the values in m into the fields of struct v with the
+// corresponding JSON names, descending into nested objects.
+func overlay(prefix string, v reflect.Value, m map[string]interface{}, errs *Errors) {
+
+	names := make([]string, 0, len(m))
+
+	for k := range m {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	for _, k := range names {
+
+		key := join(prefix, k)
+		f, ok := field(v, k)
+
+		if !ok {
+			*errs = append(*errs, &KeyError{key, `unknown key`})
+			continue
+		}
+
+		if sub, ok := m[k].(map[string]interface{}); ok && f.Kind() == reflect.Struct {
+			overlay(key, f, sub, errs)
+			continue
+		}
+
+		j, err := json.Marshal(m[k])
+
+		if err == nil {
+			err = json.Unmarshal(j, f.Addr().Interface())
+		}
+
+		if err != nil {
+			*errs = append(*errs, &KeyError{key, strings.TrimPrefix(err.Error(), `json: `)})
+		}
+	}
+}
+
+// walk calls fn with the path and value of every scalar field of struct
+// v, descending into nested structs.
+func walk(prefix string, v reflect.Value, fn func(string, reflect.Value)) {
+
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+
+		key := join(prefix, jsonName(t.Field(i)))
+		f := v.Field(i)
+
+		switch {
+
+		case f.Type() == durationType:
+			fn(key, f)
+
+		case f.Kind() == reflect.Struct:
+			walk(key, f, fn)
+
+		case f.Kind() == reflect.String, f.Kind() == reflect.Bool,
+			f.Kind() >= reflect.Int && f.Kind() <= reflect.Int64:
+			fn(key, f)
+		}
+	}
+}
+
+// setString parses a string into a scalar field.
+func setString(v reflect.Value, s string) (error) {
+
+	switch {
+
+	case v.Type() == durationType:
+		return v.Addr().Interface().(*Duration).Set(s)
+
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+
+	case v.Kind() == reflect.Bool:
+		if b, err := strconv.ParseBool(s); err != nil {
+			return fmt.Errorf(`invalid boolean %q`, s)
+		} else {
+			v.SetBool(b)
+		}
+
+	default:
+		if n, err := strconv.ParseInt(s, 10, v.Type().Bits()); err != nil {
+			return fmt.Errorf(`invalid integer %q`, s)
+		} else {
+			v.SetInt(n)
+		}
+	}
+
+	return nil
+}
+
+// field returns the field of struct v with a JSON name.
+func field(v reflect.Value, name string) (reflect.Value, bool) {
+
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// jsonName returns the JSON name of a struct field.
+func jsonName(sf reflect.StructField) (string) {
+
+	if name := strings.Split(sf.Tag.Get(`json`), `,`)[0]; name != `` {
+		return name
+	}
+
+	return sf.Name
+}
+
+// join appends a key to a dotted key path.
+func join(prefix, key string) (string) {
+
+	if prefix == `` {
+		return key
+	}
+
+	return prefix + `.` + key
+}
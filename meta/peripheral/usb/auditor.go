@@ -0,0 +1,336 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`sort`
+	`time`
+)
+
+const (
+	AuditUnchanged		AuditStatus	= `unchanged`
+	AuditChanged		AuditStatus	= `changed`
+	AuditNew		AuditStatus	= `new`
+	AuditMissing		AuditStatus	= `missing`
+
+	MatchFingerprint	string	= `fingerprint`
+	MatchSerial		string	= `serial`
+	MatchPort		string	= `port`
+
+	// PortPathField is the field name used in change records for devices
+	// that moved to a different port.
+	PortPathField		string	= `PortPath`
+
+	auditFileMode		os.FileMode	= 0640
+)
+
+// AuditStatus describes the outcome of auditing a single device.
+type AuditStatus string
+
+// AuditResult is the outcome of auditing a single device against its
+// baseline. Device is nil for missing devices and Baseline is nil for
+// new devices.
+type AuditResult struct {
+	Status		AuditStatus	`json:"status"`
+	Moved		bool		`json:"moved"`
+	MatchedBy	string		`json:"matched_by,omitempty"`
+	Source		string		`json:"source,omitempty"`
+	Device		*DeviceInfo	`json:"device,omitempty"`
+	Baseline	*DeviceInfo	`json:"baseline,omitempty"`
+	Changes		Changes		`json:"changes,omitempty"`
+}
+
+// AuditReport lists the audit results for all current and baseline devices
+// and the baselines that were skipped because they could not be read.
+type AuditReport struct {
+	Collector	string		`json:"collector"`
+	Started		time.Time	`json:"started"`
+	Results		[]*AuditResult	`json:"results"`
+	Skipped		map[string]string `json:"skipped,omitempty"`
+}
+
+// Count returns the number of results with a given status.
+func (this *AuditReport) Count(s AuditStatus) (n int) {
+
+	for _, r := range this.Results {
+		if r.Status == s {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Moved returns the number of devices that moved to a different port.
+func (this *AuditReport) Moved() (n int) {
+
+	for _, r := range this.Results {
+		if r.Moved {
+			n++
+		}
+	}
+
+	return n
+}
+
+// JSON reports the audit in JSON format.
+func (this *AuditReport) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the audit in formatted JSON format.
+func (this *AuditReport) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// Save writes the audit report to a JSON file.
+func (this *AuditReport) Save(fn string) (error) {
+
+	if j, err := this.PrettyJSON(); err != nil {
+		return err
+	} else {
+		return ioutil.WriteFile(fn, j, auditFileMode)
+	}
+}
+
+// Auditor audits a set of current devices against a set of baselines,
+// pairing devices by fingerprint, then serial number, then port. Changes
+// are classified by the auditor's own policy, never by DefaultPolicy.
+// Skipped lists baselines that could not be read, keyed by source name;
+// they are carried into every report.
+type Auditor struct {
+	Baselines	map[string]*DeviceInfo
+	Skipped		map[string]error
+	Policy		*AuditPolicy
+}
+
+// NewAuditor instantiates an Auditor with baselines keyed by source name.
+// The policy classifies the severity of detected changes; if it is nil,
+// a new DefaultAuditPolicy is used.
+func NewAuditor(baselines map[string]*DeviceInfo, policy *AuditPolicy) (*Auditor) {
+
+	if policy == nil {
+		policy = DefaultAuditPolicy()
+	}
+
+	return &Auditor{Baselines: baselines, Policy: policy}
+}
+
+// NewDirAuditor instantiates an Auditor with baselines read from every
+// JSON file in a directory. Files that are not valid baselines are listed
+// in the auditor's Skipped map rather than failing the audit.
+func NewDirAuditor(dir string, policy *AuditPolicy) (*Auditor, error) {
+
+	baselines, skipped, err := LoadBaselines(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := NewAuditor(baselines, policy)
+	this.Skipped = skipped
+
+	return this, nil
+}
+
+// LoadBaselines reads every JSON file in a directory as a DeviceInfo
+// object and returns the objects keyed by file path. Files that cannot be
+// read or are not valid DeviceInfo JSON are returned with their errors in
+// the skipped map, so one bad baseline does not stop the audit; err is
+// reserved for failures to list the directory.
+func LoadBaselines(dir string) (baselines map[string]*DeviceInfo, skipped map[string]error, err error) {
+
+	fns, err := filepath.Glob(filepath.Join(dir, `*.json`))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	baselines = make(map[string]*DeviceInfo)
+	skipped = make(map[string]error)
+
+	for _, fn := range fns {
+
+		di := &DeviceInfo{}
+
+		if j, err := ioutil.ReadFile(fn); err != nil {
+			skipped[fn] = err
+		} else if err := di.RestoreJSON(j); err != nil {
+			skipped[fn] = err
+		} else {
+			baselines[fn] = di
+		}
+	}
+
+	return baselines, skipped, nil
+}
+
+// Audit pairs each current device with a baseline and reports changed,
+// unchanged, new, missing and moved devices. A move to a different hub
+// port is recorded as a change to the port path; bus numbers, which can
+// change across reboots, are ignored. The change records of each
+// paired device are also stored in the device.
+func (this *Auditor) Audit(current []*DeviceInfo) (*AuditReport, error) {
+
+	report := &AuditReport{Started: time.Now()}
+
+	for src, err := range this.Skipped {
+		if report.Skipped == nil {
+			report.Skipped = make(map[string]string)
+		}
+		report.Skipped[src] = err.Error()
+	}
+
+	if len(current) > 0 {
+		report.Collector = current[0].HostName
+	} else if host, err := os.Hostname(); err == nil {
+		report.Collector = host
+	}
+
+	var sources []string
+
+	for src := range this.Baselines {
+		sources = append(sources, src)
+	}
+
+	sort.Strings(sources)
+
+	results := make([]*AuditResult, len(current))
+	matched := make(map[string]bool)
+
+	for _, by := range []string{MatchFingerprint, MatchSerial, MatchPort} {
+
+		for i, di := range current {
+
+			if results[i] != nil {
+				continue
+			}
+
+			key := matchKey(by, di)
+
+			if key == `` {
+				continue
+			}
+
+			for _, src := range sources {
+
+				if matched[src] || matchKey(by, this.Baselines[src]) != key {
+					continue
+				}
+
+				matched[src] = true
+
+				if r, err := this.compare(di, src, by); err != nil {
+					return nil, err
+				} else {
+					results[i] = r
+				}
+
+				break
+			}
+		}
+	}
+
+	for i, di := range current {
+
+		if results[i] == nil {
+			results[i] = &AuditResult{Status: AuditNew, Device: di}
+		}
+
+		report.Results = append(report.Results, results[i])
+	}
+
+	for _, src := range sources {
+
+		if !matched[src] {
+			report.Results = append(report.Results, &AuditResult{
+				Status:		AuditMissing,
+				Source:		src,
+				Baseline:	this.Baselines[src],
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// compare audits a current device against a paired baseline.
+func (this *Auditor) compare(di *DeviceInfo, src, by string) (*AuditResult, error) {
+
+	baseline := this.Baselines[src]
+
+	ss, err := DefaultComparator.Compare(baseline, di)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &AuditResult{
+		Status:		AuditUnchanged,
+		MatchedBy:	by,
+		Source:		src,
+		Device:		di,
+		Baseline:	baseline,
+	}
+
+	if baseline.PortPath != `` && di.PortPath != `` && baseline.PortPath != di.PortPath {
+		r.Moved = true
+		ss = append(ss, []string{PortPathField, baseline.PortPath, di.PortPath})
+	}
+
+	r.Changes = NewChanges(ss, src, di.HostName)
+
+	if len(r.Changes) > 0 {
+		r.Status = AuditChanged
+	}
+
+	di.SetChangeRecords(r.Changes)
+
+	if this.Policy != nil {
+		this.Policy.Apply(di)
+	}
+
+	return r, nil
+}
+
+// matchKey returns the key used to pair devices by a given method, or an
+// empty string if the device cannot be paired by that method.
+func matchKey(by string, di *DeviceInfo) (string) {
+
+	switch by {
+
+	case MatchFingerprint:
+		return di.FP()
+
+	case MatchSerial:
+		if di.SerialNum == `` {
+			return ``
+		}
+		return fmt.Sprintf(`%s:%s:%s`, di.VendorID, di.ProductID, di.SerialNum)
+
+	case MatchPort:
+		if di.PortPath == `` {
+			return ``
+		}
+		return fmt.Sprintf(`%s:%s:%s:%s`, di.HostName, di.VendorID, di.ProductID, di.PortPath)
+	}
+
+	return ``
+}
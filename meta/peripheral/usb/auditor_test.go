@@ -0,0 +1,97 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`encoding/json`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestNewDirAuditor(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `auditor`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	baseline := &DeviceInfo{
+		HostName:	`host01`,
+		VendorID:	`0801`,
+		ProductID:	`0001`,
+		SerialNum:	`B000001`,
+		FirmwareVer:	`1.0`,
+	}
+
+	j, err := json.Marshal(baseline)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, bad := filepath.Join(dir, `good.json`), filepath.Join(dir, `bad.json`)
+
+	if err := ioutil.WriteFile(good, j, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, []byte(`{"vendor_id":`), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(p *AuditPolicy) { DefaultPolicy = p }(DefaultPolicy)
+	DefaultPolicy = nil
+
+	a, err := NewDirAuditor(dir, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.Baselines) != 1 || a.Baselines[good] == nil {
+		t.Fatalf(`baselines: got %v, want only %s`, a.Baselines, good)
+	}
+	if len(a.Skipped) != 1 || a.Skipped[bad] == nil {
+		t.Fatalf(`skipped: got %v, want only %s`, a.Skipped, bad)
+	}
+
+	current := *baseline
+	current.SerialNum = `B000002`
+	current.FirmwareVer = `1.1`
+
+	report, err := a.Audit([]*DeviceInfo{&current})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := report.Skipped[bad]; !ok {
+		t.Errorf(`report does not list skipped baseline %s`, bad)
+	}
+
+	if len(current.Changes) == 0 {
+		t.Fatal(`no changes recorded`)
+	}
+
+	for _, c := range current.Changes {
+		if c.Severity == `` {
+			t.Errorf(`change to %s not classified without DefaultPolicy`, c.Field)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`encoding/xml`
+	`time`
+)
+
+var changeHeader = []string{
+	`field`,
+	`old_value`,
+	`new_value`,
+	`detected_at`,
+	`source`,
+	`collector`,
+	`severity`,
+}
+
+// Change records a single property change detected by an audit.
+type Change struct {
+	Field		string		`json:"field"       xml:"field"`
+	OldValue	string		`json:"old_value"   xml:"old_value"`
+	NewValue	string		`json:"new_value"   xml:"new_value"`
+	DetectedAt	time.Time	`json:"detected_at" xml:"detected_at"`
+	Source		string		`json:"source"      xml:"source"`
+	Collector	string		`json:"collector"   xml:"collector"`
+	Severity	Severity	`json:"severity,omitempty" xml:"severity,omitempty"`
+}
+
+// Changes is a list of property changes.
+type Changes []*Change
+
+// NewChanges converts a list of change tuples of field name, old value,
+// and new value to a list of Change records. Source identifies the
+// baseline the device was compared with and collector identifies the
+// host that detected the changes.
+func NewChanges(ss [][]string, source, collector string) (this Changes) {
+
+	now := time.Now()
+
+	for _, s := range ss {
+
+		if len(s) < 3 {
+			continue
+		}
+
+		this = append(this, &Change{
+			Field:		s[0],
+			OldValue:	s[1],
+			NewValue:	s[2],
+			DetectedAt:	now,
+			Source:		source,
+			Collector:	collector,
+		})
+	}
+
+	return this
+}
+
+// Triples converts the changes to a list of tuples of field name, old
+// value, and new value.
+func (this Changes) Triples() (ss [][]string) {
+
+	for _, c := range this {
+		ss = append(ss, []string{c.Field, c.OldValue, c.NewValue})
+	}
+
+	return ss
+}
+
+// DeepCopy returns a copy of the changes that shares no records with the
+// original.
+func (this Changes) DeepCopy() (that Changes) {
+
+	if this == nil {
+		return nil
+	}
+
+	that = make(Changes, len(this))
+
+	for i, c := range this {
+		cc := *c
+		that[i] = &cc
+	}
+
+	return that
+}
+
+// JSON reports the changes in JSON format.
+func (this Changes) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the changes in formatted JSON format.
+func (this Changes) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// XML reports the changes in XML format.
+func (this Changes) XML() ([]byte, error) {
+	return xml.Marshal(changesXML{Changes: this})
+}
+
+// PrettyXML reports the changes in formatted XML format.
+func (this Changes) PrettyXML() ([]byte, error) {
+	return xml.MarshalIndent(changesXML{Changes: this}, MarshalPrefix, MarshalIndent)
+}
+
+// CSV reports the changes in CSV format with a header row.
+func (this Changes) CSV() ([]byte, error) {
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+
+	if err := w.Write(changeHeader); err != nil {
+		return nil, err
+	}
+
+	for _, c := range this {
+
+		if err := w.Write([]string{
+			c.Field,
+			c.OldValue,
+			c.NewValue,
+			c.DetectedAt.Format(time.RFC3339),
+			c.Source,
+			c.Collector,
+			string(c.Severity),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+// changesXML wraps a list of changes in a single XML root element.
+type changesXML struct {
+	XMLName		xml.Name	`xml:"changes"`
+	Changes		Changes		`xml:"change"`
+}
+
+// ChangeLog accumulates change records across audits.
+type ChangeLog struct {
+	Changes		Changes		`json:"changes"`
+}
+
+// Append adds change records to the log.
+func (this *ChangeLog) Append(c Changes) {
+	this.Changes = append(this.Changes, c...)
+}
+
+// Since returns the change records detected at or after a given time.
+func (this *ChangeLog) Since(t time.Time) (c Changes) {
+
+	for _, ch := range this.Changes {
+		if !ch.DetectedAt.Before(t) {
+			c = append(c, ch)
+		}
+	}
+
+	return c
+}
+
+// Clear removes all change records from the log.
+func (this *ChangeLog) Clear() {
+	this.Changes = nil
+}
@@ -0,0 +1,390 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`fmt`
+	`reflect`
+	`regexp`
+	`sort`
+	`strings`
+	`sync`
+)
+
+var (
+	// DefaultComparator is used by CompareFile, CompareJSON and the
+	// Auditor. It honors 'cmp' tag exclusions, compares IDs as case-
+	// insensitive hex and ignores surrounding whitespace in versions.
+	DefaultComparator = NewComparator(`cmp`).
+		Normalize(NormalizeHex, `VendorID`, `ProductID`).
+		Normalize(NormalizeSpace, `ProductVer`, `FirmwareVer`, `SoftwareID`)
+
+	// versionRgx splits a version string into numeric and other parts.
+	versionRgx = regexp.MustCompile(`\d+|[^\d.]+`)
+)
+
+// Normalizer transforms a string value before comparison so that
+// equivalent representations compare equal.
+type Normalizer func(string) (string)
+
+// NormalizeHex normalizes hexadecimal values to lowercase without a '0x'
+// prefix or leading zeros.
+func NormalizeHex(s string) (string) {
+
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), `0x`)
+
+	if t := strings.TrimLeft(s, `0`); t != `` {
+		return t
+	} else if s != `` {
+		return `0`
+	}
+
+	return s
+}
+
+// NormalizeSpace trims leading and trailing whitespace.
+func NormalizeSpace(s string) (string) {
+	return strings.TrimSpace(s)
+}
+
+// NormalizeVersion normalizes version strings for semantic comparison:
+// a leading 'v' is dropped, numeric components lose leading zeros and
+// trailing zero components are removed, so '1.10', 'v1.10.0' and '01.10'
+// compare equal.
+func NormalizeVersion(s string) (string) {
+
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), `v`)
+	parts := versionRgx.FindAllString(s, -1)
+
+	for i, p := range parts {
+		if p[0] >= '0' && p[0] <= '9' {
+			if parts[i] = strings.TrimLeft(p, `0`); parts[i] == `` {
+				parts[i] = `0`
+			}
+		}
+	}
+
+	for len(parts) > 1 && parts[len(parts)-1] == `0` {
+		parts = parts[:len(parts)-1]
+	}
+
+	return strings.Join(parts, `.`)
+}
+
+// Comparator compares two values of the same type field by field,
+// descending into nested structs, pointers, slices, arrays and maps.
+// Struct fields whose exclusion tag is '-' are skipped. Each difference is
+// reported as a tuple of field path, old value and new value, where the
+// path is the struct field name for top-level fields and is extended with
+// '.Name', '[index]' or '[key]' for nested values. A Comparator is safe
+// for concurrent use, including registering normalizers while comparisons
+// are in progress.
+type Comparator struct {
+	Tag		string
+
+	mu		sync.RWMutex
+	normalizers	map[string]Normalizer
+	plans		map[reflect.Type][]compareField
+}
+
+// comparison holds the normalizers in effect for a single Compare call.
+type comparison struct {
+	*Comparator
+	normalizers	map[string]Normalizer
+}
+
+// compareField is a precomputed plan for comparing one struct field.
+type compareField struct {
+	index	[]int
+	name	string
+	tag	string
+}
+
+// NewComparator instantiates a Comparator that skips struct fields whose
+// exclusion tag is '-'.
+func NewComparator(tag string) (*Comparator) {
+
+	return &Comparator{
+		Tag:		tag,
+		normalizers:	make(map[string]Normalizer),
+		plans:		make(map[reflect.Type][]compareField),
+	}
+}
+
+// Normalize registers a normalizer for one or more fields, identified by
+// field path or, for top-level fields, by tag name. It returns the
+// comparator to allow chaining. Comparisons already in progress keep the
+// normalizers they started with.
+func (this *Comparator) Normalize(n Normalizer, fields ...string) (*Comparator) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	normalizers := make(map[string]Normalizer, len(this.normalizers) + len(fields))
+
+	for f, fn := range this.normalizers {
+		normalizers[f] = fn
+	}
+	for _, f := range fields {
+		normalizers[f] = n
+	}
+
+	this.normalizers = normalizers
+
+	return this
+}
+
+// Normalizer returns the normalizer registered for a field path or tag
+// name, or nil.
+func (this *Comparator) Normalizer(field string) (Normalizer) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.normalizers[field]
+}
+
+// Compare compares two values and returns an array of changes. Each change
+// is a tuple of field path, old value, and new value.
+func (this *Comparator) Compare(old, new interface{}) (ss [][]string, err error) {
+
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+
+	if !ov.IsValid() || !nv.IsValid() {
+		return nil, fmt.Errorf(`cannot compare nil values`)
+	}
+	if ov.Type() != nv.Type() {
+		return nil, fmt.Errorf(`type mismatch: %T and %T`, old, new)
+	}
+
+	this.mu.RLock()
+	c := &comparison{this, this.normalizers}
+	this.mu.RUnlock()
+
+	c.compare(``, ``, ov, nv, &ss)
+
+	return ss, nil
+}
+
+// CompareField compares the values of a single struct field and returns
+// an array of changes, applying the normalizers registered for the field
+// even if its exclusion tag is '-'.
+func (this *Comparator) CompareField(f reflect.StructField, ov, nv reflect.Value) (ss [][]string) {
+
+	this.mu.RLock()
+	c := &comparison{this, this.normalizers}
+	this.mu.RUnlock()
+
+	c.compare(f.Name, TagName(f), ov, nv, &ss)
+
+	return ss
+}
+
+// compare recursively compares two values of the same type.
+func (this *comparison) compare(path, tag string, ov, nv reflect.Value, ss *[][]string) {
+
+	switch ov.Kind() {
+
+	case reflect.Ptr, reflect.Interface:
+
+		if ov.IsNil() || nv.IsNil() {
+			if ov.IsNil() != nv.IsNil() {
+				this.leaf(path, tag, ov, nv, ss)
+			}
+			return
+		}
+
+		oe, ne := ov.Elem(), nv.Elem()
+
+		if oe.Type() != ne.Type() {
+			this.leaf(path, tag, ov, nv, ss)
+			return
+		}
+
+		this.compare(path, tag, oe, ne, ss)
+
+	case reflect.Struct:
+
+		plan := this.plan(ov.Type())
+
+		if len(plan) == 0 {
+			this.leaf(path, tag, ov, nv, ss)
+			return
+		}
+
+		for _, f := range plan {
+
+			name := f.name
+
+			if path != `` {
+				name = path + `.` + f.name
+			}
+
+			this.compare(name, f.tag, ov.FieldByIndex(f.index), nv.FieldByIndex(f.index), ss)
+		}
+
+	case reflect.Slice, reflect.Array:
+
+		if ov.Kind() == reflect.Slice && ov.Type().Elem().Kind() == reflect.Uint8 {
+			this.leaf(path, tag, ov, nv, ss)
+			return
+		}
+
+		n := ov.Len()
+
+		if nv.Len() > n {
+			n = nv.Len()
+		}
+
+		for i := 0; i < n; i++ {
+
+			name := fmt.Sprintf(`%s[%d]`, path, i)
+
+			switch {
+			case i >= ov.Len():
+				*ss = append(*ss, []string{name, ``, this.format(nv.Index(i))})
+			case i >= nv.Len():
+				*ss = append(*ss, []string{name, this.format(ov.Index(i)), ``})
+			default:
+				this.compare(name, ``, ov.Index(i), nv.Index(i), ss)
+			}
+		}
+
+	case reflect.Map:
+
+		keys := make(map[string]reflect.Value)
+
+		for _, k := range ov.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range nv.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+
+		var names []string
+
+		for k := range keys {
+			names = append(names, k)
+		}
+
+		sort.Strings(names)
+
+		for _, k := range names {
+
+			name := fmt.Sprintf(`%s[%s]`, path, k)
+			oe, ne := ov.MapIndex(keys[k]), nv.MapIndex(keys[k])
+
+			switch {
+			case !oe.IsValid():
+				*ss = append(*ss, []string{name, ``, this.format(ne)})
+			case !ne.IsValid():
+				*ss = append(*ss, []string{name, this.format(oe), ``})
+			default:
+				this.compare(name, ``, oe, ne, ss)
+			}
+		}
+
+	default:
+		this.leaf(path, tag, ov, nv, ss)
+	}
+}
+
+// leaf compares two values by their normalized string representations.
+func (this *comparison) leaf(path, tag string, ov, nv reflect.Value, ss *[][]string) {
+
+	o, n := this.format(ov), this.format(nv)
+
+	if this.normalize(path, tag, o) != this.normalize(path, tag, n) {
+		*ss = append(*ss, []string{path, o, n})
+	}
+}
+
+// format returns the string representation of a value.
+func (this *Comparator) format(v reflect.Value) (string) {
+
+	if !v.IsValid() {
+		return ``
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return ``
+	}
+	if v.CanInterface() {
+		return fmt.Sprint(v.Interface())
+	}
+
+	return v.String()
+}
+
+// normalize applies the normalizer registered for a field, if any.
+func (this *comparison) normalize(path, tag, s string) (string) {
+
+	if n, ok := this.normalizers[path]; ok {
+		return n(s)
+	}
+	if n, ok := this.normalizers[tag]; ok && tag != `` {
+		return n(s)
+	}
+
+	return s
+}
+
+// plan returns the cached comparison plan for a struct type, flattening
+// embedded structs and skipping unexported and excluded fields.
+func (this *Comparator) plan(t reflect.Type) ([]compareField) {
+
+	this.mu.RLock()
+	plan, ok := this.plans[t]
+	this.mu.RUnlock()
+
+	if ok {
+		return plan
+	}
+
+	plan = this.buildPlan(t, nil)
+
+	this.mu.Lock()
+	this.plans[t] = plan
+	this.mu.Unlock()
+
+	return plan
+}
+
+// buildPlan computes the comparison plan for a struct type.
+func (this *Comparator) buildPlan(t reflect.Type, index []int) (plan []compareField) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+
+		if this.Tag != `` && f.Tag.Get(this.Tag) == `-` {
+			continue
+		}
+
+		idx := append(append([]int{}, index...), i)
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			plan = append(plan, this.buildPlan(f.Type, idx)...)
+			continue
+		}
+
+		if f.PkgPath != `` {
+			continue
+		}
+
+		plan = append(plan, compareField{idx, f.Name, TagName(f)})
+	}
+
+	return plan
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`fmt`
+	`reflect`
+	`testing`
+)
+
+func TestNormalizers(t *testing.T) {
+
+	tests := []struct {
+		name	string
+		fn	Normalizer
+		in	string
+		want	string
+	}{
+		{`hex case`, NormalizeHex, `0A1B`, `a1b`},
+		{`hex prefix`, NormalizeHex, ` 0x0801 `, `801`},
+		{`hex zero`, NormalizeHex, `0x0000`, `0`},
+		{`hex empty`, NormalizeHex, ``, ``},
+		{`space`, NormalizeSpace, "  1.0\t", `1.0`},
+		{`space empty`, NormalizeSpace, ``, ``},
+		{`version prefix`, NormalizeVersion, `v1.10.0`, `1.10`},
+		{`version zeros`, NormalizeVersion, `01.10`, `1.10`},
+		{`version zero`, NormalizeVersion, `0.0`, `0`},
+	}
+
+	for _, tt := range tests {
+		if got := tt.fn(tt.in); got != tt.want {
+			t.Errorf(`%s: got %q, want %q`, tt.name, got, tt.want)
+		}
+	}
+}
+
+// compareTest is a nested value used to exercise the comparator.
+type compareTest struct {
+	ID	string			`json:"id"`
+	Ver	string			`json:"ver"`
+	Skip	string			`json:"skip" cmp:"-"`
+	Tags	[]string		`json:"tags"`
+	Grid	[][]int			`json:"grid"`
+	Attrs	map[string]string	`json:"attrs"`
+	Inner	*compareInner		`json:"inner"`
+}
+
+type compareInner struct {
+	Ports	[]compareInner		`json:"ports"`
+	Name	string			`json:"name"`
+}
+
+func TestComparator(t *testing.T) {
+
+	c := NewComparator(`cmp`).
+		Normalize(NormalizeHex, `id`).
+		Normalize(NormalizeVersion, `Ver`).
+		Normalize(NormalizeSpace, `Inner.Ports[0].Name`)
+
+	tests := []struct {
+		name	string
+		old	*compareTest
+		new	*compareTest
+		want	[][]string
+	}{
+		{`equal after hex normalize`,
+			&compareTest{ID: `0x0A1B`},
+			&compareTest{ID: `a1b`},
+			nil,
+		},
+		{`equal after version normalize`,
+			&compareTest{Ver: `v1.10.0`},
+			&compareTest{Ver: `1.10`},
+			nil,
+		},
+		{`different after normalize`,
+			&compareTest{Ver: `1.10`},
+			&compareTest{Ver: `1.1`},
+			[][]string{{`Ver`, `1.10`, `1.1`}},
+		},
+		{`excluded field`,
+			&compareTest{Skip: `a`},
+			&compareTest{Skip: `b`},
+			nil,
+		},
+		{`nil and empty slice`,
+			&compareTest{Tags: nil},
+			&compareTest{Tags: []string{}},
+			nil,
+		},
+		{`nil and empty map`,
+			&compareTest{Attrs: nil},
+			&compareTest{Attrs: map[string]string{}},
+			nil,
+		},
+		{`nil and empty pointer`,
+			&compareTest{Inner: nil},
+			&compareTest{Inner: &compareInner{}},
+			[][]string{{`Inner`, ``, `&{[] }`}},
+		},
+		{`slice element added`,
+			&compareTest{Tags: []string{`a`}},
+			&compareTest{Tags: []string{`a`, `b`}},
+			[][]string{{`Tags[1]`, ``, `b`}},
+		},
+		{`nested slice`,
+			&compareTest{Grid: [][]int{{1, 2}, {3}}},
+			&compareTest{Grid: [][]int{{1, 4}, {3, 5}}},
+			[][]string{{`Grid[0][1]`, `2`, `4`}, {`Grid[1][1]`, ``, `5`}},
+		},
+		{`nested struct slice`,
+			&compareTest{Inner: &compareInner{Ports: []compareInner{{Name: `a`}}}},
+			&compareTest{Inner: &compareInner{Ports: []compareInner{{Name: `b`}}}},
+			[][]string{{`Inner.Ports[0].Name`, `a`, `b`}},
+		},
+		{`nested path normalizer`,
+			&compareTest{Inner: &compareInner{Ports: []compareInner{{Name: ` a `}}}},
+			&compareTest{Inner: &compareInner{Ports: []compareInner{{Name: `a`}}}},
+			nil,
+		},
+		{`map keys sorted`,
+			&compareTest{Attrs: map[string]string{`b`: `1`, `a`: `1`}},
+			&compareTest{Attrs: map[string]string{`b`: `2`, `c`: `3`}},
+			[][]string{{`Attrs[a]`, `1`, ``}, {`Attrs[b]`, `1`, `2`}, {`Attrs[c]`, ``, `3`}},
+		},
+	}
+
+	for _, tt := range tests {
+
+		got, err := c.Compare(tt.old, tt.new)
+
+		if err != nil {
+			t.Errorf(`%s: %v`, tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf(`%s: got %q, want %q`, tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := c.Compare(nil, &compareTest{}); err == nil {
+		t.Errorf(`nil value: expected error`)
+	}
+	if _, err := c.Compare(&compareTest{}, &compareInner{}); err == nil {
+		t.Errorf(`type mismatch: expected error`)
+	}
+}
+
+func TestCompareWith(t *testing.T) {
+
+	p, err := NewProfile(`compare-test`, `vendor_id`, `firmware_ver`, `port_number`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := &DeviceInfo{VendorID: `0x0801`, FirmwareVer: ` 1.0 `, PortNumber: 1}
+	new := &DeviceInfo{VendorID: `0801`, FirmwareVer: `1.0`, PortNumber: 2}
+
+	want := [][]string{{`PortNumber`, `1`, `2`}}
+
+	if got, err := new.CompareWith(old, p); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf(`got %q, want %q`, got, want)
+	}
+}
+
+// benchFleetSize is the number of device records compared per benchmark
+// operation, on the order of a nightly audit of a large fleet.
+const benchFleetSize = 10000
+
+// benchRecords returns pairs of baseline and current records in which
+// every record differs in ID case and whitespace and one in ten has a new
+// firmware version.
+func benchRecords(n int) (old, new []*DeviceInfo) {
+
+	for i := 0; i < n; i++ {
+
+		o := &DeviceInfo{
+			HostName:	fmt.Sprintf(`host%05d`, i / 4),
+			VendorID:	`0801`,
+			ProductID:	`0001`,
+			SerialNum:	fmt.Sprintf(`B%06d`, i),
+			VendorName:	`Mag-Tek`,
+			ProductName:	`USB Swipe Reader`,
+			ProductVer:	`V05`,
+			FirmwareVer:	`21042840G01`,
+			SoftwareID:	`21042840G01`,
+			BufferSize:	24,
+			MaxPktSize:	8,
+			USBSpec:	`1.10`,
+			USBClass:	`per-interface`,
+			USBSubClass:	`per-interface`,
+			USBProtocol:	`0`,
+			DeviceSpeed:	`full`,
+			DeviceVer:	`1.00`,
+			ObjectType:	`*usb.Magtek`,
+			DeviceSN:	fmt.Sprintf(`B%06d`, i),
+			FactorySN:	fmt.Sprintf(`B%06d0112`, i),
+			DescriptorSN:	fmt.Sprintf(`B%06d`, i),
+		}
+
+		n := *o
+		n.VendorID, n.ProductVer = `0x0801`, ` V05 `
+
+		if i % 10 == 0 {
+			n.FirmwareVer = `21042840G02`
+		}
+
+		old, new = append(old, o), append(new, &n)
+	}
+
+	return old, new
+}
+
+// BenchmarkComparator measures comparing a fleet of records with their
+// baselines using the default comparator.
+func BenchmarkComparator(b *testing.B) {
+
+	old, new := benchRecords(benchFleetSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := range old {
+			if _, err := DefaultComparator.Compare(old[j], new[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkComparatorParallel measures concurrent comparisons sharing the
+// default comparator, as in an audit that compares devices in parallel.
+func BenchmarkComparatorParallel(b *testing.B) {
+
+	old, new := benchRecords(benchFleetSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for j := 0; pb.Next(); j++ {
+			if _, err := DefaultComparator.Compare(old[j % len(old)], new[j % len(new)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -15,10 +15,14 @@
 package usb
 
 import (
+	`crypto/sha256`
+	`encoding/hex`
 	`encoding/json`
 	`encoding/xml`
 	`fmt`
 	`os`
+	`strconv`
+	`strings`
 
 	`github.com/google/gousb`
 	`github.com/jscherff/goutil`
@@ -27,6 +31,8 @@ import (
 const (
 	MarshalPrefix		string	= ""
 	MarshalIndent		string	= "\t"
+
+	fingerprintSize		int	= 16
 )
 
 type DeviceInfo struct {
@@ -44,6 +50,7 @@ type DeviceInfo struct {
 	PortNumber	int		`json:"port_number"   csv:"-" nvp:"-" cmp:"-"`
 	BusNumber	int		`json:"bus_number"    csv:"-" nvp:"-" cmp:"-"`
 	BusAddress	int		`json:"bus_address"   csv:"-" nvp:"-" cmp:"-"`
+	PortPath	string		`json:"port_path,omitempty" csv:"-" nvp:"-" cmp:"-"`
 	BufferSize	int		`json:"buffer_size"   csv:"-" nvp:"-"`
 	MaxPktSize	int		`json:"max_pkt_size"  csv:"-" nvp:"-"`
 	USBSpec		string		`json:"usb_spec"      csv:"-" nvp:"-"`
@@ -57,6 +64,7 @@ type DeviceInfo struct {
 	DeviceSN	string		`json:"device_sn"     csv:"-" nvp:"-"`
 	FactorySN	string		`json:"factory_sn"    csv:"-" nvp:"-"`
 	DescriptorSN	string		`json:"descriptor_sn" csv:"-" nvp:"-"`
+	Fingerprint	string		`json:"fingerprint,omitempty" csv:"-" nvp:"-" cmp:"-"`
 
 	Custom01	string		`json:"custom_01,omitempty" xml:",omitempty" csv:"-" nvp:"-"`
 	Custom02	string		`json:"custom_02,omitempty" xml:",omitempty" csv:"-" nvp:"-"`
@@ -69,7 +77,8 @@ type DeviceInfo struct {
 	Custom09	string		`json:"custom_09,omitempty" xml:",omitempty" csv:"-" nvp:"-"`
 	Custom10	string		`json:"custom_10,omitempty" xml:",omitempty" csv:"-" nvp:"-"`
 
-	Changes		[][]string	`json:"-" xml:"-" csv:"-" nvp:"-" cmp:"-"`
+	Changes		Changes		`json:"-" xml:"-" csv:"-" nvp:"-" cmp:"-"`
+	ChangeLog	ChangeLog	`json:"-" xml:"-" csv:"-" nvp:"-" cmp:"-"`
 }
 
 // NewDeviceInfo instantiates a DeviceInfo object.
@@ -80,6 +89,7 @@ func NewDeviceInfo(desc *gousb.DeviceDesc) (this *DeviceInfo, err error) {
 			VendorID:	desc.Vendor.String(),
 			ProductID:	desc.Product.String(),
 			PortNumber:	desc.Port,
+			PortPath:	portPath(desc.Path),
 			BusNumber:	desc.Bus,
 			BusAddress:	desc.Address,
 			MaxPktSize:	desc.MaxControlPacketSize,
@@ -103,9 +113,71 @@ func NewDeviceInfo(desc *gousb.DeviceDesc) (this *DeviceInfo, err error) {
 	return this, nil
 }
 
-// ID is a convenience method to retrieve the device serial number.
+// portPath formats the chain of hub port numbers from the root hub to a
+// device, e.g. '1.4.2'. Unlike the bus number, it does not change across
+// reboots or hub re-enumeration.
+func portPath(path []int) (string) {
+
+	ss := make([]string, len(path))
+
+	for i, p := range path {
+		ss[i] = strconv.Itoa(p)
+	}
+
+	return strings.Join(ss, `.`)
+}
+
+// ID is a convenience method to retrieve the device serial number, or the
+// device fingerprint if the device has no serial number.
 func (this *DeviceInfo) ID() (string) {
-	return this.SerialNum
+
+	if this.SerialNum != `` {
+		return this.SerialNum
+	}
+
+	return this.FP()
+}
+
+// FP is a convenience method to retrieve the device fingerprint. If the
+// fingerprint is not set, it is derived from device properties without
+// being stored.
+func (this *DeviceInfo) FP() (string) {
+
+	if this.Fingerprint == `` {
+		return this.MakeFingerprint()
+	}
+
+	return this.Fingerprint
+}
+
+// MakeFingerprint derives a stable identity hash from the immutable device
+// properties: vendor ID, product ID, factory serial number, descriptor
+// serial number and device version. If the device has neither a factory
+// nor a descriptor serial number, the host name and hub port path are
+// also used so that identical devices on different ports remain distinct.
+// It should be called once the serial numbers have been read.
+func (this *DeviceInfo) MakeFingerprint() (string) {
+
+	props := []string{
+		this.VendorID,
+		this.ProductID,
+		this.FactorySN,
+		this.DescriptorSN,
+		this.DeviceVer,
+	}
+
+	if this.FactorySN == `` && this.DescriptorSN == `` {
+		props = append(props, this.HostName, this.PortPath)
+	}
+
+	h := sha256.New()
+
+	for _, p := range props {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:fingerprintSize])
 }
 
 // SN is a convenience method to retrieve the device serial number.
@@ -138,6 +210,17 @@ func (this *DeviceInfo) Conn() (string) {
 	return fmt.Sprintf(`P%02x-B%02x`, this.PortNumber, this.BusNumber)
 }
 
+// DeepCopy returns a copy of the object that shares no changes or change
+// log records with the original.
+func (this *DeviceInfo) DeepCopy() (*DeviceInfo) {
+
+	that := *this
+	that.Changes = this.Changes.DeepCopy()
+	that.ChangeLog.Changes = this.ChangeLog.Changes.DeepCopy()
+
+	return &that
+}
+
 // Save saves the object to a JSON file.
 func (this *DeviceInfo) Save(fn string) (error) {
 	return goutil.SaveObject(this, fn)
@@ -148,11 +231,24 @@ func (this *DeviceInfo) RestoreFile(fn string) (error) {
 	return goutil.RestoreObject(fn, this)
 }
 
-// RestoreJSON restores the object from a JSON file.
+// RestoreJSON restores the object from a JSON file after checking the
+// types of its fields against the DeviceInfo schema. Missing and unknown
+// fields are allowed so that records written by other versions restore.
 func (this *DeviceInfo) RestoreJSON(j []byte) (error) {
+
+	if err := deviceInfoSchema.ValidateTypes(j); err != nil {
+		return err
+	}
+
 	return json.Unmarshal(j, &this)
 }
 
+// ValidateJSON checks JSON input strictly against the DeviceInfo schema:
+// every required field must be present and unknown fields are rejected.
+func (this *DeviceInfo) ValidateJSON(j []byte) (error) {
+	return deviceInfoSchema.Validate(j)
+}
+
 // CompareFile compares fields of two objects and returns an array of changes.
 func (this *DeviceInfo) CompareFile(fn string) (ss [][]string, err error) {
 
@@ -162,7 +258,7 @@ func (this *DeviceInfo) CompareFile(fn string) (ss [][]string, err error) {
 		return ss, err
 	}
 
-	return goutil.CompareObjects(other, this, `cmp`)
+	return DefaultComparator.Compare(other, this)
 }
 
 // CompareJSON compares fields of two objects and returns an array of changes.
@@ -174,33 +270,90 @@ func (this *DeviceInfo) CompareJSON(j []byte) (ss [][]string, err error) {
 		return ss, err
 	}
 
-	return goutil.CompareObjects(other, this, `cmp`)
+	return DefaultComparator.Compare(other, this)
 }
 
 // AuditFile compares fields of two objects and stores changes internally.
-func (this *DeviceInfo) AuditFile(fn string) (err error) {
-	this.Changes, err = this.CompareFile(fn)
-	return err
+func (this *DeviceInfo) AuditFile(fn string) (error) {
+
+	ss, err := this.CompareFile(fn)
+
+	if err != nil {
+		return err
+	}
+
+	this.recordAudit(ss, fn)
+
+	return nil
 }
 
 // AuditJSON compares fields of two objects and stores changes internally.
-func (this *DeviceInfo) AuditJSON(j []byte) (err error) {
-	this.Changes, err = this.CompareJSON(j)
-	return err
+// The change records identify the baseline by its fingerprint.
+func (this *DeviceInfo) AuditJSON(j []byte) (error) {
+
+	other := &DeviceInfo{}
+
+	if err := other.RestoreJSON(j); err != nil {
+		return err
+	}
+
+	ss, err := DefaultComparator.Compare(other, this)
+
+	if err != nil {
+		return err
+	}
+
+	this.recordAudit(ss, jsonSource(other))
+
+	return nil
 }
 
 // SetChanges stores a list of DeviceInfo property changes. Each change
-// is a tuple of field name, old value, and new value.
+// is a tuple of field name, old value, and new value. Unlike
+// SetChangeRecords, it does not add to the change log.
 func (this *DeviceInfo) SetChanges(c [][]string) {
-	this.Changes = c
+	this.Changes = NewChanges(c, ``, this.HostName)
 }
 
 // GetChanges returns a list of DeviceInfo property changes. Each change
 // is a tuple of field name, old value, and new value.
 func (this *DeviceInfo) GetChanges() ([][]string) {
+	return this.Changes.Triples()
+}
+
+// SetChangeRecords stores a list of DeviceInfo property change records
+// and appends them to the change log.
+func (this *DeviceInfo) SetChangeRecords(c Changes) {
+	this.Changes = c
+	this.ChangeLog.Append(c)
+}
+
+// recordAudit stores the changes found by an audit against a baseline,
+// appends them to the change log and classifies them with DefaultPolicy.
+func (this *DeviceInfo) recordAudit(ss [][]string, source string) {
+
+	this.SetChangeRecords(NewChanges(ss, source, this.HostName))
+
+	if p := DefaultPolicy; p != nil {
+		p.Apply(this)
+	}
+}
+
+// GetChangeRecords returns a list of DeviceInfo property change records.
+func (this *DeviceInfo) GetChangeRecords() (Changes) {
 	return this.Changes
 }
 
+// GetChangeLog returns the log of change records accumulated across audits.
+func (this *DeviceInfo) GetChangeLog() (*ChangeLog) {
+	return &this.ChangeLog
+}
+
+// jsonSource identifies a baseline restored from JSON in change records.
+func jsonSource(baseline *DeviceInfo) (string) {
+	return fmt.Sprintf(`json:%s`, baseline.FP())
+}
+
 // JSON reports all unfiltered fields in JSON format.
 func (this *DeviceInfo) JSON() ([]byte, error) {
 	return json.Marshal(this)
@@ -0,0 +1,216 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`fmt`
+)
+
+const (
+	diffContext		int	= 3
+
+	ansiReset		string	= "\x1b[0m"
+	ansiRed			string	= "\x1b[31m"
+	ansiGreen		string	= "\x1b[32m"
+	ansiCyan		string	= "\x1b[36m"
+	ansiBold		string	= "\x1b[1m"
+)
+
+// diffLine is a single line of an edit script: ' ' for a line common to
+// both inputs, '-' for a deleted line and '+' for an inserted line.
+type diffLine struct {
+	op	byte
+	text	string
+	a, b	int
+}
+
+// unifiedDiff returns a unified diff of two lists of lines with the
+// standard three lines of context.
+func unifiedDiff(aName, bName string, a, b []string, color bool) ([]byte) {
+
+	script := editScript(a, b)
+
+	var buf bytes.Buffer
+
+	paint := func(c, s string) string {
+		if color {
+			return c + s + ansiReset
+		}
+		return s
+	}
+
+	changed := false
+
+	for _, l := range script {
+		if l.op != ' ' {
+			changed = true
+			break
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	fmt.Fprintln(&buf, paint(ansiBold, `--- ` + aName))
+	fmt.Fprintln(&buf, paint(ansiBold, `+++ ` + bName))
+
+	for i := 0; i < len(script); {
+
+		if script[i].op == ' ' {
+			i++
+			continue
+		}
+
+		start := i - diffContext
+
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+
+		for end < len(script) {
+
+			if script[end].op != ' ' {
+				end++
+				continue
+			}
+
+			next := end
+
+			for next < len(script) && script[next].op == ' ' {
+				next++
+			}
+
+			if next == len(script) || next - end > 2 * diffContext {
+				end += diffContext
+				if end > len(script) {
+					end = len(script)
+				}
+				break
+			}
+
+			end = next
+		}
+
+		hunk := script[start:end]
+
+		aStart, aLen, bStart, bLen := hunkRange(hunk)
+
+		fmt.Fprintln(&buf, paint(ansiCyan, fmt.Sprintf(`@@ -%d,%d +%d,%d @@`,
+			aStart, aLen, bStart, bLen)))
+
+		for _, l := range hunk {
+			switch l.op {
+			case '-':
+				fmt.Fprintln(&buf, paint(ansiRed, `-` + l.text))
+			case '+':
+				fmt.Fprintln(&buf, paint(ansiGreen, `+` + l.text))
+			default:
+				fmt.Fprintln(&buf, ` ` + l.text)
+			}
+		}
+
+		i = end
+	}
+
+	return buf.Bytes()
+}
+
+// hunkRange returns the one-based starting line numbers and lengths of a
+// hunk in each input.
+func hunkRange(hunk []diffLine) (aStart, aLen, bStart, bLen int) {
+
+	aStart, bStart = -1, -1
+
+	for _, l := range hunk {
+
+		if l.op != '+' {
+			if aStart < 0 {
+				aStart = l.a
+			}
+			aLen++
+		}
+		if l.op != '-' {
+			if bStart < 0 {
+				bStart = l.b
+			}
+			bLen++
+		}
+	}
+
+	if aStart < 0 {
+		aStart = hunk[0].a
+	}
+	if bStart < 0 {
+		bStart = hunk[0].b
+	}
+
+	if aLen > 0 {
+		aStart++
+	}
+	if bLen > 0 {
+		bStart++
+	}
+
+	return aStart, aLen, bStart, bLen
+}
+
+// editScript computes a shortest edit script between two lists of lines
+// using a longest common subsequence table.
+func editScript(a, b []string) (script []diffLine) {
+
+	lcs := make([][]int, len(a) + 1)
+
+	for i := range lcs {
+		lcs[i] = make([]int, len(b) + 1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+
+	for i < len(a) || j < len(b) {
+
+		switch {
+
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			script = append(script, diffLine{' ', a[i], i, j})
+			i++; j++
+
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			script = append(script, diffLine{'+', b[j], i, j})
+			j++
+
+		default:
+			script = append(script, diffLine{'-', a[i], i, j})
+			i++
+		}
+	}
+
+	return script
+}
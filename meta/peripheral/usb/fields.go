@@ -0,0 +1,193 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`fmt`
+	`reflect`
+	`strconv`
+	`strings`
+)
+
+// deviceInfoFields lists the serialized fields of DeviceInfo in struct
+// order, and deviceInfoIndex maps their tag names to struct field indexes.
+var deviceInfoFields, deviceInfoIndex = indexFields(reflect.TypeOf(DeviceInfo{}))
+
+// indexFields returns the serialized fields of a struct type and a map of
+// their JSON tag names to their positions in the list.
+func indexFields(t reflect.Type) (fields []reflect.StructField, index map[string]int) {
+
+	index = make(map[string]int)
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+
+		if name := TagName(f); name != `` {
+			index[name] = len(fields)
+			fields = append(fields, f)
+		}
+	}
+
+	return fields, index
+}
+
+// TagName returns the JSON tag name of a struct field, or an empty string
+// if the field is not serialized. Reports and field profiles both name
+// DeviceInfo fields this way.
+func TagName(f reflect.StructField) (string) {
+
+	name := strings.Split(f.Tag.Get(`json`), `,`)[0]
+
+	switch name {
+	case `-`:
+		return ``
+	case ``:
+		return f.Name
+	default:
+		return name
+	}
+}
+
+// taggedFields returns the tag names of DeviceInfo fields not excluded by
+// the given struct tag, in struct order.
+func taggedFields(tag string) (names []string) {
+
+	for _, f := range deviceInfoFields {
+		if tag == `` || f.Tag.Get(tag) != `-` {
+			names = append(names, TagName(f))
+		}
+	}
+
+	return names
+}
+
+// field returns the struct field and value of a DeviceInfo field by tag name.
+func (this *DeviceInfo) field(name string) (reflect.StructField, reflect.Value, bool) {
+
+	if i, ok := deviceInfoIndex[name]; !ok {
+		return reflect.StructField{}, reflect.Value{}, false
+	} else {
+		f := deviceInfoFields[i]
+		return f, reflect.ValueOf(this).Elem().FieldByIndex(f.Index), true
+	}
+}
+
+// FieldInfo describes a DeviceInfo field addressable by tag name.
+type FieldInfo struct {
+	Name	string			`json:"name"`
+	Field	string			`json:"field"`
+	Type	string			`json:"type"`
+	Tags	map[string]string	`json:"tags"`
+}
+
+// Fields lists the names, types and struct tags of all DeviceInfo fields
+// addressable by Get and Set, in struct order.
+func Fields() (fi []*FieldInfo) {
+
+	for _, f := range deviceInfoFields {
+
+		tags := make(map[string]string)
+
+		for _, key := range []string{`json`, `xml`, `csv`, `nvp`, `cmp`} {
+			if v, ok := f.Tag.Lookup(key); ok {
+				tags[key] = v
+			}
+		}
+
+		fi = append(fi, &FieldInfo{
+			Name:	TagName(f),
+			Field:	f.Name,
+			Type:	f.Type.String(),
+			Tags:	tags,
+		})
+	}
+
+	return fi
+}
+
+// Fields lists the names, types and struct tags of all fields addressable
+// by Get and Set.
+func (this *DeviceInfo) Fields() ([]*FieldInfo) {
+	return Fields()
+}
+
+// Get returns the value of a field by tag name.
+func (this *DeviceInfo) Get(name string) (interface{}, error) {
+
+	if _, v, ok := this.field(name); !ok {
+		return nil, fmt.Errorf(`unknown field %q`, name)
+	} else {
+		return v.Interface(), nil
+	}
+}
+
+// GetString returns the value of a field by tag name as a string.
+func (this *DeviceInfo) GetString(name string) (string, error) {
+
+	if v, err := this.Get(name); err != nil {
+		return ``, err
+	} else {
+		return fmt.Sprint(v), nil
+	}
+}
+
+// Set assigns the value of a field by tag name. Strings are parsed for
+// integer fields; other values must be assignable to the field type.
+func (this *DeviceInfo) Set(name string, i interface{}) (error) {
+
+	_, v, ok := this.field(name)
+
+	if !ok {
+		return fmt.Errorf(`unknown field %q`, name)
+	}
+
+	iv := reflect.ValueOf(i)
+
+	switch {
+
+	case !iv.IsValid():
+		return fmt.Errorf(`field %q: nil value`, name)
+
+	case iv.Type().AssignableTo(v.Type()):
+		v.Set(iv)
+
+	case v.Kind() == reflect.Int && iv.Kind() == reflect.String:
+		n, err := strconv.Atoi(iv.String())
+		if err != nil {
+			return fmt.Errorf(`field %q: %v`, name, err)
+		}
+		v.SetInt(int64(n))
+
+	case v.Kind() == reflect.Int && isInt(iv.Kind()):
+		v.SetInt(iv.Int())
+
+	default:
+		return fmt.Errorf(`field %q: cannot assign %T to %s`, name, i, v.Type())
+	}
+
+	return nil
+}
+
+// isInt reports whether a kind is a signed integer kind.
+func isInt(k reflect.Kind) (bool) {
+
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	default:
+		return false
+	}
+}
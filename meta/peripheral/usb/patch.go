@@ -0,0 +1,335 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`reflect`
+	`strings`
+)
+
+const (
+	PatchAdd		string	= `add`
+	PatchRemove		string	= `remove`
+	PatchReplace		string	= `replace`
+	PatchTest		string	= `test`
+)
+
+var pointerEscaper = strings.NewReplacer(`~`, `~0`, `/`, `~1`)
+var pointerUnescaper = strings.NewReplacer(`~1`, `/`, `~0`, `~`)
+
+// PatchOp is a single RFC 6902 JSON Patch operation.
+type PatchOp struct {
+	Op		string		`json:"op"`
+	Path		string		`json:"path"`
+	Value		interface{}	`json:"value,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface for PatchOp. The
+// value member is always present for operations that require it, even
+// when the value is empty.
+func (this *PatchOp) MarshalJSON() ([]byte, error) {
+
+	switch this.Op {
+
+	case PatchAdd, PatchReplace, PatchTest:
+		return json.Marshal(struct {
+			Op	string		`json:"op"`
+			Path	string		`json:"path"`
+			Value	interface{}	`json:"value"`
+		}{this.Op, this.Path, this.Value})
+
+	default:
+		return json.Marshal(struct {
+			Op	string		`json:"op"`
+			Path	string		`json:"path"`
+		}{this.Op, this.Path})
+	}
+}
+
+// Patch is an RFC 6902 JSON Patch document.
+type Patch []*PatchOp
+
+// JSON reports the patch in JSON format.
+func (this Patch) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the patch in formatted JSON format.
+func (this Patch) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// PatchFrom returns a JSON Patch that transforms another object into this
+// one, limited to the fields compared by audits.
+func (this *DeviceInfo) PatchFrom(other *DeviceInfo) (Patch, error) {
+
+	p, err := GetProfile(`cmp`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return this.PatchWith(other, p)
+}
+
+// PatchWith returns a JSON Patch that transforms another object into this
+// one, limited to the fields of a profile.
+func (this *DeviceInfo) PatchWith(other *DeviceInfo, p *Profile) (patch Patch, err error) {
+
+	om, err := toMap(other)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nm, err := toMap(this)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range p.Fields {
+
+		ov, oldOk := om[name]
+		nv, newOk := nm[name]
+		path := `/` + pointerEscaper.Replace(name)
+
+		switch {
+
+		case oldOk && !newOk:
+			patch = append(patch, &PatchOp{Op: PatchRemove, Path: path})
+
+		case !oldOk && newOk:
+			patch = append(patch, &PatchOp{Op: PatchAdd, Path: path, Value: nv})
+
+		case oldOk && newOk && !reflect.DeepEqual(ov, nv):
+			patch = append(patch, &PatchOp{Op: PatchReplace, Path: path, Value: nv})
+		}
+	}
+
+	return patch, nil
+}
+
+// PatchFile returns a JSON Patch that transforms the object saved in a
+// JSON file into this one.
+func (this *DeviceInfo) PatchFile(fn string) (Patch, error) {
+
+	other := &DeviceInfo{}
+
+	if err := other.RestoreFile(fn); err != nil {
+		return nil, err
+	}
+
+	return this.PatchFrom(other)
+}
+
+// PatchJSON returns a JSON Patch that transforms the object in a JSON
+// document into this one.
+func (this *DeviceInfo) PatchJSON(j []byte) (Patch, error) {
+
+	other := &DeviceInfo{}
+
+	if err := other.RestoreJSON(j); err != nil {
+		return nil, err
+	}
+
+	return this.PatchFrom(other)
+}
+
+// ApplyPatch applies a JSON Patch to the object. Only top-level paths are
+// supported. The object is unchanged if any operation fails or the result
+// does not validate against the DeviceInfo schema.
+func (this *DeviceInfo) ApplyPatch(patch Patch) (error) {
+
+	m, err := toMap(this)
+
+	if err != nil {
+		return err
+	}
+
+	for i, op := range patch {
+
+		if !strings.HasPrefix(op.Path, `/`) || strings.Count(op.Path, `/`) != 1 {
+			return fmt.Errorf(`patch op %d: unsupported path %q`, i, op.Path)
+		}
+
+		name := pointerUnescaper.Replace(op.Path[1:])
+		_, exists := m[name]
+
+		switch op.Op {
+
+		case PatchAdd:
+			if v, err := normalize(op.Value); err != nil {
+				return err
+			} else {
+				m[name] = v
+			}
+
+		case PatchReplace:
+			if !exists {
+				return fmt.Errorf(`patch op %d: path %q not found`, i, op.Path)
+			}
+			if v, err := normalize(op.Value); err != nil {
+				return err
+			} else {
+				m[name] = v
+			}
+
+		case PatchRemove:
+			if !exists {
+				return fmt.Errorf(`patch op %d: path %q not found`, i, op.Path)
+			}
+			delete(m, name)
+
+		case PatchTest:
+			if v, err := normalize(op.Value); err != nil {
+				return err
+			} else if !exists || !reflect.DeepEqual(m[name], v) {
+				return fmt.Errorf(`patch op %d: test failed for path %q`, i, op.Path)
+			}
+
+		default:
+			return fmt.Errorf(`patch op %d: unsupported operation %q`, i, op.Op)
+		}
+	}
+
+	j, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	that := &DeviceInfo{}
+
+	if err := that.RestoreJSON(j); err != nil {
+		return err
+	}
+
+	that.Changes, that.ChangeLog = this.Changes, this.ChangeLog
+	*this = *that
+
+	return nil
+}
+
+// ApplyPatchJSON applies a JSON Patch document to the object.
+func (this *DeviceInfo) ApplyPatchJSON(j []byte) (error) {
+
+	var patch Patch
+
+	if err := json.Unmarshal(j, &patch); err != nil {
+		return err
+	}
+
+	return this.ApplyPatch(patch)
+}
+
+// Diff returns a unified text diff of the compared fields of another object
+// and this one, optionally colorized with ANSI escape sequences.
+func (this *DeviceInfo) Diff(other *DeviceInfo, color bool) ([]byte, error) {
+
+	p, err := GetProfile(`cmp`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ob, err := other.NVPWith(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nb, err := this.NVPWith(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return unifiedDiff(`baseline`, `current`, lines(ob), lines(nb), color), nil
+}
+
+// DiffFile returns a unified text diff of the object saved in a JSON file
+// and this one.
+func (this *DeviceInfo) DiffFile(fn string, color bool) ([]byte, error) {
+
+	other := &DeviceInfo{}
+
+	if err := other.RestoreFile(fn); err != nil {
+		return nil, err
+	}
+
+	return this.Diff(other, color)
+}
+
+// DiffJSON returns a unified text diff of the object in a JSON document
+// and this one.
+func (this *DeviceInfo) DiffJSON(j []byte, color bool) ([]byte, error) {
+
+	other := &DeviceInfo{}
+
+	if err := other.RestoreJSON(j); err != nil {
+		return nil, err
+	}
+
+	return this.Diff(other, color)
+}
+
+// toMap converts an object to a map of JSON values keyed by tag name.
+func toMap(i interface{}) (m map[string]interface{}, err error) {
+
+	j, err := json.Marshal(i)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	err = dec.Decode(&m)
+
+	return m, err
+}
+
+// normalize converts a value to the form produced by toMap so that values
+// can be compared with reflect.DeepEqual.
+func normalize(v interface{}) (n interface{}, err error) {
+
+	j, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	err = dec.Decode(&n)
+
+	return n, err
+}
+
+// lines splits text into lines without trailing newlines.
+func lines(b []byte) ([]string) {
+
+	if s := strings.TrimSuffix(string(b), "\n"); s == `` {
+		return nil
+	} else {
+		return strings.Split(s, "\n")
+	}
+}
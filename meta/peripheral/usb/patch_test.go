@@ -0,0 +1,62 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import `testing`
+
+func TestApplyPatchReplaceTest(t *testing.T) {
+
+	tests := []struct {
+		name	string
+		patch	Patch
+		ok	bool
+	}{
+		{`replace int then test`, Patch{
+			&PatchOp{Op: PatchReplace, Path: `/port_number`, Value: 3},
+			&PatchOp{Op: PatchTest, Path: `/port_number`, Value: 3},
+		}, true},
+		{`replace float then test int`, Patch{
+			&PatchOp{Op: PatchReplace, Path: `/buffer_size`, Value: 64.0},
+			&PatchOp{Op: PatchTest, Path: `/buffer_size`, Value: 64},
+		}, true},
+		{`replace string then test`, Patch{
+			&PatchOp{Op: PatchReplace, Path: `/firmware_ver`, Value: `1.1`},
+			&PatchOp{Op: PatchTest, Path: `/firmware_ver`, Value: `1.1`},
+		}, true},
+		{`add then test`, Patch{
+			&PatchOp{Op: PatchAdd, Path: `/custom_01`, Value: `asset`},
+			&PatchOp{Op: PatchTest, Path: `/custom_01`, Value: `asset`},
+		}, true},
+		{`replace then test old value`, Patch{
+			&PatchOp{Op: PatchReplace, Path: `/port_number`, Value: 3},
+			&PatchOp{Op: PatchTest, Path: `/port_number`, Value: 1},
+		}, false},
+	}
+
+	for _, tt := range tests {
+
+		di := &DeviceInfo{VendorID: `0801`, ProductID: `0001`, PortNumber: 1, FirmwareVer: `1.0`}
+		err := di.ApplyPatch(tt.patch)
+
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf(`%s: %v`, tt.name, err)
+		case !tt.ok && err == nil:
+			t.Errorf(`%s: expected test failure`, tt.name)
+		case !tt.ok && di.PortNumber != 1:
+			t.Errorf(`%s: failed patch modified the object`, tt.name)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`path`
+)
+
+const (
+	SeverityIgnore		Severity	= `ignore`
+	SeverityInfo		Severity	= `info`
+	SeverityWarn		Severity	= `warn`
+	SeverityAlert		Severity	= `alert`
+)
+
+// DefaultPolicy classifies the changes recorded by AuditFile, AuditJSON,
+// AuditStore and their profile variants. Set it to nil to leave those
+// changes unclassified.
+var DefaultPolicy = DefaultAuditPolicy()
+
+var severityRank = map[Severity]int{
+	SeverityIgnore:	0,
+	SeverityInfo:	1,
+	SeverityWarn:	2,
+	SeverityAlert:	3,
+}
+
+// Severity classifies a change and determines the action taken for it.
+type Severity string
+
+// Valid reports whether the severity is one of the known levels.
+func (this Severity) Valid() (bool) {
+	_, ok := severityRank[this]
+	return ok
+}
+
+// AtLeast reports whether the severity is at or above another level.
+func (this Severity) AtLeast(other Severity) (bool) {
+	return this.rank() >= other.rank()
+}
+
+// rank returns the numeric level of the severity. Unclassified changes
+// rank as informational.
+func (this Severity) rank() (int) {
+
+	if r, ok := severityRank[this]; ok {
+		return r
+	}
+
+	return severityRank[SeverityInfo]
+}
+
+// AuditRule maps changes to a severity. Field, Host and Type are glob
+// patterns matched against the changed field (by struct field name or
+// tag name), the device host name and the device object type. Empty
+// patterns match everything.
+type AuditRule struct {
+	Field		string		`json:"field"`
+	Host		string		`json:"host,omitempty"`
+	Type		string		`json:"type,omitempty"`
+	Severity	Severity	`json:"severity"`
+}
+
+// Match reports whether the rule applies to a change on a device.
+func (this *AuditRule) Match(di *DeviceInfo, c *Change) (bool) {
+
+	if !globMatch(this.Host, di.HostName) || !globMatch(this.Type, di.ObjectType) {
+		return false
+	}
+
+	return globMatch(this.Field, c.Field) || globMatch(this.Field, fieldTagName(c.Field))
+}
+
+// AuditPolicy classifies audit changes using an ordered list of rules.
+// The first matching rule determines the severity of a change; changes
+// that match no rule receive the default severity.
+type AuditPolicy struct {
+	Rules		[]*AuditRule	`json:"rules"`
+	Default		Severity	`json:"default"`
+}
+
+// DefaultAuditPolicy alerts on serial number and vendor or product ID
+// changes, warns on version changes and on devices moved to a different
+// port, and ignores buffer size fluctuation.
+func DefaultAuditPolicy() (*AuditPolicy) {
+
+	return &AuditPolicy{
+		Rules: []*AuditRule{
+			&AuditRule{Field: `SerialNum`, Severity: SeverityAlert},
+			&AuditRule{Field: `DeviceSN`, Severity: SeverityAlert},
+			&AuditRule{Field: `FactorySN`, Severity: SeverityAlert},
+			&AuditRule{Field: `DescriptorSN`, Severity: SeverityAlert},
+			&AuditRule{Field: `VendorID`, Severity: SeverityAlert},
+			&AuditRule{Field: `ProductID`, Severity: SeverityAlert},
+			&AuditRule{Field: `FirmwareVer`, Severity: SeverityWarn},
+			&AuditRule{Field: `SoftwareID`, Severity: SeverityWarn},
+			&AuditRule{Field: `ProductVer`, Severity: SeverityWarn},
+			&AuditRule{Field: PortPathField, Severity: SeverityWarn},
+			&AuditRule{Field: `BufferSize`, Severity: SeverityIgnore},
+			&AuditRule{Field: `MaxPktSize`, Severity: SeverityIgnore},
+		},
+		Default: SeverityInfo,
+	}
+}
+
+// NewAuditPolicy instantiates an AuditPolicy after verifying its rules.
+func NewAuditPolicy(def Severity, rules ...*AuditRule) (this *AuditPolicy, err error) {
+
+	this = &AuditPolicy{Rules: rules, Default: def}
+
+	if err = this.Verify(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// LoadAuditPolicy reads an AuditPolicy from a JSON file.
+func LoadAuditPolicy(fn string) (*AuditPolicy, error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &AuditPolicy{}
+
+	if err := json.Unmarshal(j, this); err != nil {
+		return nil, err
+	}
+	if err := this.Verify(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Verify checks that every severity is known and every pattern is valid.
+func (this *AuditPolicy) Verify() (error) {
+
+	if !this.Default.Valid() {
+		return fmt.Errorf(`audit policy: unknown default severity %q`, this.Default)
+	}
+
+	for i, r := range this.Rules {
+
+		if !r.Severity.Valid() {
+			return fmt.Errorf(`audit policy: rule %d: unknown severity %q`, i, r.Severity)
+		}
+
+		for _, p := range []string{r.Field, r.Host, r.Type} {
+			if _, err := path.Match(p, ``); err != nil {
+				return fmt.Errorf(`audit policy: rule %d: bad pattern %q`, i, p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Classify returns the severity of a change on a device.
+func (this *AuditPolicy) Classify(di *DeviceInfo, c *Change) (Severity) {
+
+	for _, r := range this.Rules {
+		if r.Match(di, c) {
+			return r.Severity
+		}
+	}
+
+	return this.Default
+}
+
+// Apply sets the severity of each of the device's current changes.
+func (this *AuditPolicy) Apply(di *DeviceInfo) {
+
+	for _, c := range di.Changes {
+		c.Severity = this.Classify(di, c)
+	}
+}
+
+// AtLeast returns the changes at or above a given severity.
+func (this Changes) AtLeast(s Severity) (c Changes) {
+
+	for _, ch := range this {
+		if ch.Severity.AtLeast(s) {
+			c = append(c, ch)
+		}
+	}
+
+	return c
+}
+
+// globMatch reports whether a value matches a glob pattern. An empty
+// pattern matches everything.
+func globMatch(pattern, s string) (bool) {
+
+	if pattern == `` {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, s)
+
+	return ok
+}
+
+// fieldTagName returns the tag name of a DeviceInfo field given its struct
+// field name, or the struct field name if there is no such field.
+func fieldTagName(name string) (string) {
+
+	for _, f := range deviceInfoFields {
+		if f.Name == name {
+			return TagName(f)
+		}
+	}
+
+	return name
+}
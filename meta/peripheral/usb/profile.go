@@ -0,0 +1,375 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`encoding/csv`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`sort`
+	`sync`
+)
+
+var (
+	profilesMu sync.RWMutex
+
+	// profiles is the registry of named field profiles. The 'csv', 'nvp'
+	// and 'cmp' profiles reproduce the fields selected by struct tags.
+	profiles = map[string]*Profile{
+		`csv`:		&Profile{Name: `csv`, Fields: taggedFields(`csv`)},
+		`nvp`:		&Profile{Name: `nvp`, Fields: taggedFields(`nvp`)},
+		`cmp`:		&Profile{Name: `cmp`, Fields: taggedFields(`cmp`)},
+		`full`:		&Profile{Name: `full`, Fields: taggedFields(``)},
+		`audit`:	&Profile{Name: `audit`, Fields: taggedFields(`cmp`)},
+		`summary`:	&Profile{Name: `summary`, Fields: []string{
+			`host_name`,
+			`vendor_id`,
+			`product_id`,
+			`serial_number`,
+			`vendor_name`,
+			`product_name`,
+		}},
+		`external`:	&Profile{Name: `external`, Fields: []string{
+			`vendor_id`,
+			`product_id`,
+			`vendor_name`,
+			`product_name`,
+			`product_ver`,
+			`firmware_ver`,
+			`software_id`,
+			`usb_spec`,
+			`usb_class`,
+			`usb_subclass`,
+			`usb_protocol`,
+			`device_speed`,
+			`device_ver`,
+			`object_type`,
+		}},
+	}
+)
+
+// Profile is a named, ordered selection of DeviceInfo fields by tag name
+// used by reports and comparisons. If the profile has a redaction policy,
+// CSVWith, NVPWith and JSONWith report redacted values; registered
+// profiles never have one.
+type Profile struct {
+	Name	string		`json:"name"`
+	Fields	[]string	`json:"fields"`
+	Redact	*RedactPolicy	`json:"-"`
+}
+
+// NewProfile instantiates a Profile after verifying the field names.
+func NewProfile(name string, fields ...string) (*Profile, error) {
+
+	for _, f := range fields {
+		if _, ok := deviceInfoIndex[f]; !ok {
+			return nil, fmt.Errorf(`profile %q: unknown field %q`, name, f)
+		}
+	}
+
+	return &Profile{Name: name, Fields: fields}, nil
+}
+
+// GetProfile returns a copy of a registered profile by name, so callers
+// cannot alter the registered profile.
+func GetProfile(name string) (*Profile, error) {
+
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	if p, ok := profiles[name]; !ok {
+		return nil, fmt.Errorf(`profile %q not found`, name)
+	} else {
+		return p.Copy(), nil
+	}
+}
+
+// Copy returns a copy of the profile that shares no fields with it. The
+// copy keeps the redaction policy.
+func (this *Profile) Copy() (*Profile) {
+
+	return &Profile{
+		Name:	this.Name,
+		Fields:	append([]string{}, this.Fields...),
+		Redact:	this.Redact,
+	}
+}
+
+// WithRedaction returns a copy of the profile whose reports are redacted
+// according to a policy.
+func (this *Profile) WithRedaction(r *RedactPolicy) (*Profile) {
+
+	that := this.Copy()
+	that.Redact = r
+
+	return that
+}
+
+// ProfileNames returns the names of all registered profiles.
+func ProfileNames() (names []string) {
+
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	for name := range profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// RegisterProfile adds a copy of a profile without its redaction policy
+// to the registry, replacing any existing profile with the same name.
+func RegisterProfile(p *Profile) (error) {
+
+	if _, err := NewProfile(p.Name, p.Fields...); err != nil {
+		return err
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	rp := p.Copy()
+	rp.Redact = nil
+	profiles[p.Name] = rp
+
+	return nil
+}
+
+// LoadProfiles registers profiles from a JSON file mapping profile names
+// to lists of field tag names.
+func LoadProfiles(fn string) (error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string][]string)
+
+	if err := json.Unmarshal(j, &m); err != nil {
+		return err
+	}
+
+	for name, fields := range m {
+		if err := RegisterProfile(&Profile{Name: name, Fields: fields}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CSVWith reports the profile fields in CSV format with a header row.
+func (this *DeviceInfo) CSVWith(p *Profile) ([]byte, error) {
+
+	that, err := this.redacted(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+
+	if err := w.Write(p.Fields); err != nil {
+		return nil, err
+	}
+	if err := w.Write(that.values(p)); err != nil {
+		return nil, err
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+// NVPWith reports the profile fields as name-value pairs.
+func (this *DeviceInfo) NVPWith(p *Profile) ([]byte, error) {
+
+	that, err := this.redacted(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	for i, v := range that.values(p) {
+		fmt.Fprintf(&b, "%s:%s\n", p.Fields[i], v)
+	}
+
+	return b.Bytes(), nil
+}
+
+// JSONWith reports the profile fields in JSON format, preserving the
+// profile field order.
+func (this *DeviceInfo) JSONWith(p *Profile) ([]byte, error) {
+
+	that, err := this.redacted(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+
+	for i, name := range p.Fields {
+
+		_, v, ok := that.field(name)
+
+		if !ok {
+			return nil, fmt.Errorf(`profile %q: unknown field %q`, p.Name, name)
+		}
+
+		k, err := json.Marshal(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		j, err := json.Marshal(v.Interface())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(j)
+	}
+
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
+
+// CompareWith compares the profile fields of another object with this one
+// using the DefaultComparator and returns an array of changes. Each change
+// is a tuple of field path, old value, and new value.
+func (this *DeviceInfo) CompareWith(other *DeviceInfo, p *Profile) (ss [][]string, err error) {
+
+	for _, name := range p.Fields {
+
+		f, nv, ok := this.field(name)
+
+		if !ok {
+			return nil, fmt.Errorf(`profile %q: unknown field %q`, p.Name, name)
+		}
+
+		_, ov, _ := other.field(name)
+
+		ss = append(ss, DefaultComparator.CompareField(f, ov, nv)...)
+	}
+
+	return ss, nil
+}
+
+// CompareFileWith compares the profile fields of an object restored from
+// a JSON file with this one and returns an array of changes.
+func (this *DeviceInfo) CompareFileWith(fn string, p *Profile) (ss [][]string, err error) {
+
+	other := &DeviceInfo{}
+
+	if err = other.RestoreFile(fn); err != nil {
+		return ss, err
+	}
+
+	return this.CompareWith(other, p)
+}
+
+// CompareJSONWith compares the profile fields of an object restored from
+// JSON with this one and returns an array of changes.
+func (this *DeviceInfo) CompareJSONWith(j []byte, p *Profile) (ss [][]string, err error) {
+
+	other := &DeviceInfo{}
+
+	if err = other.RestoreJSON(j); err != nil {
+		return ss, err
+	}
+
+	return this.CompareWith(other, p)
+}
+
+// AuditFileWith compares the profile fields of an object restored from a
+// JSON file with this one and stores changes internally.
+func (this *DeviceInfo) AuditFileWith(fn string, p *Profile) (error) {
+
+	ss, err := this.CompareFileWith(fn, p)
+
+	if err != nil {
+		return err
+	}
+
+	this.recordAudit(ss, fn)
+
+	return nil
+}
+
+// AuditJSONWith compares the profile fields of an object restored from
+// JSON with this one and stores changes internally.
+func (this *DeviceInfo) AuditJSONWith(j []byte, p *Profile) (error) {
+
+	other := &DeviceInfo{}
+
+	if err := other.RestoreJSON(j); err != nil {
+		return err
+	}
+
+	ss, err := this.CompareWith(other, p)
+
+	if err != nil {
+		return err
+	}
+
+	this.recordAudit(ss, jsonSource(other))
+
+	return nil
+}
+
+// redacted returns the object itself, or a redacted copy if the profile
+// has a redaction policy.
+func (this *DeviceInfo) redacted(p *Profile) (*DeviceInfo, error) {
+
+	if p.Redact == nil {
+		return this, nil
+	}
+
+	return this.Redact(p.Redact)
+}
+
+// values returns the profile field values as strings.
+func (this *DeviceInfo) values(p *Profile) (ss []string) {
+
+	for _, name := range p.Fields {
+		if _, v, ok := this.field(name); ok {
+			ss = append(ss, fmt.Sprint(v.Interface()))
+		} else {
+			ss = append(ss, ``)
+		}
+	}
+
+	return ss
+}
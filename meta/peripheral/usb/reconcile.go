@@ -0,0 +1,268 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`encoding/json`
+	`fmt`
+	`reflect`
+)
+
+const (
+	OwnerNone		Owner	= ``
+	OwnerDevice		Owner	= `device`
+	OwnerRecord		Owner	= `record`
+)
+
+// Owner identifies which side of a reconciliation is authoritative for a
+// field: the device itself, the central CMDB record, or neither.
+type Owner string
+
+// Ownership maps field tag names to their authoritative owner. Fields not
+// listed are owned by the default owner.
+type Ownership struct {
+	Fields	map[string]Owner	`json:"fields"`
+	Default	Owner			`json:"default"`
+}
+
+// DefaultOwnership makes the device authoritative for the properties it
+// reports about itself, the CMDB record authoritative for custom
+// attributes, and leaves the descriptive names and classes that either
+// side may refine without an owner.
+func DefaultOwnership() (*Ownership) {
+
+	return &Ownership{
+		Fields: map[string]Owner{
+			`host_name`:		OwnerDevice,
+			`vendor_id`:		OwnerDevice,
+			`product_id`:		OwnerDevice,
+			`serial_number`:	OwnerDevice,
+			`product_ver`:		OwnerDevice,
+			`firmware_ver`:		OwnerDevice,
+			`software_id`:		OwnerDevice,
+			`buffer_size`:		OwnerDevice,
+			`max_pkt_size`:		OwnerDevice,
+			`usb_spec`:		OwnerDevice,
+			`device_speed`:		OwnerDevice,
+			`device_ver`:		OwnerDevice,
+			`object_type`:		OwnerDevice,
+			`device_sn`:		OwnerDevice,
+			`factory_sn`:		OwnerDevice,
+			`descriptor_sn`:	OwnerDevice,
+			`custom_01`:		OwnerRecord,
+			`custom_02`:		OwnerRecord,
+			`custom_03`:		OwnerRecord,
+			`custom_04`:		OwnerRecord,
+			`custom_05`:		OwnerRecord,
+			`custom_06`:		OwnerRecord,
+			`custom_07`:		OwnerRecord,
+			`custom_08`:		OwnerRecord,
+			`custom_09`:		OwnerRecord,
+			`custom_10`:		OwnerRecord,
+		},
+		Default: OwnerNone,
+	}
+}
+
+// Owner returns the authoritative owner of a field.
+func (this *Ownership) Owner(name string) (Owner) {
+
+	if o, ok := this.Fields[name]; ok {
+		return o
+	}
+
+	return this.Default
+}
+
+// Verify checks that every field exists and every owner is known.
+func (this *Ownership) Verify() (error) {
+
+	for name, o := range this.Fields {
+		if _, ok := deviceInfoIndex[name]; !ok {
+			return fmt.Errorf(`ownership: unknown field %q`, name)
+		}
+		if !o.valid() {
+			return fmt.Errorf(`ownership: field %q: unknown owner %q`, name, o)
+		}
+	}
+
+	if !this.Default.valid() {
+		return fmt.Errorf(`ownership: unknown default owner %q`, this.Default)
+	}
+
+	return nil
+}
+
+// valid reports whether the owner is one of the known owners.
+func (this Owner) valid() (bool) {
+	return this == OwnerNone || this == OwnerDevice || this == OwnerRecord
+}
+
+// Conflict describes a field that changed differently on the device and
+// in the CMDB record since the baseline, or a change to an owned field by
+// the side that does not own it, and how it was resolved.
+type Conflict struct {
+	Field		string	`json:"field"`
+	Base		string	`json:"base"`
+	Device		string	`json:"device"`
+	Record		string	`json:"record"`
+	Resolved	string	`json:"resolved"`
+	Owner		Owner	`json:"owner"`
+}
+
+// Conflicts is a list of reconciliation conflicts.
+type Conflicts []*Conflict
+
+// JSON reports the conflicts in JSON format.
+func (this Conflicts) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the conflicts in formatted JSON format.
+func (this Conflicts) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// Reconcile merges a device, its saved baseline and its central CMDB
+// record. A field owned by the device always takes the device value and
+// one owned by the record always takes the record value; a change to it
+// by the other side since the baseline is reported as a conflict. Fields
+// without an owner are merged three ways: a field changed on only one
+// side takes the changed value, and one changed on both sides to
+// different values is a conflict resolved in favor of the device.
+// Volatile fields excluded from comparison, such as the bus address,
+// keep the device value. A nil baseline treats every difference as a
+// conflict.
+func Reconcile(base, device, record *DeviceInfo, own *Ownership) (*DeviceInfo, Conflicts, error) {
+
+	if device == nil || record == nil {
+		return nil, nil, fmt.Errorf(`device and record are required`)
+	}
+	if base == nil {
+		base = &DeviceInfo{}
+	}
+	if own == nil {
+		own = DefaultOwnership()
+	}
+	if err := own.Verify(); err != nil {
+		return nil, nil, err
+	}
+
+	result := *device
+	result.Changes, result.ChangeLog = nil, ChangeLog{}
+
+	var conflicts Conflicts
+
+	for _, f := range deviceInfoFields {
+
+		if f.Tag.Get(`cmp`) == `-` {
+			continue
+		}
+
+		name := TagName(f)
+
+		_, bv, _ := base.field(name)
+		_, dv, _ := device.field(name)
+		_, rv, _ := record.field(name)
+		_, v, _ := result.field(name)
+
+		b, d, r := bv.Interface(), dv.Interface(), rv.Interface()
+
+		if reflect.DeepEqual(d, r) {
+			v.Set(dv)
+			continue
+		}
+
+		c := &Conflict{
+			Field:	name,
+			Base:	fmt.Sprint(b),
+			Device:	fmt.Sprint(d),
+			Record:	fmt.Sprint(r),
+			Owner:	own.Owner(name),
+		}
+
+		switch {
+
+		case c.Owner == OwnerDevice:
+			v.Set(dv)
+			c.Resolved = c.Device
+			if reflect.DeepEqual(r, b) {
+				continue
+			}
+
+		case c.Owner == OwnerRecord:
+			v.Set(rv)
+			c.Resolved = c.Record
+			if reflect.DeepEqual(d, b) {
+				continue
+			}
+
+		case reflect.DeepEqual(d, b):
+			v.Set(rv)
+			continue
+
+		case reflect.DeepEqual(r, b):
+			v.Set(dv)
+			continue
+
+		default:
+			v.Set(dv)
+			c.Resolved = c.Device
+		}
+
+		conflicts = append(conflicts, c)
+	}
+
+	return &result, conflicts, nil
+}
+
+// ReconcileJSON reconciles this device with a baseline and a CMDB record
+// given as JSON documents. An empty baseline treats every difference as
+// a conflict.
+func (this *DeviceInfo) ReconcileJSON(base, record []byte, own *Ownership) (*DeviceInfo, Conflicts, error) {
+
+	var b *DeviceInfo
+
+	if len(base) > 0 {
+		b = &DeviceInfo{}
+		if err := b.RestoreJSON(base); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r := &DeviceInfo{}
+
+	if err := r.RestoreJSON(record); err != nil {
+		return nil, nil, err
+	}
+
+	return Reconcile(b, this, r, own)
+}
+
+// ReconcileFile reconciles this device with a baseline and a CMDB record
+// saved in JSON files.
+func (this *DeviceInfo) ReconcileFile(base, record string, own *Ownership) (*DeviceInfo, Conflicts, error) {
+
+	b, r := &DeviceInfo{}, &DeviceInfo{}
+
+	if err := b.RestoreFile(base); err != nil {
+		return nil, nil, err
+	}
+	if err := r.RestoreFile(record); err != nil {
+		return nil, nil, err
+	}
+
+	return Reconcile(b, this, r, own)
+}
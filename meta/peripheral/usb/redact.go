@@ -0,0 +1,348 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`crypto/aes`
+	`crypto/cipher`
+	`crypto/hmac`
+	`crypto/sha256`
+	`encoding/base64`
+	`encoding/hex`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`reflect`
+	`strings`
+)
+
+const (
+	RedactNone		RedactMode	= ``
+	RedactMask		RedactMode	= `mask`
+	RedactHash		RedactMode	= `hash`
+	RedactToken		RedactMode	= `token`
+
+	redactMaskChar		string	= `*`
+	redactMaskKeep		int	= 4
+	redactHashSize		int	= 16
+	redactTokenPrefix	string	= `tok:`
+	redactMinKeySize	int	= 16
+
+	redactHashLabel		string	= `cmdb-redact-hash`
+	redactNonceLabel	string	= `cmdb-redact-nonce`
+	redactCipherLabel	string	= `cmdb-redact-cipher`
+)
+
+// RedactMode determines how a field value is redacted.
+type RedactMode string
+
+// RedactPolicy maps field tag names to redaction modes. The key is used
+// to hash values and to encrypt reversible tokens. Hashing requires a key
+// of at least 16 bytes, so that low-entropy values such as host names
+// cannot be recovered by hashing guesses, and tokenization requires a 16,
+// 24 or 32-byte key; only holders of the key can recover the original
+// values. Separate subkeys are derived from the key for each use.
+type RedactPolicy struct {
+	Fields	map[string]RedactMode	`json:"fields"`
+	Key	[]byte			`json:"-"`
+}
+
+// DefaultRedactPolicy hashes serial numbers and host names and masks
+// custom attributes. The key must be at least 16 bytes.
+func DefaultRedactPolicy(key []byte) (*RedactPolicy, error) {
+
+	this := &RedactPolicy{
+		Fields: map[string]RedactMode{
+			`host_name`:		RedactHash,
+			`serial_number`:	RedactHash,
+			`device_sn`:		RedactHash,
+			`factory_sn`:		RedactHash,
+			`descriptor_sn`:	RedactHash,
+			`fingerprint`:		RedactHash,
+			`custom_01`:		RedactMask,
+			`custom_02`:		RedactMask,
+			`custom_03`:		RedactMask,
+			`custom_04`:		RedactMask,
+			`custom_05`:		RedactMask,
+			`custom_06`:		RedactMask,
+			`custom_07`:		RedactMask,
+			`custom_08`:		RedactMask,
+			`custom_09`:		RedactMask,
+			`custom_10`:		RedactMask,
+		},
+		Key: key,
+	}
+
+	if err := this.Verify(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// NewRedactPolicy instantiates a RedactPolicy after verifying the field
+// names, modes and key.
+func NewRedactPolicy(key []byte, fields map[string]RedactMode) (this *RedactPolicy, err error) {
+
+	this = &RedactPolicy{Fields: fields, Key: key}
+
+	if err = this.Verify(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// LoadRedactPolicy reads a RedactPolicy from a JSON file.
+func LoadRedactPolicy(fn string, key []byte) (*RedactPolicy, error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &RedactPolicy{}
+
+	if err := json.Unmarshal(j, this); err != nil {
+		return nil, err
+	}
+
+	return NewRedactPolicy(key, this.Fields)
+}
+
+// Verify checks that every field exists and holds a string, that every
+// mode is known, and that the key is usable for hashing and tokenization
+// if needed.
+func (this *RedactPolicy) Verify() (error) {
+
+	for name, mode := range this.Fields {
+
+		if i, ok := deviceInfoIndex[name]; !ok {
+			return fmt.Errorf(`redact policy: unknown field %q`, name)
+		} else if deviceInfoFields[i].Type.Kind() != reflect.String {
+			return fmt.Errorf(`redact policy: field %q is not a string`, name)
+		}
+
+		switch mode {
+
+		case RedactNone, RedactMask:
+
+		case RedactHash:
+			if len(this.Key) < redactMinKeySize {
+				return fmt.Errorf(`redact policy: field %q: hash key must be at least %d bytes`,
+					name, redactMinKeySize)
+			}
+
+		case RedactToken:
+			if _, err := aes.NewCipher(this.Key); err != nil {
+				return fmt.Errorf(`redact policy: field %q: %v`, name, err)
+			}
+
+		default:
+			return fmt.Errorf(`redact policy: field %q: unknown mode %q`, name, mode)
+		}
+	}
+
+	return nil
+}
+
+// Redact returns a copy of the object with fields redacted according to
+// the policy. All Reporter output of the copy is redacted.
+func (this *DeviceInfo) Redact(p *RedactPolicy) (*DeviceInfo, error) {
+
+	that := *this
+
+	for name, mode := range p.Fields {
+
+		_, v, ok := that.field(name)
+
+		if !ok || v.Kind() != reflect.String {
+			return nil, fmt.Errorf(`redact policy: invalid field %q`, name)
+		}
+
+		if s, err := p.redact(mode, v.String()); err != nil {
+			return nil, err
+		} else {
+			v.SetString(s)
+		}
+	}
+
+	return &that, nil
+}
+
+// Value redacts a single value of a field, identified by tag name,
+// according to the policy. Values of fields not in the policy are
+// returned unchanged.
+func (this *RedactPolicy) Value(name, s string) (string, error) {
+
+	if mode, ok := this.Fields[name]; !ok {
+		return s, nil
+	} else {
+		return this.redact(mode, s)
+	}
+}
+
+// Unredact returns a copy of the object with tokenized fields restored to
+// their original values. Masked and hashed fields cannot be restored.
+func (this *DeviceInfo) Unredact(p *RedactPolicy) (*DeviceInfo, error) {
+
+	that := *this
+
+	for name, mode := range p.Fields {
+
+		if mode != RedactToken {
+			continue
+		}
+
+		_, v, ok := that.field(name)
+
+		if !ok || v.Kind() != reflect.String {
+			return nil, fmt.Errorf(`redact policy: invalid field %q`, name)
+		}
+
+		if s, err := p.Detokenize(v.String()); err != nil {
+			return nil, fmt.Errorf(`field %q: %v`, name, err)
+		} else {
+			v.SetString(s)
+		}
+	}
+
+	return &that, nil
+}
+
+// Tokenize encrypts a value into a reversible token. Tokens are
+// deterministic so that equal values produce equal tokens: the nonce is
+// an HMAC of the value under a subkey separate from the cipher key.
+func (this *RedactPolicy) Tokenize(s string) (string, error) {
+
+	if s == `` {
+		return ``, nil
+	}
+
+	aead, err := this.aead()
+
+	if err != nil {
+		return ``, err
+	}
+
+	mac := hmac.New(sha256.New, this.subkey(redactNonceLabel, sha256.Size))
+	mac.Write([]byte(s))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	token := aead.Seal(nonce, nonce, []byte(s), nil)
+
+	return redactTokenPrefix + base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Detokenize decrypts a token produced by Tokenize.
+func (this *RedactPolicy) Detokenize(token string) (string, error) {
+
+	if token == `` {
+		return ``, nil
+	}
+
+	if !strings.HasPrefix(token, redactTokenPrefix) {
+		return ``, fmt.Errorf(`malformed token`)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, redactTokenPrefix))
+
+	if err != nil {
+		return ``, err
+	}
+
+	aead, err := this.aead()
+
+	if err != nil {
+		return ``, err
+	}
+
+	if len(b) < aead.NonceSize() {
+		return ``, fmt.Errorf(`malformed token`)
+	}
+
+	s, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+
+	if err != nil {
+		return ``, err
+	}
+
+	return string(s), nil
+}
+
+// redact applies a redaction mode to a single value.
+func (this *RedactPolicy) redact(mode RedactMode, s string) (string, error) {
+
+	if s == `` {
+		return s, nil
+	}
+
+	switch mode {
+
+	case RedactNone:
+		return s, nil
+
+	case RedactMask:
+		if n := len(s) - redactMaskKeep; n > redactMaskKeep {
+			return strings.Repeat(redactMaskChar, n) + s[n:], nil
+		}
+		return strings.Repeat(redactMaskChar, len(s)), nil
+
+	case RedactHash:
+		if len(this.Key) < redactMinKeySize {
+			return ``, fmt.Errorf(`hash key must be at least %d bytes`, redactMinKeySize)
+		}
+		mac := hmac.New(sha256.New, this.subkey(redactHashLabel, sha256.Size))
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil)[:redactHashSize]), nil
+
+	case RedactToken:
+		return this.Tokenize(s)
+
+	default:
+		return ``, fmt.Errorf(`unknown redaction mode %q`, mode)
+	}
+}
+
+// aead returns the authenticated cipher used for tokenization. Its key
+// is a subkey of the same length as the policy key, which selects AES-128,
+// AES-192 or AES-256.
+func (this *RedactPolicy) aead() (cipher.AEAD, error) {
+
+	switch len(this.Key) {
+	case 16, 24, 32:
+	default:
+		return nil, aes.KeySizeError(len(this.Key))
+	}
+
+	block, err := aes.NewCipher(this.subkey(redactCipherLabel, len(this.Key)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// subkey derives a key of a given size, at most 32 bytes, for one use of
+// the policy key.
+func (this *RedactPolicy) subkey(label string, size int) ([]byte) {
+
+	mac := hmac.New(sha256.New, this.Key)
+	mac.Write([]byte(label))
+
+	return mac.Sum(nil)[:size]
+}
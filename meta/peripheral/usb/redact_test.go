@@ -0,0 +1,163 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`strings`
+	`testing`
+)
+
+// testRedactKey is a 32-byte key usable for hashing and tokenization.
+var testRedactKey = []byte(`0123456789abcdef0123456789abcdef`)
+
+// testRedactInfo returns a device whose redacted values are distinctive
+// enough to be found in any output.
+func testRedactInfo() (*DeviceInfo) {
+
+	return &DeviceInfo{
+		HostName:	`secret-host-01`,
+		VendorID:	`0801`,
+		ProductID:	`0001`,
+		SerialNum:	`SECRETSERIAL42`,
+		VendorName:	`Mag-Tek`,
+		ProductName:	`USB Swipe Reader`,
+		DeviceSN:	`SECRETDEVICESN`,
+		Custom01:	`secret-custom-attr`,
+	}
+}
+
+func TestRedactOutput(t *testing.T) {
+
+	secrets := []string{`secret-host-01`, `SECRETSERIAL42`, `SECRETDEVICESN`, `secret-custom-attr`}
+
+	modes := []RedactMode{RedactMask, RedactHash, RedactToken}
+
+	for _, mode := range modes {
+
+		rp, err := NewRedactPolicy(testRedactKey, map[string]RedactMode{
+			`host_name`:		mode,
+			`serial_number`:	mode,
+			`device_sn`:		mode,
+			`custom_01`:		mode,
+		})
+
+		if err != nil {
+			t.Fatalf(`%s: %v`, mode, err)
+		}
+
+		di := testRedactInfo()
+		rdi, err := di.Redact(rp)
+
+		if err != nil {
+			t.Fatalf(`%s: %v`, mode, err)
+		}
+
+		p, err := GetProfile(`full`)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p = p.WithRedaction(rp)
+
+		outputs := map[string]func() ([]byte, error){
+			`JSON`:		rdi.JSON,
+			`XML`:		rdi.XML,
+			`CSV`:		rdi.CSV,
+			`NVP`:		rdi.NVP,
+			`PrettyJSON`:	rdi.PrettyJSON,
+			`PrettyXML`:	rdi.PrettyXML,
+			`CSVWith`:	func() ([]byte, error) { return di.CSVWith(p) },
+			`NVPWith`:	func() ([]byte, error) { return di.NVPWith(p) },
+			`JSONWith`:	func() ([]byte, error) { return di.JSONWith(p) },
+		}
+
+		for name, fn := range outputs {
+
+			b, err := fn()
+
+			if err != nil {
+				t.Fatalf(`%s %s: %v`, mode, name, err)
+			}
+
+			for _, s := range secrets {
+				if strings.Contains(string(b), s) {
+					t.Errorf(`%s %s: output contains %q`, mode, name, s)
+				}
+			}
+		}
+
+		if b, err := di.JSONWith(p); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(string(b), `"vendor_name":"Mag-Tek"`) {
+			t.Errorf(`%s JSONWith: unredacted field missing: %s`, mode, b)
+		}
+
+		if di.HostName != `secret-host-01` {
+			t.Errorf(`%s: Redact modified the original object`, mode)
+		}
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+
+	rp, err := NewRedactPolicy(testRedactKey, map[string]RedactMode{
+		`host_name`:		RedactToken,
+		`serial_number`:	RedactToken,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	di := testRedactInfo()
+	rdi, err := di.Redact(rp)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if udi, err := rdi.Unredact(rp); err != nil {
+		t.Fatal(err)
+	} else if udi.HostName != di.HostName || udi.SerialNum != di.SerialNum {
+		t.Errorf(`Unredact: got %q %q, want %q %q`,
+			udi.HostName, udi.SerialNum, di.HostName, di.SerialNum)
+	}
+}
+
+func TestRegisterProfileRedaction(t *testing.T) {
+
+	rp, err := DefaultRedactPolicy(testRedactKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProfile(`redacted-test`, `host_name`, `vendor_id`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterProfile(p.WithRedaction(rp)); err != nil {
+		t.Fatal(err)
+	}
+
+	if rp, err := GetProfile(`redacted-test`); err != nil {
+		t.Fatal(err)
+	} else if rp.Redact != nil {
+		t.Errorf(`registered profile kept its redaction policy`)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`reflect`
+	`sort`
+	`strings`
+	`time`
+)
+
+const (
+	SchemaDraft		string	= `http://json-schema.org/draft-04/schema#`
+)
+
+var (
+	// deviceInfoSchema is used to validate DeviceInfo JSON input.
+	deviceInfoSchema = MustSchema(DeviceInfo{})
+
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// Schema is a JSON Schema document generated from struct tags.
+type Schema struct {
+	Schema		string			`json:"$schema,omitempty"`
+	Title		string			`json:"title,omitempty"`
+	Type		string			`json:"type"`
+	Format		string			`json:"format,omitempty"`
+	Properties	map[string]*Schema	`json:"properties,omitempty"`
+	Required	[]string		`json:"required,omitempty"`
+	Items		*Schema			`json:"items,omitempty"`
+	AdditionalProps	interface{}		`json:"additionalProperties,omitempty"`
+}
+
+// NewSchema generates a JSON Schema document from the exported fields and
+// JSON tags of a struct. Embedded structs are flattened as they are by
+// encoding/json; fields without 'omitempty' are required.
+func NewSchema(i interface{}) (*Schema, error) {
+
+	t := reflect.TypeOf(i)
+
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf(`unsupported type %T`, i)
+	}
+
+	this := typeSchema(t)
+	this.Schema = SchemaDraft
+	this.Title = t.Name()
+
+	return this, nil
+}
+
+// MustSchema is like NewSchema but panics on error.
+func MustSchema(i interface{}) (*Schema) {
+
+	if s, err := NewSchema(i); err != nil {
+		panic(err)
+	} else {
+		return s
+	}
+}
+
+// JSON reports the schema in JSON format.
+func (this *Schema) JSON() ([]byte, error) {
+	return json.Marshal(this)
+}
+
+// PrettyJSON reports the schema in formatted JSON format.
+func (this *Schema) PrettyJSON() ([]byte, error) {
+	return json.MarshalIndent(this, MarshalPrefix, MarshalIndent)
+}
+
+// Validate checks a JSON document against the schema and returns a
+// SchemaErrors value listing every offending field. Required fields must
+// be present and, where the schema forbids them, unknown fields are
+// rejected.
+func (this *Schema) Validate(j []byte) (error) {
+	return this.check(j, true)
+}
+
+// ValidateTypes checks the types of the fields present in a JSON document
+// against the schema and returns a SchemaErrors value listing every
+// offending field. Missing and unknown fields are allowed, so documents
+// written by older or newer versions still pass.
+func (this *Schema) ValidateTypes(j []byte) (error) {
+	return this.check(j, false)
+}
+
+// check decodes a JSON document and validates it against the schema.
+func (this *Schema) check(j []byte, strict bool) (error) {
+
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	var errs SchemaErrors
+
+	this.validate(``, v, strict, &errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// validate recursively checks a decoded value against the schema. Required
+// and unknown fields are checked only if strict is set.
+func (this *Schema) validate(path string, v interface{}, strict bool, errs *SchemaErrors) {
+
+	field := path
+
+	if field == `` {
+		field = `/`
+	}
+
+	switch this.Type {
+
+	case `string`:
+		if _, ok := v.(string); !ok {
+			errs.add(field, `expected string, got %s`, jsonType(v))
+		} else if this.Format == `date-time` {
+			if _, err := time.Parse(time.RFC3339, v.(string)); err != nil {
+				errs.add(field, `expected RFC 3339 date-time`)
+			}
+		}
+
+	case `integer`:
+		if n, ok := v.(json.Number); !ok {
+			errs.add(field, `expected integer, got %s`, jsonType(v))
+		} else if _, err := n.Int64(); err != nil {
+			errs.add(field, `expected integer, got %s`, n)
+		}
+
+	case `number`:
+		if _, ok := v.(json.Number); !ok {
+			errs.add(field, `expected number, got %s`, jsonType(v))
+		}
+
+	case `boolean`:
+		if _, ok := v.(bool); !ok {
+			errs.add(field, `expected boolean, got %s`, jsonType(v))
+		}
+
+	case `array`:
+		if v == nil {
+			return
+		}
+		if a, ok := v.([]interface{}); !ok {
+			errs.add(field, `expected array, got %s`, jsonType(v))
+		} else if this.Items != nil {
+			for i, e := range a {
+				this.Items.validate(fmt.Sprintf(`%s/%d`, path, i), e, strict, errs)
+			}
+		}
+
+	case `object`:
+		if v == nil {
+			return
+		}
+
+		m, ok := v.(map[string]interface{})
+
+		if !ok {
+			errs.add(field, `expected object, got %s`, jsonType(v))
+			return
+		}
+
+		if strict {
+			for _, name := range this.Required {
+				if _, ok := m[name]; !ok {
+					errs.add(path + `/` + name, `required field missing`)
+				}
+			}
+		}
+
+		var names []string
+
+		for name := range m {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+
+			if s, ok := this.Properties[name]; ok {
+				s.validate(path + `/` + name, m[name], strict, errs)
+				continue
+			}
+
+			switch ap := this.AdditionalProps.(type) {
+			case *Schema:
+				ap.validate(path + `/` + name, m[name], strict, errs)
+			case bool:
+				if !ap && strict {
+					errs.add(path + `/` + name, `unknown field`)
+				}
+			}
+		}
+	}
+}
+
+// SchemaError describes a schema violation in a single field. Field is
+// a JSON Pointer to the offending value.
+type SchemaError struct {
+	Field		string
+	Message		string
+}
+
+// Error implements the error interface for SchemaError.
+func (this *SchemaError) Error() (string) {
+	return fmt.Sprintf(`field %q: %s`, this.Field, this.Message)
+}
+
+// SchemaErrors is a list of schema violations.
+type SchemaErrors []*SchemaError
+
+// Error implements the error interface for SchemaErrors.
+func (this SchemaErrors) Error() (string) {
+
+	var ss []string
+
+	for _, e := range this {
+		ss = append(ss, e.Error())
+	}
+
+	return strings.Join(ss, `; `)
+}
+
+// add appends a new schema violation to the list.
+func (this *SchemaErrors) add(field, format string, args ...interface{}) {
+	*this = append(*this, &SchemaError{field, fmt.Sprintf(format, args...)})
+}
+
+// typeSchema generates the schema for a Go type.
+func typeSchema(t reflect.Type) (*Schema) {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return &Schema{Type: `string`, Format: `date-time`}
+	}
+
+	switch t.Kind() {
+
+	case reflect.String:
+		return &Schema{Type: `string`}
+
+	case reflect.Bool:
+		return &Schema{Type: `boolean`}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: `integer`}
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: `number`}
+
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: `array`, Items: typeSchema(t.Elem())}
+
+	case reflect.Map:
+		return &Schema{Type: `object`, AdditionalProps: typeSchema(t.Elem())}
+
+	case reflect.Struct:
+		this := &Schema{
+			Type:		`object`,
+			Properties:	make(map[string]*Schema),
+			AdditionalProps: false,
+		}
+		this.addFields(t)
+		return this
+
+	default:
+		return &Schema{}
+	}
+}
+
+// addFields adds the serialized fields of a struct type to an object
+// schema, flattening untagged embedded structs.
+func (this *Schema) addFields(t reflect.Type) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+		tag := f.Tag.Get(`json`)
+
+		if tag == `-` {
+			continue
+		}
+
+		opts := strings.Split(tag, `,`)
+		name := opts[0]
+
+		if f.Anonymous && name == `` {
+			et := f.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				this.addFields(et)
+				continue
+			}
+		}
+
+		if f.PkgPath != `` {
+			continue
+		}
+
+		if name == `` {
+			name = f.Name
+		}
+
+		this.Properties[name] = typeSchema(f.Type)
+
+		omitempty := false
+
+		for _, opt := range opts[1:] {
+			if opt == `omitempty` {
+				omitempty = true
+			}
+		}
+
+		if !omitempty {
+			this.Required = append(this.Required, name)
+		}
+	}
+}
+
+// jsonType returns the JSON type name of a decoded value.
+func jsonType(v interface{}) (string) {
+
+	switch v.(type) {
+	case nil:
+		return `null`
+	case string:
+		return `string`
+	case json.Number:
+		return `number`
+	case bool:
+		return `boolean`
+	case []interface{}:
+		return `array`
+	case map[string]interface{}:
+		return `object`
+	default:
+		return fmt.Sprintf(`%T`, v)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`errors`
+	`fmt`
+	`time`
+)
+
+// ErrNotFound is returned by a Store when no record matches a lookup.
+var ErrNotFound = errors.New(`record not found`)
+
+// Store persists device records keyed by fingerprint and keeps a history
+// of every stored revision.
+type Store interface {
+	Put(*DeviceInfo) (error)
+	Get(string) (*DeviceInfo, error)
+	GetBySerial(string) (*DeviceInfo, error)
+	List(*Filter) ([]*DeviceInfo, error)
+	History(string) ([]*Revision, error)
+	Close() (error)
+}
+
+// Revision is a device record as it was stored at a point in time.
+type Revision struct {
+	Stored		time.Time	`json:"stored"`
+	Device		*DeviceInfo	`json:"device"`
+}
+
+// Filter selects device records. Each non-empty field is a glob pattern
+// matched against the corresponding DeviceInfo field; a nil Filter
+// matches every record.
+type Filter struct {
+	HostName	string	`json:"host_name,omitempty"`
+	VendorID	string	`json:"vendor_id,omitempty"`
+	ProductID	string	`json:"product_id,omitempty"`
+	SerialNum	string	`json:"serial_number,omitempty"`
+	ObjectType	string	`json:"object_type,omitempty"`
+}
+
+// Match reports whether a device record satisfies the filter.
+func (this *Filter) Match(di *DeviceInfo) (bool) {
+
+	if this == nil {
+		return true
+	}
+
+	return globMatch(this.HostName, di.HostName) &&
+		globMatch(this.VendorID, di.VendorID) &&
+		globMatch(this.ProductID, di.ProductID) &&
+		globMatch(this.SerialNum, di.SerialNum) &&
+		globMatch(this.ObjectType, di.ObjectType)
+}
+
+// SaveStore saves the object to a store.
+func (this *DeviceInfo) SaveStore(s Store) (error) {
+	return s.Put(this)
+}
+
+// RestoreStore restores the object from the store record with a given
+// fingerprint.
+func (this *DeviceInfo) RestoreStore(s Store, fp string) (error) {
+
+	if that, err := s.Get(fp); err != nil {
+		return err
+	} else {
+		*this = *that
+	}
+
+	return nil
+}
+
+// CompareStore compares fields of the stored record with the same
+// fingerprint and returns an array of changes.
+func (this *DeviceInfo) CompareStore(s Store) (ss [][]string, err error) {
+
+	other, err := s.Get(this.FP())
+
+	if err != nil {
+		return ss, err
+	}
+
+	return DefaultComparator.Compare(other, this)
+}
+
+// AuditStore compares fields of the stored record with the same
+// fingerprint and stores changes internally.
+func (this *DeviceInfo) AuditStore(s Store) (error) {
+
+	ss, err := this.CompareStore(s)
+
+	if err != nil {
+		return err
+	}
+
+	this.recordAudit(ss, fmt.Sprintf(`store:%s`, this.FP()))
+
+	return nil
+}
+
+// NewStoreAuditor instantiates an Auditor with baselines read from every
+// record in a store that matches a filter.
+func NewStoreAuditor(s Store, f *Filter, policy *AuditPolicy) (*Auditor, error) {
+
+	dis, err := s.List(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	baselines := make(map[string]*DeviceInfo)
+
+	for _, di := range dis {
+		baselines[fmt.Sprintf(`store:%s`, di.FP())] = di
+	}
+
+	return NewAuditor(baselines, policy), nil
+}
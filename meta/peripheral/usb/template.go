@@ -0,0 +1,225 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`bytes`
+	`fmt`
+	`io/ioutil`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`text/template`
+	`time`
+
+	`github.com/jscherff/cmdb/meta/peripheral`
+)
+
+// Built-in templates. Each is executed with a slice of *DeviceInfo.
+const (
+	TemplateNVP = `{{range .}}` +
+		`host_name:{{.HostName}}{{"\n"}}` +
+		`vendor_id:{{.VendorID}}{{"\n"}}` +
+		`product_id:{{.ProductID}}{{"\n"}}` +
+		`serial_number:{{.SerialNum}}{{"\n"}}` +
+		`vendor_name:{{.VendorName}}{{"\n"}}` +
+		`product_name:{{.ProductName}}{{"\n"}}` +
+		`product_ver:{{.ProductVer}}{{"\n"}}` +
+		`firmware_ver:{{.FirmwareVer}}{{"\n"}}` +
+		`software_id:{{.SoftwareID}}{{"\n"}}` +
+		`{{end}}`
+
+	TemplateLabel = `{{range .}}` +
+		`+----------------------------------------+{{"\n"}}` +
+		`| {{vendor .VendorID | padr 38}} |{{"\n"}}` +
+		`| {{product .VendorID .ProductID | padr 38}} |{{"\n"}}` +
+		`| {{printf "VID/PID: %s/%s" .VendorID .ProductID | padr 38}} |{{"\n"}}` +
+		`| {{printf "S/N: %s" .SerialNum | padr 38}} |{{"\n"}}` +
+		`| {{printf "Host: %s" .HostName | padr 38}} |{{"\n"}}` +
+		`+----------------------------------------+{{"\n"}}` +
+		`{{end}}`
+
+	TemplateHTML = `<table>{{"\n"}}` +
+		`<tr><th>Host</th><th>Vendor ID</th><th>Product ID</th>` +
+		`<th>Serial Number</th><th>Vendor</th><th>Product</th>` +
+		`<th>Firmware</th></tr>{{"\n"}}` +
+		`{{range .}}` +
+		`<tr><td>{{html .HostName}}</td><td>{{html .VendorID}}</td>` +
+		`<td>{{html .ProductID}}</td><td>{{html .SerialNum}}</td>` +
+		`<td>{{vendor .VendorID | html}}</td>` +
+		`<td>{{product .VendorID .ProductID | html}}</td>` +
+		`<td>{{html .FirmwareVer}}</td></tr>{{"\n"}}` +
+		`{{end}}` +
+		`</table>{{"\n"}}`
+)
+
+var builtinTemplates = map[string]string{
+	`nvp`:		TemplateNVP,
+	`label`:	TemplateLabel,
+	`html`:		TemplateHTML,
+}
+
+// Template is a text/template report layout for DeviceInfo objects.
+// Templates are executed with a slice of *DeviceInfo.
+type Template struct {
+	*template.Template
+	meta *peripheral.Usb
+}
+
+// NewTemplate parses a report template. The optional USB metadata is used
+// by the vendor, product and class helper functions to resolve names.
+func NewTemplate(name, text string, meta *peripheral.Usb) (this *Template, err error) {
+
+	this = &Template{meta: meta}
+
+	if this.Template, err = template.New(name).Funcs(this.funcs()).Parse(text); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// LoadTemplate parses a report template from a file.
+func LoadTemplate(fn string, meta *peripheral.Usb) (*Template, error) {
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTemplate(filepath.Base(fn), string(b), meta)
+}
+
+// BuiltinTemplate returns one of the built-in report templates by name:
+// 'nvp', 'label' or 'html'.
+func BuiltinTemplate(name string, meta *peripheral.Usb) (*Template, error) {
+
+	if text, ok := builtinTemplates[name]; !ok {
+		return nil, fmt.Errorf(`template %q not found`, name)
+	} else {
+		return NewTemplate(name, text, meta)
+	}
+}
+
+// Render executes the template against one or more devices.
+func (this *Template) Render(objs ...*DeviceInfo) ([]byte, error) {
+
+	var b bytes.Buffer
+
+	if err := this.Execute(&b, objs); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Render reports the device using a custom template.
+func (this *DeviceInfo) Render(t *Template) ([]byte, error) {
+	return t.Render(this)
+}
+
+// funcs returns the helper functions available to templates.
+func (this *Template) funcs() (template.FuncMap) {
+
+	return template.FuncMap{
+		`padl`:		padLeft,
+		`padr`:		padRight,
+		`hex`:		hexFormat,
+		`upper`:	strings.ToUpper,
+		`lower`:	strings.ToLower,
+		`trim`:		strings.TrimSpace,
+		`join`:		strings.Join,
+		`now`:		time.Now,
+		`vendor`:	this.vendor,
+		`product`:	this.product,
+		`class`:	this.class,
+	}
+}
+
+// vendor resolves a vendor ID to a vendor name, returning the ID if the
+// vendor is unknown.
+func (this *Template) vendor(vid string) (string) {
+
+	if this.meta == nil {
+		return vid
+	}
+	if v, err := this.meta.GetVendor(vid); err == nil {
+		return v.String()
+	}
+
+	return vid
+}
+
+// product resolves a vendor and product ID to a product name, returning
+// the product ID if the product is unknown.
+func (this *Template) product(vid, pid string) (string) {
+
+	if this.meta == nil {
+		return pid
+	}
+	if v, err := this.meta.GetVendor(vid); err != nil {
+		return pid
+	} else if p, err := v.GetProduct(pid); err == nil {
+		return p.String()
+	}
+
+	return pid
+}
+
+// class resolves a class ID to a class name, returning the ID if the
+// class is unknown.
+func (this *Template) class(cid string) (string) {
+
+	if this.meta == nil {
+		return cid
+	}
+	if c, err := this.meta.GetClass(cid); err == nil {
+		return c.String()
+	}
+
+	return cid
+}
+
+// padLeft right-justifies a value in a field of the given width.
+func padLeft(n int, v interface{}) (string) {
+	return fmt.Sprintf(`%*v`, n, v)
+}
+
+// padRight left-justifies a value in a field of the given width.
+func padRight(n int, v interface{}) (string) {
+	return fmt.Sprintf(`%-*v`, n, v)
+}
+
+// hexFormat formats an integer, or a string holding a hexadecimal number,
+// as zero-padded lowercase hexadecimal of the given width.
+func hexFormat(n int, v interface{}) (string, error) {
+
+	switch t := v.(type) {
+
+	case int:
+		return fmt.Sprintf(`%0*x`, n, t), nil
+
+	case string:
+		i, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(t), `0x`), 16, 64)
+		if err != nil {
+			return ``, err
+		}
+		return fmt.Sprintf(`%0*x`, n, i), nil
+
+	default:
+		return ``, fmt.Errorf(`unsupported type %T`, t)
+	}
+}
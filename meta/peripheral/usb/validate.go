@@ -0,0 +1,83 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import (
+	`fmt`
+	`regexp`
+)
+
+var (
+	// hexIDRgx matches vendor and product IDs as reported by gousb.
+	hexIDRgx = regexp.MustCompile(`^[0-9a-f]{4}$`)
+
+	// serialRgx matches serial numbers of printable ASCII without spaces.
+	serialRgx = regexp.MustCompile(`^[\x21-\x7e]*$`)
+
+	// requiredFields must be non-empty in a valid DeviceInfo.
+	requiredFields = []string{`host_name`, `vendor_id`, `product_id`, `object_type`}
+
+	// serialFields hold serial numbers assigned by us. The factory and
+	// descriptor serial numbers are read from the hardware, may contain
+	// spaces or padding and feed the fingerprint, so they are stored
+	// exactly as read and not checked.
+	serialFields = []string{`serial_number`, `device_sn`}
+)
+
+// ValidateSN checks that a serial number is not empty and consists of
+// printable ASCII characters without spaces.
+func ValidateSN(s string) (error) {
+
+	if s == `` {
+		return fmt.Errorf(`serial number is empty`)
+	}
+	if !serialRgx.MatchString(s) {
+		return fmt.Errorf(`serial number %q contains invalid characters`, s)
+	}
+
+	return nil
+}
+
+// Validate checks required fields, the format of the vendor and product
+// IDs and the character set of the assigned serial numbers. It returns a
+// SchemaErrors value listing every offending field.
+func (this *DeviceInfo) Validate() (error) {
+
+	var errs SchemaErrors
+
+	for _, name := range requiredFields {
+		if s, _ := this.GetString(name); s == `` {
+			errs.add(`/` + name, `required field empty`)
+		}
+	}
+
+	for _, name := range []string{`vendor_id`, `product_id`} {
+		if s, _ := this.GetString(name); s != `` && !hexIDRgx.MatchString(s) {
+			errs.add(`/` + name, `expected four lowercase hex digits, got %q`, s)
+		}
+	}
+
+	for _, name := range serialFields {
+		if s, _ := this.GetString(name); !serialRgx.MatchString(s) {
+			errs.add(`/` + name, `invalid characters in %q`, s)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
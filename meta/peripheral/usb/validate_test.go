@@ -0,0 +1,57 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usb
+
+import `testing`
+
+func TestValidate(t *testing.T) {
+
+	valid := func() (*DeviceInfo) {
+		return &DeviceInfo{
+			HostName:	`host01`,
+			VendorID:	`0801`,
+			ProductID:	`0001`,
+			ObjectType:	`*usb.Magtek`,
+			SerialNum:	`24FFFFF`,
+			DeviceSN:	`24FFFFF`,
+		}
+	}
+
+	tests := []struct {
+		name	string
+		edit	func(*DeviceInfo)
+		ok	bool
+	}{
+		{`valid`, func(di *DeviceInfo) {}, true},
+		{`padded factory serial`, func(di *DeviceInfo) { di.FactorySN = "B4 1234\x00\x00" }, true},
+		{`padded descriptor serial`, func(di *DeviceInfo) { di.DescriptorSN = ` 24FFFFF  ` }, true},
+		{`space in serial number`, func(di *DeviceInfo) { di.SerialNum = `24F FFF` }, false},
+		{`control character in device serial`, func(di *DeviceInfo) { di.DeviceSN = "24F\x00" }, false},
+		{`missing host name`, func(di *DeviceInfo) { di.HostName = `` }, false},
+		{`uppercase vendor ID`, func(di *DeviceInfo) { di.VendorID = `0A1B` }, false},
+	}
+
+	for _, tt := range tests {
+
+		di := valid()
+		tt.edit(di)
+
+		if err := di.Validate(); tt.ok && err != nil {
+			t.Errorf(`%s: %v`, tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf(`%s: expected error`, tt.name)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`sort`
+	`sync`
+	`time`
+
+	`github.com/jscherff/goutil`
+)
+
+// ledgerFileMode is the permission mode of the allocator state file.
+const ledgerFileMode os.FileMode = 0640
+
+var (
+	// ErrNotFound is returned when a serial number has not been issued.
+	ErrNotFound = errors.New(`serial number not found`)
+
+	// ErrNoRule is returned when no rule applies to a vendor and product.
+	ErrNoRule = errors.New(`no serial number rule for device`)
+)
+
+// Assignment records the issuance of a serial number to a device. A
+// released serial number has a non-zero Released time; when it is
+// reissued, the previous holder is moved to Previous.
+type Assignment struct {
+	Serial		string		`json:"serial_number"`
+	Sequence	string		`json:"sequence"`
+	VendorID	string		`json:"vendor_id"`
+	ProductID	string		`json:"product_id"`
+	HostName	string		`json:"host_name"`
+	Fingerprint	string		`json:"fingerprint"`
+	Issued		time.Time	`json:"issued"`
+	Released	time.Time	`json:"released"`
+	Previous	[]*Assignment	`json:"previous,omitempty"`
+}
+
+// Active reports whether the serial number is currently held by a device.
+func (this *Assignment) Active() (bool) {
+	return this.Released.IsZero()
+}
+
+// Copy returns a deep copy of the assignment.
+func (this *Assignment) Copy() (*Assignment) {
+
+	that := *this
+	that.Previous = nil
+
+	for _, prev := range this.Previous {
+		that.Previous = append(that.Previous, prev.Copy())
+	}
+
+	return &that
+}
+
+// ledger is the persistent state of an Allocator.
+type ledger struct {
+	Sequences	map[string]int64	`json:"sequences"`
+	Assignments	map[string]*Assignment	`json:"assignments"`
+}
+
+// Allocator issues unique serial numbers from sequences selected by
+// vendor and product ID, and records which host and device received each.
+// State is saved to a file before every change takes effect, so that a
+// central service never hands out the same serial number twice, even if
+// the save fails.
+type Allocator struct {
+	Rules		[]*Rule
+	File		string
+
+	mu		sync.Mutex
+	ledger		*ledger
+	active		map[string]string
+}
+
+// NewAllocator instantiates an Allocator with a list of rules, restoring
+// its state from a file if the file exists. An empty file name keeps the
+// state in memory only.
+func NewAllocator(fn string, rules []*Rule) (*Allocator, error) {
+
+	for _, r := range rules {
+		if err := r.Verify(); err != nil {
+			return nil, err
+		}
+	}
+
+	this := &Allocator{
+		Rules:	rules,
+		File:	fn,
+		ledger:	&ledger{
+			Sequences:	make(map[string]int64),
+			Assignments:	make(map[string]*Assignment),
+		},
+		active:	make(map[string]string),
+	}
+
+	if fn == `` {
+		return this, nil
+	}
+
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		return this, nil
+	}
+
+	if err := goutil.RestoreObject(fn, this.ledger); err != nil {
+		return nil, err
+	}
+
+	for _, a := range this.ledger.Assignments {
+		this.index(a)
+	}
+
+	return this, nil
+}
+
+// Rule returns the first rule that applies to a vendor and product ID.
+func (this *Allocator) Rule(vid, pid string) (*Rule, error) {
+
+	for _, r := range this.Rules {
+		if r.Match(vid, pid) {
+			return r, nil
+		}
+	}
+
+	return nil, ErrNoRule
+}
+
+// Issue assigns the next serial number in the device's sequence to the
+// device with the given fingerprint on the given host. If the device
+// already holds an active serial number from the same sequence, that
+// assignment is returned instead. The returned assignment is a copy.
+func (this *Allocator) Issue(vid, pid, host, fp string) (*Assignment, error) {
+
+	r, err := this.Rule(vid, pid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	seq := r.Name()
+
+	if sn, ok := this.active[activeKey(fp, seq)]; ok && fp != `` {
+		return this.ledger.Assignments[sn].Copy(), nil
+	}
+
+	n, ok := this.ledger.Sequences[seq]
+
+	if !ok || n < r.Format.Start {
+		n = r.Format.Start
+	}
+
+	for {
+
+		sn, err := r.Format.Render(n)
+
+		if err != nil {
+			return nil, fmt.Errorf(`sequence %q: %v`, seq, err)
+		}
+
+		n++
+
+		if _, taken := this.ledger.Assignments[sn]; taken {
+			continue
+		}
+
+		a := &Assignment{
+			Serial:		sn,
+			Sequence:	seq,
+			VendorID:	vid,
+			ProductID:	pid,
+			HostName:	host,
+			Fingerprint:	fp,
+			Issued:		time.Now(),
+		}
+
+		if err := this.commit(seq, n, a); err != nil {
+			return nil, err
+		}
+
+		return a.Copy(), nil
+	}
+}
+
+// IssueSN issues a serial number and returns it as a string. It allows
+// an Allocator to be used directly by device drivers.
+func (this *Allocator) IssueSN(vid, pid, host, fp string) (string, error) {
+
+	if a, err := this.Issue(vid, pid, host, fp); err != nil {
+		return ``, err
+	} else {
+		return a.Serial, nil
+	}
+}
+
+// Claim records a serial number that was assigned outside the allocator,
+// such as one already written to a device, so that it is never issued
+// again. Claiming a serial number already held by another device fails.
+func (this *Allocator) Claim(sn, vid, pid, host, fp string) (*Assignment, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if a, ok := this.ledger.Assignments[sn]; ok {
+		if a.Active() && a.Fingerprint != fp {
+			return nil, fmt.Errorf(`serial number %q held by device %q`, sn, a.Fingerprint)
+		}
+		if a.Active() {
+			return a.Copy(), nil
+		}
+	}
+
+	seq := ``
+
+	if r, err := this.Rule(vid, pid); err == nil && r.Format.Check(sn) == nil {
+		seq = r.Name()
+	}
+
+	return this.assign(sn, seq, vid, pid, host, fp)
+}
+
+// Release returns a serial number to the allocator. It remains recorded
+// and is not issued again unless explicitly reissued.
+func (this *Allocator) Release(sn string) (error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	a, ok := this.ledger.Assignments[sn]
+
+	if !ok {
+		return ErrNotFound
+	}
+	if !a.Active() {
+		return fmt.Errorf(`serial number %q already released`, sn)
+	}
+
+	rel := a.Copy()
+	rel.Released = time.Now()
+
+	return this.commit(``, 0, rel)
+}
+
+// Reissue assigns a released serial number to a device, keeping a record
+// of its previous holders.
+func (this *Allocator) Reissue(sn, host, fp string) (*Assignment, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	a, ok := this.ledger.Assignments[sn]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if a.Active() {
+		return nil, fmt.Errorf(`serial number %q held by device %q`, sn, a.Fingerprint)
+	}
+
+	return this.assign(sn, a.Sequence, a.VendorID, a.ProductID, host, fp)
+}
+
+// Lookup returns the assignment of a serial number.
+func (this *Allocator) Lookup(sn string) (*Assignment, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if a, ok := this.ledger.Assignments[sn]; ok {
+		return a.Copy(), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// Assignments returns a copy of every assignment, ordered by serial
+// number.
+func (this *Allocator) Assignments() (as []*Assignment) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, a := range this.ledger.Assignments {
+		as = append(as, a.Copy())
+	}
+
+	sort.Slice(as, func(i, j int) bool {
+		return as[i].Serial < as[j].Serial
+	})
+
+	return as
+}
+
+// assign records a serial number as held by a device, moving any previous
+// holder to the assignment history. The caller must hold the lock.
+func (this *Allocator) assign(sn, seq, vid, pid, host, fp string) (*Assignment, error) {
+
+	a := &Assignment{
+		Serial:		sn,
+		Sequence:	seq,
+		VendorID:	vid,
+		ProductID:	pid,
+		HostName:	host,
+		Fingerprint:	fp,
+		Issued:		time.Now(),
+	}
+
+	if prev, ok := this.ledger.Assignments[sn]; ok {
+
+		held := prev.Copy()
+		a.Previous, held.Previous = held.Previous, nil
+		a.Previous = append(a.Previous, held)
+	}
+
+	if err := this.commit(``, 0, a); err != nil {
+		return nil, err
+	}
+
+	return a.Copy(), nil
+}
+
+// commit records an assignment and, if seq is not empty, the next value
+// of a sequence. The resulting state is saved before it replaces the
+// current state, so a failed save leaves the allocator unchanged. The
+// caller must hold the lock.
+func (this *Allocator) commit(seq string, next int64, a *Assignment) (error) {
+
+	l := this.ledger
+
+	if this.File != `` {
+
+		l = &ledger{
+			Sequences:	make(map[string]int64, len(this.ledger.Sequences) + 1),
+			Assignments:	make(map[string]*Assignment, len(this.ledger.Assignments) + 1),
+		}
+
+		for k, v := range this.ledger.Sequences {
+			l.Sequences[k] = v
+		}
+		for k, v := range this.ledger.Assignments {
+			l.Assignments[k] = v
+		}
+	}
+
+	if seq != `` {
+		l.Sequences[seq] = next
+	}
+
+	prev := l.Assignments[a.Serial]
+	l.Assignments[a.Serial] = a
+
+	if err := this.save(l); err != nil {
+		return err
+	}
+
+	if prev != nil && this.active[activeKey(prev.Fingerprint, prev.Sequence)] == prev.Serial {
+		delete(this.active, activeKey(prev.Fingerprint, prev.Sequence))
+	}
+
+	this.ledger = l
+	this.index(a)
+
+	return nil
+}
+
+// index records an active assignment in the index of active serial
+// numbers by device and sequence.
+func (this *Allocator) index(a *Assignment) {
+
+	if a.Active() && a.Fingerprint != `` {
+		this.active[activeKey(a.Fingerprint, a.Sequence)] = a.Serial
+	}
+}
+
+// activeKey returns the index key of a device's assignment from a sequence.
+func activeKey(fp, seq string) (string) {
+	return fp + "\x00" + seq
+}
+
+// save writes allocator state to the allocator's file, if any, through a
+// synced temporary file that is renamed over it, so that the file always
+// holds either the old or the new state.
+func (this *Allocator) save(l *ledger) (error) {
+
+	if this.File == `` {
+		return nil
+	}
+
+	j, err := json.MarshalIndent(l, ``, "\t")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(this.File), `.tmp-`)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(j); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), ledgerFileMode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), this.File)
+}
@@ -0,0 +1,489 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	`bytes`
+	`encoding/csv`
+	`sort`
+	`strings`
+	`time`
+
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+const (
+	FindingDuplicate	string	= `duplicate_serial`
+	FindingFactory		string	= `factory_collision`
+	FindingMissing		string	= `missing_serial`
+
+	ActionKeep		string	= `keep`
+	ActionSetDefault	string	= `set_default_sn`
+	ActionIssue		string	= `issue_sn`
+	ActionRetire		string	= `retire_record`
+	ActionInspect		string	= `inspect`
+)
+
+// Capability describes the serial number support of a device object type.
+// A Serializer has a configurable device serial number; DefaultLength is
+// the number of leading factory serial number characters SetDefaultSN
+// copies to it, or zero if it cannot.
+type Capability struct {
+	Serializer	bool	`json:"serializer"`
+	DefaultLength	int	`json:"default_length"`
+}
+
+// DefaultCapabilities returns the capabilities of the device types in
+// ci/peripheral/usb, keyed by object type.
+func DefaultCapabilities() (map[string]*Capability) {
+
+	return map[string]*Capability{
+		`*usb.Magtek`:	&Capability{Serializer: true, DefaultLength: 7},
+		`*usb.IDTech`:	&Capability{Serializer: true},
+	}
+}
+
+// Device is a device record in a finding with the action suggested for it.
+type Device struct {
+	Fingerprint	string		`json:"fingerprint"`
+	HostName	string		`json:"host_name"`
+	VendorID	string		`json:"vendor_id"`
+	ProductID	string		`json:"product_id"`
+	ObjectType	string		`json:"object_type"`
+	SerialNum	string		`json:"serial_number"`
+	DeviceSN	string		`json:"device_sn"`
+	FactorySN	string		`json:"factory_sn"`
+	FirstSeen	time.Time	`json:"first_seen"`
+	Action		string		`json:"action"`
+	NewSerial	string		`json:"new_serial,omitempty"`
+	Note		string		`json:"note,omitempty"`
+}
+
+// Finding is a serial number problem shared by one or more devices.
+type Finding struct {
+	Kind		string		`json:"kind"`
+	Serial		string		`json:"serial_number,omitempty"`
+	Hosts		[]string	`json:"hosts"`
+	Devices		[]*Device	`json:"devices"`
+}
+
+// Report is the result of a fleet-wide serial number analysis.
+type Report struct {
+	Generated	time.Time	`json:"generated"`
+	Records		int		`json:"records"`
+	Findings	[]*Finding	`json:"findings"`
+}
+
+// Analyzer finds serial numbers shared by different devices, factory
+// serial numbers shared by different records and serializable devices
+// without a serial number, and suggests how to correct each device.
+type Analyzer struct {
+	Capabilities	map[string]*Capability
+	Filter		*usb.Filter
+}
+
+// NewAnalyzer instantiates an Analyzer for the device types in
+// ci/peripheral/usb.
+func NewAnalyzer() (*Analyzer) {
+	return &Analyzer{Capabilities: DefaultCapabilities()}
+}
+
+// Analyze analyzes the records in a store that match the filter. The
+// first stored revision of a device is used as the time it was first
+// seen.
+func (this *Analyzer) Analyze(s usb.Store) (*Report, error) {
+
+	dis, err := s.List(this.Filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return this.AnalyzeRecords(dis, func(fp string) (time.Time) {
+
+		if revs, err := s.History(fp); err != nil || len(revs) == 0 {
+			return time.Time{}
+		} else {
+			return revs[0].Stored
+		}
+
+	}), nil
+}
+
+// AnalyzeRecords analyzes a set of device records. The firstSeen
+// function, which may be nil, returns the time a device was first seen;
+// when devices share a serial number, the device that first had it keeps
+// it unless another device's factory serial number yields it. Records of
+// one device on one host that share a factory serial number are taken to
+// be superseded by the latest one and are not checked for duplicate or
+// missing serial numbers.
+func (this *Analyzer) AnalyzeRecords(dis []*usb.DeviceInfo, firstSeen func(string) (time.Time)) (*Report) {
+
+	report := &Report{Generated: time.Now(), Records: len(dis), Findings: []*Finding{}}
+
+	seen := make(map[string]time.Time)
+
+	first := func(fp string) (time.Time) {
+
+		if firstSeen == nil {
+			return time.Time{}
+		}
+		if t, ok := seen[fp]; ok {
+			return t
+		}
+
+		seen[fp] = firstSeen(fp)
+
+		return seen[fp]
+	}
+
+	serials := make(map[string][]*usb.DeviceInfo)
+	factory := make(map[string][]*usb.DeviceInfo)
+	claimed := make(map[string]string)
+	superseded := make(map[string]bool)
+	var missing []*usb.DeviceInfo
+
+	for _, di := range dis {
+		if di.FactorySN != `` {
+			key := di.VendorID + `:` + di.ProductID + `:` + di.FactorySN
+			factory[key] = append(factory[key], di)
+		}
+	}
+
+	var collisions []*Finding
+
+	for _, key := range sortedKeys(factory) {
+
+		group := factory[key]
+
+		if distinct(group) < 2 {
+			continue
+		}
+
+		f := &Finding{Kind: FindingFactory, Serial: group[0].FactorySN}
+		sameHost := len(hosts(group)) == 1
+
+		for _, di := range group {
+			f.Devices = append(f.Devices, this.device(di, first))
+		}
+
+		sortByFirstSeen(f.Devices)
+
+		for i, d := range f.Devices {
+			switch {
+			case !sameHost:
+				d.Action, d.Note = ActionInspect, `factory serial number on several hosts; possible cloned or counterfeit hardware`
+			case i == len(f.Devices) - 1:
+				d.Action, d.Note = ActionKeep, `latest record of the device`
+			default:
+				d.Action, d.Note = ActionRetire, `superseded record of the same device after a firmware or descriptor change`
+				superseded[d.Fingerprint] = true
+			}
+		}
+
+		collisions = append(collisions, f)
+	}
+
+	for _, di := range dis {
+
+		if superseded[di.FP()] {
+			continue
+		}
+
+		for _, sn := range deviceSerials(di) {
+			serials[sn] = append(serials[sn], di)
+		}
+
+		if c := this.capability(di); c.Serializer && strings.TrimSpace(di.DeviceSN) == `` {
+			missing = append(missing, di)
+		}
+	}
+
+	for _, sn := range sortedKeys(serials) {
+
+		group := serials[sn]
+
+		if distinct(group) < 2 {
+			continue
+		}
+
+		f := &Finding{Kind: FindingDuplicate, Serial: sn}
+		keeper := this.keeper(sn, group, first)
+
+		kd := this.device(keeper, first)
+		kd.Action, kd.Note = ActionKeep, `first device with this serial number`
+		f.Devices = append(f.Devices, kd)
+
+		for _, di := range group {
+			if di.FP() != keeper.FP() {
+				d := this.device(di, first)
+				this.remedy(d, di, serials, claimed)
+				f.Devices = append(f.Devices, d)
+			}
+		}
+
+		report.add(f)
+	}
+
+	for _, f := range collisions {
+		report.add(f)
+	}
+
+	for _, di := range missing {
+
+		d := this.device(di, first)
+		this.remedy(d, di, serials, claimed)
+
+		report.add(&Finding{Kind: FindingMissing, Devices: []*Device{d}})
+	}
+
+	return report
+}
+
+// keeper returns the device that keeps a shared serial number: the one
+// whose factory serial number yields it, or the one that was first seen
+// with it, or the one with the lowest fingerprint.
+func (this *Analyzer) keeper(sn string, group []*usb.DeviceInfo, first func(string) (time.Time)) (*usb.DeviceInfo) {
+
+	cands := group
+
+	var own []*usb.DeviceInfo
+
+	for _, di := range group {
+		if this.defaultSN(di) == sn {
+			own = append(own, di)
+		}
+	}
+
+	if len(own) > 0 {
+		cands = own
+	}
+
+	best := cands[0]
+
+	for _, di := range cands[1:] {
+
+		ti, tb := first(di.FP()), first(best.FP())
+
+		switch {
+		case ti.IsZero() && !tb.IsZero():
+		case !ti.IsZero() && (tb.IsZero() || ti.Before(tb)):
+			best = di
+		case ti.Equal(tb) && di.FP() < best.FP():
+			best = di
+		}
+	}
+
+	return best
+}
+
+// remedy suggests how to give a device a unique serial number: copy its
+// factory serial number if the result is neither in use nor suggested for
+// another device, otherwise issue a new serial number. Devices whose
+// serial number cannot be set must be inspected.
+func (this *Analyzer) remedy(d *Device, di *usb.DeviceInfo, serials map[string][]*usb.DeviceInfo, claimed map[string]string) {
+
+	c := this.capability(di)
+
+	if !c.Serializer {
+		d.Action, d.Note = ActionInspect, `serial number is not configurable`
+		return
+	}
+
+	if sn := this.defaultSN(di); sn != `` {
+
+		fp, inUse := claimed[sn]
+		inUse = inUse && fp != di.FP()
+
+		for _, other := range serials[sn] {
+			if other.FP() != di.FP() {
+				inUse = true
+			}
+		}
+
+		if !inUse {
+			claimed[sn] = di.FP()
+			d.Action, d.NewSerial = ActionSetDefault, sn
+			d.Note = `copy the factory serial number with SetDefaultSN`
+			return
+		}
+
+		d.Note = `factory-derived serial number ` + sn + ` is in use; `
+	}
+
+	d.Action = ActionIssue
+	d.Note += `issue a new serial number with IssueDeviceSN`
+}
+
+// defaultSN returns the serial number SetDefaultSN would assign to a
+// device, or an empty string if it cannot assign one.
+func (this *Analyzer) defaultSN(di *usb.DeviceInfo) (string) {
+
+	c := this.capability(di)
+
+	if !c.Serializer || c.DefaultLength < 1 || len(di.FactorySN) < c.DefaultLength {
+		return ``
+	}
+
+	return di.FactorySN[:c.DefaultLength]
+}
+
+// capability returns the capability of a device's object type.
+func (this *Analyzer) capability(di *usb.DeviceInfo) (*Capability) {
+
+	if c, ok := this.Capabilities[di.ObjectType]; ok && c != nil {
+		return c
+	}
+
+	return &Capability{}
+}
+
+// device summarizes a device record.
+func (this *Analyzer) device(di *usb.DeviceInfo, first func(string) (time.Time)) (*Device) {
+
+	return &Device{
+		Fingerprint:	di.FP(),
+		HostName:	di.HostName,
+		VendorID:	di.VendorID,
+		ProductID:	di.ProductID,
+		ObjectType:	di.ObjectType,
+		SerialNum:	di.SerialNum,
+		DeviceSN:	di.DeviceSN,
+		FactorySN:	di.FactorySN,
+		FirstSeen:	first(di.FP()),
+	}
+}
+
+// add adds a finding, collecting the hosts of its devices.
+func (this *Report) add(f *Finding) {
+
+	set := make(map[string]bool)
+
+	for _, d := range f.Devices {
+		if !set[d.HostName] {
+			set[d.HostName] = true
+			f.Hosts = append(f.Hosts, d.HostName)
+		}
+	}
+
+	sort.Strings(f.Hosts)
+
+	this.Findings = append(this.Findings, f)
+}
+
+// Count returns the number of findings of a kind.
+func (this *Report) Count(kind string) (n int) {
+
+	for _, f := range this.Findings {
+		if f.Kind == kind {
+			n++
+		}
+	}
+
+	return n
+}
+
+// CSV reports the findings in CSV format with a header row and one row
+// per device in each finding.
+func (this *Report) CSV() ([]byte, error) {
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+
+	w.Write([]string{
+		`kind`, `serial_number`, `fingerprint`, `host_name`, `vendor_id`,
+		`product_id`, `object_type`, `device_sn`, `factory_sn`,
+		`first_seen`, `action`, `new_serial`, `note`,
+	})
+
+	for _, f := range this.Findings {
+		for _, d := range f.Devices {
+
+			var fs string
+
+			if !d.FirstSeen.IsZero() {
+				fs = d.FirstSeen.Format(time.RFC3339)
+			}
+
+			w.Write([]string{
+				f.Kind, f.Serial, d.Fingerprint, d.HostName, d.VendorID,
+				d.ProductID, d.ObjectType, d.DeviceSN, d.FactorySN,
+				fs, d.Action, d.NewSerial, d.Note,
+			})
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+// deviceSerials returns the distinct non-empty serial numbers of a device.
+func deviceSerials(di *usb.DeviceInfo) (sns []string) {
+
+	for _, sn := range []string{di.SerialNum, di.DeviceSN} {
+		if sn = strings.TrimSpace(sn); sn != `` && (len(sns) == 0 || sns[0] != sn) {
+			sns = append(sns, sn)
+		}
+	}
+
+	return sns
+}
+
+// distinct returns the number of distinct fingerprints in a group.
+func distinct(group []*usb.DeviceInfo) (int) {
+	return len(set(group, func(di *usb.DeviceInfo) (string) { return di.FP() }))
+}
+
+// hosts returns the distinct host names in a group.
+func hosts(group []*usb.DeviceInfo) (map[string]bool) {
+	return set(group, func(di *usb.DeviceInfo) (string) { return di.HostName })
+}
+
+// set returns the distinct values of a field in a group.
+func set(group []*usb.DeviceInfo, field func(*usb.DeviceInfo) (string)) (map[string]bool) {
+
+	m := make(map[string]bool)
+
+	for _, di := range group {
+		m[field(di)] = true
+	}
+
+	return m
+}
+
+// sortByFirstSeen orders devices by the time they were first seen, then
+// by fingerprint.
+func sortByFirstSeen(ds []*Device) {
+
+	sort.SliceStable(ds, func(i, j int) (bool) {
+		if !ds[i].FirstSeen.Equal(ds[j].FirstSeen) {
+			return ds[i].FirstSeen.Before(ds[j].FirstSeen)
+		}
+		return ds[i].Fingerprint < ds[j].Fingerprint
+	})
+}
+
+// sortedKeys returns the keys of a map in order.
+func sortedKeys(m map[string][]*usb.DeviceInfo) (keys []string) {
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
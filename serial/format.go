@@ -0,0 +1,221 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`path`
+	`strconv`
+	`strings`
+)
+
+// Format describes how a sequence number is rendered as a serial number:
+// a prefix followed by the number zero-padded to a width and, optionally,
+// a Luhn check digit. A Width of zero means no padding and no upper bound.
+type Format struct {
+	Prefix		string	`json:"prefix"`
+	Width		int	`json:"width"`
+	Start		int64	`json:"start"`
+	CheckDigit	bool	`json:"check_digit"`
+	MaxLength	int	`json:"max_length,omitempty"`
+}
+
+// Render returns the serial number for a sequence number.
+func (this *Format) Render(n int64) (string, error) {
+
+	if n < 0 {
+		return ``, fmt.Errorf(`negative sequence number %d`, n)
+	}
+
+	digits := strconv.FormatInt(n, 10)
+
+	if this.Width > 0 {
+		if len(digits) > this.Width {
+			return ``, fmt.Errorf(`sequence number %d exceeds width %d`, n, this.Width)
+		}
+		digits = strings.Repeat(`0`, this.Width - len(digits)) + digits
+	}
+
+	if this.CheckDigit {
+		digits += string(luhn(digits))
+	}
+
+	sn := this.Prefix + digits
+
+	if this.MaxLength > 0 && len(sn) > this.MaxLength {
+		return ``, fmt.Errorf(`serial number %q exceeds maximum length %d`, sn, this.MaxLength)
+	}
+
+	return sn, nil
+}
+
+// Check reports whether a serial number conforms to the format, including
+// its check digit.
+func (this *Format) Check(sn string) (error) {
+
+	if !strings.HasPrefix(sn, this.Prefix) {
+		return fmt.Errorf(`serial number %q lacks prefix %q`, sn, this.Prefix)
+	}
+
+	digits := strings.TrimPrefix(sn, this.Prefix)
+
+	if this.CheckDigit {
+		if len(digits) < 2 {
+			return fmt.Errorf(`serial number %q too short`, sn)
+		}
+		cd := digits[len(digits)-1]
+		digits = digits[:len(digits)-1]
+		if !isDigits(digits) || luhn(digits) != cd {
+			return fmt.Errorf(`serial number %q has invalid check digit`, sn)
+		}
+	}
+
+	if !isDigits(digits) {
+		return fmt.Errorf(`serial number %q has non-numeric sequence`, sn)
+	}
+	if this.Width > 0 && len(digits) != this.Width {
+		return fmt.Errorf(`serial number %q sequence not %d digits`, sn, this.Width)
+	}
+
+	return nil
+}
+
+// Verify checks the format for invalid settings.
+func (this *Format) Verify() (error) {
+
+	if this.Width < 0 {
+		return fmt.Errorf(`invalid width %d`, this.Width)
+	}
+	if this.Start < 0 {
+		return fmt.Errorf(`invalid start %d`, this.Start)
+	}
+	if this.MaxLength < 0 {
+		return fmt.Errorf(`invalid maximum length %d`, this.MaxLength)
+	}
+
+	return nil
+}
+
+// Rule selects the sequence and format used for devices whose vendor and
+// product IDs match its glob patterns. Sequence names the counter shared
+// by every rule that refers to it and defaults to the format prefix.
+type Rule struct {
+	VendorID	string	`json:"vendor_id"`
+	ProductID	string	`json:"product_id"`
+	Sequence	string	`json:"sequence"`
+	Format		*Format	`json:"format"`
+}
+
+// Match reports whether the rule applies to a vendor and product ID. An
+// empty pattern matches any value.
+func (this *Rule) Match(vid, pid string) (bool) {
+	return globMatch(this.VendorID, vid) && globMatch(this.ProductID, pid)
+}
+
+// Name returns the name of the rule's sequence.
+func (this *Rule) Name() (string) {
+
+	if this.Sequence != `` {
+		return this.Sequence
+	}
+
+	return this.Format.Prefix
+}
+
+// Verify checks the rule for invalid settings.
+func (this *Rule) Verify() (error) {
+
+	for _, p := range []string{this.VendorID, this.ProductID} {
+		if _, err := path.Match(p, ``); err != nil {
+			return fmt.Errorf(`invalid pattern %q: %v`, p, err)
+		}
+	}
+
+	if this.Format == nil {
+		return fmt.Errorf(`rule for %s:%s has no format`, this.VendorID, this.ProductID)
+	}
+
+	return this.Format.Verify()
+}
+
+// LoadRules reads a list of rules from a JSON file.
+func LoadRules(fn string) (rules []*Rule, err error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(j, &rules); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		if err := r.Verify(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// luhn returns the Luhn check digit for a string of decimal digits.
+func luhn(digits string) (byte) {
+
+	sum := 0
+
+	for i, double := len(digits) - 1, true; i >= 0; i, double = i - 1, !double {
+
+		d := int(digits[i] - '0')
+
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+	}
+
+	return byte('0' + (10 - sum % 10) % 10)
+}
+
+// isDigits reports whether a string consists only of decimal digits.
+func isDigits(s string) (bool) {
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// globMatch reports whether a string matches a glob pattern. An empty
+// pattern matches everything.
+func globMatch(pattern, s string) (bool) {
+
+	if pattern == `` {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, s)
+
+	return ok
+}
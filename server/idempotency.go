@@ -0,0 +1,255 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`bytes`
+	`container/list`
+	`net/http`
+	`sync`
+	`time`
+
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/store`
+)
+
+const (
+	IdempotencyHeader	string		= `Idempotency-Key`
+
+	// DefaultIdempotencyTTL bounds how long responses are remembered.
+	// A request replayed later is applied again, so clients must not
+	// replay older requests; the agent's spool expires them first.
+	DefaultIdempotencyTTL	time.Duration	= 24 * time.Hour
+	DefaultIdempotencyLease	time.Duration	= 5 * time.Minute
+	DefaultIdempotencySize	int		= 100000
+)
+
+// idempotent wraps a handler so that POST and PUT requests with an
+// idempotency key are applied at most once. Keys are scoped to the
+// authenticated host, or to unauthenticated requests. A request that
+// reuses a key for a different method or path fails with 422
+// Unprocessable Entity, and one that arrives while the original is in
+// progress fails with 409 Conflict. Server errors are not recorded, so
+// such requests may be retried.
+func (this *Server) idempotent(h http.Handler) (http.Handler) {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get(IdempotencyHeader)
+
+		if key == `` || this.Idempotency == nil ||
+			(r.Method != http.MethodPost && r.Method != http.MethodPut) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		scope := ``
+
+		if p := auth.FromContext(r.Context()); p != nil {
+			scope = p.Host
+		}
+
+		req := r.Method + ` ` + r.URL.Path
+		ir, ok, err := this.Idempotency.ReserveKey(scope, key, req, this.IdempotencyTTL, this.IdempotencyLease)
+
+		switch {
+
+		case err != nil:
+			this.error(w, http.StatusInternalServerError, err)
+			return
+
+		case ok:
+
+		case ir.Request != req:
+			writeError(w, http.StatusUnprocessableEntity, `idempotency key reused for a different request`)
+			return
+
+		case !ir.Done():
+			w.Header().Set(`Retry-After`, `1`)
+			writeError(w, http.StatusConflict, `request with this idempotency key in progress`)
+			return
+
+		default:
+			for k, v := range ir.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(`Idempotent-Replayed`, `true`)
+			w.WriteHeader(ir.Code)
+			w.Write(ir.Body)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		if rec.code >= http.StatusInternalServerError {
+			err = this.Idempotency.ReleaseKey(scope, key)
+		} else {
+			err = this.Idempotency.RecordResponse(scope, key, &store.IdempotentResponse{
+				Request:	req,
+				Code:		rec.code,
+				Header:		rec.Header().Clone(),
+				Body:		rec.body.Bytes(),
+				Stored:		time.Now(),
+			})
+		}
+
+		if err != nil && this.Log != nil {
+			this.Log.Printf(`idempotency key %q: %v`, key, err)
+		}
+	})
+}
+
+// replayScope is the idempotency scope of accepted request signatures. It
+// cannot be a host name.
+const replayScope = `#signatures`
+
+// replayCache is an auth.ReplayCache that records accepted signatures in
+// a server's idempotency store as reservations that are never completed,
+// so each expires once its lease, the signature's window, has passed.
+type replayCache struct {
+	srv		*Server
+}
+
+// Remember implements auth.ReplayCache.
+func (this *replayCache) Remember(sig string, window time.Duration) (bool, error) {
+
+	ttl := this.srv.IdempotencyTTL
+
+	if ttl < window {
+		ttl = window
+	}
+
+	_, ok, err := this.srv.Idempotency.ReserveKey(replayScope, sig, `signature`, ttl, window)
+
+	return ok, err
+}
+
+// IdempotencyCache is an in-memory store.IdempotencyStore for stores that
+// do not persist idempotency keys. Its entries do not survive a restart.
+// The least recently stored entries are evicted beyond a size limit.
+type IdempotencyCache struct {
+	Size		int
+
+	mu		sync.Mutex
+	entries		map[string]*list.Element
+	order		*list.List
+}
+
+// cacheEntry is a response recorded in an IdempotencyCache.
+type cacheEntry struct {
+	id		string
+	resp		store.IdempotentResponse
+}
+
+// NewIdempotencyCache instantiates an IdempotencyCache with a maximum
+// number of entries.
+func NewIdempotencyCache(size int) (*IdempotencyCache) {
+
+	return &IdempotencyCache{
+		Size:		size,
+		entries:	make(map[string]*list.Element),
+		order:		list.New(),
+	}
+}
+
+// ReserveKey implements store.IdempotencyStore.
+func (this *IdempotencyCache) ReserveKey(scope, key, request string, ttl, lease time.Duration) (*store.IdempotentResponse, bool, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	id, now := cacheID(scope, key), time.Now()
+
+	if el, ok := this.entries[id]; ok {
+
+		ce := el.Value.(*cacheEntry)
+
+		if !ce.resp.Expired(now, ttl, lease) {
+			resp := ce.resp
+			return &resp, false, nil
+		}
+
+		this.order.Remove(el)
+		delete(this.entries, id)
+	}
+
+	ce := &cacheEntry{id: id, resp: store.IdempotentResponse{Request: request, Stored: now}}
+	this.entries[id] = this.order.PushBack(ce)
+
+	for this.Size > 0 && this.order.Len() > this.Size {
+		el := this.order.Front()
+		this.order.Remove(el)
+		delete(this.entries, el.Value.(*cacheEntry).id)
+	}
+
+	resp := ce.resp
+
+	return &resp, true, nil
+}
+
+// RecordResponse implements store.IdempotencyStore.
+func (this *IdempotencyCache) RecordResponse(scope, key string, resp *store.IdempotentResponse) (error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if el, ok := this.entries[cacheID(scope, key)]; ok {
+		el.Value.(*cacheEntry).resp = *resp
+	}
+
+	return nil
+}
+
+// ReleaseKey implements store.IdempotencyStore.
+func (this *IdempotencyCache) ReleaseKey(scope, key string) (error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	id := cacheID(scope, key)
+
+	if el, ok := this.entries[id]; ok {
+		this.order.Remove(el)
+		delete(this.entries, id)
+	}
+
+	return nil
+}
+
+// cacheID combines a scope and key into an IdempotencyCache entry ID.
+func cacheID(scope, key string) (string) {
+	return scope + "\x00" + key
+}
+
+// recorder captures the status code and body of a response while passing
+// them through.
+type recorder struct {
+	http.ResponseWriter
+	code		int
+	body		bytes.Buffer
+}
+
+// WriteHeader records and writes the status code.
+func (this *recorder) WriteHeader(code int) {
+	this.code = code
+	this.ResponseWriter.WriteHeader(code)
+}
+
+// Write records and writes body data.
+func (this *recorder) Write(b []byte) (int, error) {
+	this.body.Write(b)
+	return this.ResponseWriter.Write(b)
+}
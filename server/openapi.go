@@ -0,0 +1,527 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// OpenAPI is the OpenAPI 3.0 description of the CMDB REST API, served at
+// /v1/openapi.yaml.
+const OpenAPI = `openapi: 3.0.3
+info:
+  title: CMDB API
+  description: Device checkin, audit and serial number issuance for CMDB agents.
+  version: 1.0.0
+  license:
+    name: Apache 2.0
+    url: http://www.apache.org/licenses/LICENSE-2.0
+servers:
+  - url: /v1
+security:
+  - Signature: []
+  - ClientCertificate: []
+paths:
+  /checkin:
+    post:
+      summary: Check in a device
+      description: Validates a device record and stores it as the device's
+        last-known record, adding a revision to its history. The
+        fingerprint is derived from the record; a client-supplied
+        fingerprint must match it. An authenticated host may not replace
+        a record stored by another host.
+      operationId: checkin
+      parameters:
+        - $ref: '#/components/parameters/IdempotencyKey'
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/DeviceInfo'
+      responses:
+        '201':
+          description: Device record stored.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/CheckinResponse'
+        '400':
+          $ref: '#/components/responses/BadRequest'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '403':
+          $ref: '#/components/responses/Forbidden'
+        '422':
+          $ref: '#/components/responses/Invalid'
+  /devices:
+    get:
+      summary: Query inventory
+      description: Lists last-known device records. Each parameter is a glob
+        pattern; omitted parameters match every record.
+      operationId: listDevices
+      parameters:
+        - {name: host_name, in: query, schema: {type: string}}
+        - {name: vendor_id, in: query, schema: {type: string}}
+        - {name: product_id, in: query, schema: {type: string}}
+        - {name: serial_number, in: query, schema: {type: string}}
+        - {name: object_type, in: query, schema: {type: string}}
+      responses:
+        '200':
+          description: Matching device records, ordered by fingerprint.
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: '#/components/schemas/DeviceInfo'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+  /devices/{fingerprint}:
+    parameters:
+      - $ref: '#/components/parameters/Fingerprint'
+    get:
+      summary: Fetch a device's last-known record
+      description: Returns the record suitable for DeviceInfo.AuditJSON.
+      operationId: getDevice
+      responses:
+        '200':
+          description: Last-known device record.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/DeviceInfo'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '404':
+          $ref: '#/components/responses/NotFound'
+  /devices/{fingerprint}/history:
+    parameters:
+      - $ref: '#/components/parameters/Fingerprint'
+    get:
+      summary: Fetch stored revisions of a device record
+      operationId: getHistory
+      responses:
+        '200':
+          description: Revisions, oldest first.
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: '#/components/schemas/Revision'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '404':
+          $ref: '#/components/responses/NotFound'
+  /devices/{fingerprint}/changes:
+    parameters:
+      - $ref: '#/components/parameters/Fingerprint'
+    get:
+      summary: Fetch recorded audit changes
+      operationId: getChanges
+      parameters:
+        - name: since
+          in: query
+          description: Return changes detected at or after this time.
+          schema: {type: string, format: date-time}
+      responses:
+        '200':
+          description: Change records, oldest first.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Changes'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '501':
+          $ref: '#/components/responses/NotImplemented'
+    post:
+      summary: Post an audit change set
+      operationId: postChanges
+      parameters:
+        - $ref: '#/components/parameters/IdempotencyKey'
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/Changes'
+      responses:
+        '201':
+          description: Change records stored.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Changes'
+        '400':
+          $ref: '#/components/responses/BadRequest'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '403':
+          $ref: '#/components/responses/Forbidden'
+        '404':
+          $ref: '#/components/responses/NotFound'
+        '501':
+          $ref: '#/components/responses/NotImplemented'
+  /serials:
+    post:
+      summary: Request a new serial number
+      description: Issues the next serial number in the sequence configured
+        for the vendor and product. A device that already holds an active
+        serial number from that sequence receives it again.
+      operationId: requestSerial
+      parameters:
+        - $ref: '#/components/parameters/IdempotencyKey'
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/SerialRequest'
+      responses:
+        '201':
+          description: Serial number issued.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Assignment'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '403':
+          $ref: '#/components/responses/Forbidden'
+        '422':
+          $ref: '#/components/responses/Invalid'
+        '501':
+          $ref: '#/components/responses/NotImplemented'
+  /serials/{serial_number}:
+    parameters:
+      - name: serial_number
+        in: path
+        required: true
+        schema: {type: string}
+    get:
+      summary: Fetch a serial number assignment
+      operationId: getSerial
+      responses:
+        '200':
+          description: Serial number assignment.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Assignment'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '404':
+          $ref: '#/components/responses/NotFound'
+    put:
+      summary: Claim a serial number
+      description: Records a serial number assigned by an agent, such as one
+        copied from the factory serial number while the server was
+        unreachable, so that it is never issued to another device.
+      operationId: claimSerial
+      parameters:
+        - $ref: '#/components/parameters/IdempotencyKey'
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/SerialRequest'
+      responses:
+        '200':
+          description: Serial number recorded.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Assignment'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '403':
+          $ref: '#/components/responses/Forbidden'
+        '409':
+          $ref: '#/components/responses/Conflict'
+        '501':
+          $ref: '#/components/responses/NotImplemented'
+  /reports/serials:
+    get:
+      summary: Report duplicate and missing serial numbers
+      description: Analyzes every stored record for serial numbers shared by
+        different devices, factory serial numbers shared by different
+        records and serializable devices without a serial number, with the
+        action suggested for each device. When devices share a serial
+        number, the one whose factory serial number yields it, or else the
+        one first seen, keeps it.
+      operationId: serialReport
+      parameters:
+        - {name: vendor_id, in: query, schema: {type: string}}
+        - {name: product_id, in: query, schema: {type: string}}
+        - {name: object_type, in: query, schema: {type: string}}
+        - {name: format, in: query, schema: {type: string, enum: [json, csv], default: json}}
+      responses:
+        '200':
+          description: Serial number report.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/SerialReport'
+            text/csv:
+              schema: {type: string}
+        '400':
+          $ref: '#/components/responses/BadRequest'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+  /keys:
+    post:
+      summary: Enroll or rotate an agent key
+      description: Enrolls the verification key of an agent for its host.
+        A request signed with the host's active key rotates it; the old key
+        keeps verifying for a grace period so spooled requests can still be
+        delivered. The first key of a host is enrolled with a client
+        certificate for the host or with the enrollment token.
+      operationId: enrollKey
+      security:
+        - {}
+        - Signature: []
+        - ClientCertificate: []
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/EnrollRequest'
+      responses:
+        '201':
+          description: Key enrolled.
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Key'
+        '400':
+          $ref: '#/components/responses/BadRequest'
+        '401':
+          $ref: '#/components/responses/Unauthorized'
+        '403':
+          $ref: '#/components/responses/Forbidden'
+        '409':
+          $ref: '#/components/responses/Conflict'
+        '422':
+          $ref: '#/components/responses/Invalid'
+        '501':
+          $ref: '#/components/responses/NotImplemented'
+components:
+  securitySchemes:
+    Signature:
+      type: apiKey
+      in: header
+      name: X-Cmdb-Signature
+      description: Base64 Ed25519 or HMAC-SHA256 signature, by the key named
+        in X-Cmdb-Key-Id and enrolled for the host in X-Cmdb-Host, of the
+        newline-joined lines 'cmdb-sig-v1', method, request URI, host, key
+        ID, X-Cmdb-Timestamp (Unix seconds), Idempotency-Key and the hex
+        SHA-256 digest of the body as sent. Signatures are accepted once,
+        within five minutes of the server's clock.
+    ClientCertificate:
+      type: mutualTLS
+      description: Client certificate naming the host in its first DNS name
+        or its common name.
+  parameters:
+    IdempotencyKey:
+      name: Idempotency-Key
+      in: header
+      description: Unique key for the request. A repeated POST or PUT with
+        the same key returns the original response, marked with the
+        Idempotent-Replayed header, instead of being applied again.
+      schema: {type: string}
+    Fingerprint:
+      name: fingerprint
+      in: path
+      required: true
+      schema: {type: string, pattern: '^[A-Za-z0-9._-]+$'}
+  responses:
+    BadRequest:
+      description: Malformed request body.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+    Invalid:
+      description: Request failed validation.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+    NotFound:
+      description: No such record.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+    Conflict:
+      description: The request conflicts with the current state, or a
+        request with the same idempotency key is in progress.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+    Unauthorized:
+      description: The request signature is invalid, stale or replayed, or
+        the request is not authenticated. Requests must be authenticated
+        unless the server allows anonymous requests.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+    Forbidden:
+      description: The authenticated host may not submit data for the host
+        named in the request.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+    NotImplemented:
+      description: The server is not configured for this operation.
+      content:
+        application/json:
+          schema: {$ref: '#/components/schemas/Error'}
+  schemas:
+    DeviceInfo:
+      type: object
+      required: [host_name, vendor_id, product_id, object_type]
+      properties:
+        host_name: {type: string}
+        vendor_id: {type: string, pattern: '^[0-9a-f]{4}$'}
+        product_id: {type: string, pattern: '^[0-9a-f]{4}$'}
+        serial_number: {type: string}
+        vendor_name: {type: string}
+        product_name: {type: string}
+        product_ver: {type: string}
+        firmware_ver: {type: string}
+        software_id: {type: string}
+        port_number: {type: integer}
+        bus_number: {type: integer}
+        bus_address: {type: integer}
+        buffer_size: {type: integer}
+        max_pkt_size: {type: integer}
+        usb_spec: {type: string}
+        usb_class: {type: string}
+        usb_subclass: {type: string}
+        usb_protocol: {type: string}
+        device_speed: {type: string}
+        device_ver: {type: string}
+        object_type: {type: string}
+        device_sn: {type: string}
+        factory_sn: {type: string}
+        descriptor_sn: {type: string}
+        fingerprint: {type: string}
+      additionalProperties: {type: string}
+    CheckinResponse:
+      type: object
+      properties:
+        fingerprint: {type: string}
+        stored: {type: string, format: date-time}
+    Revision:
+      type: object
+      properties:
+        stored: {type: string, format: date-time}
+        device: {$ref: '#/components/schemas/DeviceInfo'}
+    Change:
+      type: object
+      properties:
+        field: {type: string}
+        old_value: {type: string}
+        new_value: {type: string}
+        detected_at: {type: string, format: date-time}
+        source: {type: string}
+        collector: {type: string}
+        severity: {type: string, enum: [ignore, info, warn, alert]}
+    Changes:
+      type: array
+      items: {$ref: '#/components/schemas/Change'}
+    SerialRequest:
+      type: object
+      required: [vendor_id, product_id]
+      properties:
+        vendor_id: {type: string}
+        product_id: {type: string}
+        host_name: {type: string}
+        fingerprint: {type: string}
+    Assignment:
+      type: object
+      properties:
+        serial_number: {type: string}
+        sequence: {type: string}
+        vendor_id: {type: string}
+        product_id: {type: string}
+        host_name: {type: string}
+        fingerprint: {type: string}
+        issued: {type: string, format: date-time}
+        released: {type: string, format: date-time}
+        previous:
+          type: array
+          items: {$ref: '#/components/schemas/Assignment'}
+    SerialReport:
+      type: object
+      properties:
+        generated: {type: string, format: date-time}
+        records: {type: integer}
+        findings:
+          type: array
+          items:
+            type: object
+            properties:
+              kind: {type: string, enum: [duplicate_serial, factory_collision, missing_serial]}
+              serial_number: {type: string}
+              hosts:
+                type: array
+                items: {type: string}
+              devices:
+                type: array
+                items: {$ref: '#/components/schemas/ReportDevice'}
+    ReportDevice:
+      type: object
+      properties:
+        fingerprint: {type: string}
+        host_name: {type: string}
+        vendor_id: {type: string}
+        product_id: {type: string}
+        object_type: {type: string}
+        serial_number: {type: string}
+        device_sn: {type: string}
+        factory_sn: {type: string}
+        first_seen: {type: string, format: date-time}
+        action: {type: string, enum: [keep, set_default_sn, issue_sn, retire_record, inspect]}
+        new_serial: {type: string}
+        note: {type: string}
+    Key:
+      type: object
+      required: [id, host, algorithm, public]
+      properties:
+        id: {type: string, pattern: '^[A-Za-z0-9._-]{1,64}$'}
+        host: {type: string}
+        algorithm: {type: string, enum: [ed25519, hmac-sha256]}
+        public: {type: string, format: byte}
+        created: {type: string, format: date-time}
+        expires: {type: string, format: date-time}
+        revoked: {type: boolean}
+    EnrollRequest:
+      type: object
+      required: [key]
+      properties:
+        key: {$ref: '#/components/schemas/Key'}
+        token: {type: string}
+    Error:
+      type: object
+      required: [error]
+      properties:
+        error: {type: string}
+        details:
+          type: array
+          items:
+            type: object
+            properties:
+              Field: {type: string}
+              Message: {type: string}
+`
@@ -0,0 +1,740 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`compress/gzip`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`log`
+	`net/http`
+	`os`
+	`strings`
+	`time`
+
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+	`github.com/jscherff/cmdb/serial`
+	`github.com/jscherff/cmdb/store`
+)
+
+const (
+	APIPrefix		string	= `/v1`
+	DefaultMaxBody		int64	= 1 << 20
+)
+
+// ChangeStore is implemented by stores that persist audit change records.
+type ChangeStore interface {
+	PutChanges(string, usb.Changes) (error)
+	Changes(string, time.Time) (usb.Changes, error)
+}
+
+// SerialRequest is the body of a request for a new serial number.
+type SerialRequest struct {
+	VendorID	string	`json:"vendor_id"`
+	ProductID	string	`json:"product_id"`
+	HostName	string	`json:"host_name"`
+	Fingerprint	string	`json:"fingerprint"`
+}
+
+// EnrollRequest is the body of a key enrollment or rotation request. The
+// token is only needed to enroll the first key of a host that has no
+// client certificate.
+type EnrollRequest struct {
+	Key		*auth.Key	`json:"key"`
+	Token		string		`json:"token,omitempty"`
+}
+
+// CheckinResponse is the body of a successful checkin response.
+type CheckinResponse struct {
+	Fingerprint	string		`json:"fingerprint"`
+	Stored		time.Time	`json:"stored"`
+}
+
+// ErrorResponse is the body of every error response. Code identifies
+// errors that clients handle specially, such as authentication failures
+// that may succeed if retried.
+type ErrorResponse struct {
+	Error		string		`json:"error"`
+	Code		string		`json:"code,omitempty"`
+	Details		interface{}	`json:"details,omitempty"`
+}
+
+// Server serves the CMDB REST API. Routes are:
+//
+//	POST /v1/checkin                       store a device record
+//	GET  /v1/devices                       query inventory
+//	GET  /v1/devices/{fingerprint}         fetch the last-known record
+//	GET  /v1/devices/{fingerprint}/history fetch stored revisions
+//	POST /v1/devices/{fingerprint}/changes post an audit change set
+//	GET  /v1/devices/{fingerprint}/changes fetch recorded changes
+//	POST /v1/serials                       request a new serial number
+//	GET  /v1/serials/{serial}              fetch a serial number assignment
+//	PUT  /v1/serials/{serial}              claim a serial number
+//	POST /v1/keys                          enroll or rotate an agent key
+//	GET  /v1/reports/serials               serial number data quality report
+//	GET  /v1/openapi.yaml                  OpenAPI description
+//
+// The Allocator is optional; without it serial number requests fail with
+// 501 Not Implemented, as do change requests if the store does not
+// implement ChangeStore. POST and PUT requests that carry an
+// Idempotency-Key header are applied at most once. Their responses are
+// kept by the store if it implements store.IdempotencyStore, so that they
+// survive a restart, and otherwise in memory.
+//
+// With an Auth verifier, installed with SetAuth, signed requests and
+// requests with client certificates are authenticated, and every request
+// except key enrollment and the OpenAPI description must be, unless the
+// verifier allows anonymous requests. Submissions are only accepted for
+// the authenticated host: a checkin or serial number request must name
+// it and a change set must be for a device last checked in by it. Without
+// one, key enrollment fails with 501 Not Implemented.
+type Server struct {
+	Store		usb.Store
+	Allocator	*serial.Allocator
+	Analyzer	*serial.Analyzer
+	Idempotency	store.IdempotencyStore
+	IdempotencyTTL	time.Duration
+	IdempotencyLease	time.Duration
+	Auth		*auth.Verifier
+	Log		*log.Logger
+	MaxBody		int64
+
+	mux		*http.ServeMux
+	handler		http.Handler
+}
+
+// NewServer instantiates a Server backed by a store and, optionally, a
+// serial number allocator.
+func NewServer(s usb.Store, a *serial.Allocator) (*Server, error) {
+
+	if s == nil {
+		return nil, errors.New(`server requires a store`)
+	}
+
+	this := &Server{
+		Store:		s,
+		Allocator:	a,
+		Analyzer:	serial.NewAnalyzer(),
+		Idempotency:	NewIdempotencyCache(DefaultIdempotencySize),
+		IdempotencyTTL:	DefaultIdempotencyTTL,
+		IdempotencyLease:	DefaultIdempotencyLease,
+		Log:		log.New(os.Stderr, `cmdb: `, log.LstdFlags),
+		MaxBody:	DefaultMaxBody,
+		mux:		http.NewServeMux(),
+	}
+
+	this.mux.HandleFunc(APIPrefix + `/checkin`, this.private(this.checkin))
+	this.mux.HandleFunc(APIPrefix + `/devices`, this.private(this.devices))
+	this.mux.HandleFunc(APIPrefix + `/devices/`, this.private(this.device))
+	this.mux.HandleFunc(APIPrefix + `/serials`, this.private(this.serials))
+	this.mux.HandleFunc(APIPrefix + `/serials/`, this.private(this.serial))
+	this.mux.HandleFunc(APIPrefix + `/keys`, this.keys)
+	this.mux.HandleFunc(APIPrefix + `/reports/serials`, this.private(this.serialReport))
+	this.mux.HandleFunc(APIPrefix + `/openapi.yaml`, this.openapi)
+
+	if is, ok := s.(store.IdempotencyStore); ok {
+		this.Idempotency = is
+	}
+
+	this.handler = this.idempotent(this.mux)
+
+	return this, nil
+}
+
+// SetAuth installs a verifier. Signatures it accepts are recorded with the
+// idempotency keys, so with a store that persists them a signature
+// captured before a restart cannot be replayed after it.
+func (this *Server) SetAuth(v *auth.Verifier) {
+
+	if v != nil && this.Idempotency != nil {
+		v.Replay = &replayCache{this}
+	}
+
+	this.Auth = v
+}
+
+// ServeHTTP implements http.Handler.
+func (this *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if this.Auth != nil {
+		this.Auth.Handler(this.handler).ServeHTTP(w, r)
+	} else {
+		this.handler.ServeHTTP(w, r)
+	}
+}
+
+// checkin validates and stores a device record. The fingerprint is derived
+// from the record rather than taken from the client, and an authenticated
+// host may only replace a stored record that it owns.
+func (this *Server) checkin(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodPost) {
+		return
+	}
+
+	j, ok := this.body(w, r)
+
+	if !ok {
+		return
+	}
+
+	di := &usb.DeviceInfo{}
+
+	if err := di.ValidateJSON(j); err != nil {
+		this.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := di.RestoreJSON(j); err != nil {
+		this.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := di.Validate(); err != nil {
+		this.error(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if !this.authorize(w, r, di.HostName) {
+		return
+	}
+
+	if fp := di.MakeFingerprint(); di.Fingerprint != `` && di.Fingerprint != fp {
+		this.error(w, http.StatusUnprocessableEntity, fmt.Errorf(`fingerprint %q does not match device properties`, di.Fingerprint))
+		return
+	} else {
+		di.Fingerprint = fp
+	}
+
+	if old, err := this.Store.Get(di.Fingerprint); err == nil {
+		if old.HostName != di.HostName && !this.authorize(w, r, old.HostName) {
+			return
+		}
+	} else if err != usb.ErrNotFound {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := this.Store.Put(di); err != nil {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	this.reply(w, http.StatusCreated, &CheckinResponse{Fingerprint: di.FP(), Stored: time.Now()})
+}
+
+// devices lists the device records that match the query parameters.
+func (this *Server) devices(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+
+	f := &usb.Filter{
+		HostName:	q.Get(`host_name`),
+		VendorID:	q.Get(`vendor_id`),
+		ProductID:	q.Get(`product_id`),
+		SerialNum:	q.Get(`serial_number`),
+		ObjectType:	q.Get(`object_type`),
+	}
+
+	dis, err := this.Store.List(f)
+
+	if err != nil {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	if dis == nil {
+		dis = []*usb.DeviceInfo{}
+	}
+
+	this.reply(w, http.StatusOK, dis)
+}
+
+// device routes requests for a single device record and its history and
+// changes.
+func (this *Server) device(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, APIPrefix + `/devices/`), `/`)
+	fp := parts[0]
+
+	if fp == `` || len(parts) > 2 {
+		this.error(w, http.StatusNotFound, errors.New(`not found`))
+		return
+	}
+
+	if len(parts) == 1 {
+		if this.method(w, r, http.MethodGet) {
+			di, err := this.Store.Get(fp)
+			this.result(w, di, err)
+		}
+		return
+	}
+
+	switch parts[1] {
+
+	case `history`:
+		if this.method(w, r, http.MethodGet) {
+			revs, err := this.Store.History(fp)
+			this.result(w, revs, err)
+		}
+
+	case `changes`:
+		this.changes(w, r, fp)
+
+	default:
+		this.error(w, http.StatusNotFound, errors.New(`not found`))
+	}
+}
+
+// changes stores a posted audit change set or returns recorded changes
+// detected at or after the time given by the 'since' parameter.
+func (this *Server) changes(w http.ResponseWriter, r *http.Request, fp string) {
+
+	if !this.method(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	cs, ok := this.Store.(ChangeStore)
+
+	if !ok {
+		this.error(w, http.StatusNotImplemented, errors.New(`store does not record changes`))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+
+		var since time.Time
+
+		if s := r.URL.Query().Get(`since`); s != `` {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				this.error(w, http.StatusBadRequest, fmt.Errorf(`since: %v`, err))
+				return
+			}
+			since = t
+		}
+
+		c, err := cs.Changes(fp, since)
+
+		if c == nil {
+			c = usb.Changes{}
+		}
+
+		this.result(w, c, err)
+		return
+	}
+
+	if di, err := this.Store.Get(fp); err != nil {
+		this.result(w, nil, err)
+		return
+	} else if !this.authorize(w, r, di.HostName) {
+		return
+	}
+
+	j, ok := this.body(w, r)
+
+	if !ok {
+		return
+	}
+
+	var c usb.Changes
+
+	if err := json.Unmarshal(j, &c); err != nil {
+		this.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := cs.PutChanges(fp, c); err != nil {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	this.reply(w, http.StatusCreated, c)
+}
+
+// serials issues a new serial number.
+func (this *Server) serials(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodPost) || !this.allocator(w) {
+		return
+	}
+
+	j, ok := this.body(w, r)
+
+	if !ok {
+		return
+	}
+
+	req, ok := this.serialRequest(w, r, j)
+
+	if !ok {
+		return
+	}
+
+	a, err := this.Allocator.Issue(req.VendorID, req.ProductID, req.HostName, req.Fingerprint)
+
+	if err == serial.ErrNoRule {
+		this.error(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	this.reply(w, http.StatusCreated, a)
+}
+
+// serial returns the assignment of a serial number or records a serial
+// number assigned by an agent, such as one copied from the factory serial
+// number while the server was unreachable.
+func (this *Server) serial(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodGet, http.MethodPut) || !this.allocator(w) {
+		return
+	}
+
+	sn := strings.TrimPrefix(r.URL.Path, APIPrefix + `/serials/`)
+
+	if sn == `` {
+		this.error(w, http.StatusNotFound, errors.New(`not found`))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if a, err := this.Allocator.Lookup(sn); err == serial.ErrNotFound {
+			this.error(w, http.StatusNotFound, err)
+		} else {
+			this.result(w, a, err)
+		}
+		return
+	}
+
+	j, ok := this.body(w, r)
+
+	if !ok {
+		return
+	}
+
+	req, ok := this.serialRequest(w, r, j)
+
+	if !ok {
+		return
+	}
+
+	if a, err := this.Allocator.Claim(sn, req.VendorID, req.ProductID, req.HostName, req.Fingerprint); err != nil {
+		this.error(w, http.StatusConflict, err)
+	} else {
+		this.reply(w, http.StatusOK, a)
+	}
+}
+
+// serialRequest decodes and checks a serial number request and verifies
+// that the client may make it for the host it names.
+func (this *Server) serialRequest(w http.ResponseWriter, r *http.Request, j []byte) (*SerialRequest, bool) {
+
+	req := &SerialRequest{}
+
+	if err := json.Unmarshal(j, req); err != nil {
+		this.error(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if req.VendorID == `` || req.ProductID == `` {
+		this.error(w, http.StatusUnprocessableEntity, errors.New(`vendor_id and product_id required`))
+		return nil, false
+	}
+	if !this.authorize(w, r, req.HostName) {
+		return nil, false
+	}
+
+	return req, true
+}
+
+// serialReport analyzes every stored record, or those matching the
+// vendor_id, product_id and object_type parameters, for duplicate and
+// missing serial numbers. The report is JSON unless the format parameter
+// is 'csv'.
+func (this *Server) serialReport(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+
+	a := serial.NewAnalyzer()
+
+	if this.Analyzer != nil {
+		*a = *this.Analyzer
+	}
+
+	a.Filter = &usb.Filter{
+		VendorID:	q.Get(`vendor_id`),
+		ProductID:	q.Get(`product_id`),
+		ObjectType:	q.Get(`object_type`),
+	}
+
+	rpt, err := a.Analyze(this.Store)
+
+	if err != nil {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch q.Get(`format`) {
+
+	case ``, `json`:
+		this.reply(w, http.StatusOK, rpt)
+
+	case `csv`:
+		if b, err := rpt.CSV(); err != nil {
+			this.error(w, http.StatusInternalServerError, err)
+		} else {
+			w.Header().Set(`Content-Type`, `text/csv`)
+			w.Write(b)
+		}
+
+	default:
+		this.error(w, http.StatusBadRequest, fmt.Errorf(`unknown format %q`, q.Get(`format`)))
+	}
+}
+
+// keys enrolls a new agent key or rotates the key that signed the request.
+func (this *Server) keys(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodPost) {
+		return
+	}
+
+	if this.Auth == nil {
+		this.error(w, http.StatusNotImplemented, errors.New(`key enrollment not configured`))
+		return
+	}
+
+	j, ok := this.body(w, r)
+
+	if !ok {
+		return
+	}
+
+	req := &EnrollRequest{}
+
+	if err := json.Unmarshal(j, req); err != nil {
+		this.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Key == nil {
+		this.error(w, http.StatusUnprocessableEntity, errors.New(`key required`))
+		return
+	}
+	if err := req.Key.Verify(); err != nil {
+		this.error(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	req.Key.Created, req.Key.Expires, req.Key.Revoked = time.Now(), time.Time{}, false
+
+	switch err := this.Auth.Enroll(r, req.Key, req.Token); err {
+
+	case nil:
+		this.reply(w, http.StatusCreated, req.Key)
+
+	case auth.ErrUnauthorized, auth.ErrKeyExpired:
+		this.error(w, http.StatusUnauthorized, err)
+
+	case auth.ErrForbidden:
+		this.error(w, http.StatusForbidden, err)
+
+	case auth.ErrKeyExists, auth.ErrHostEnrolled:
+		this.error(w, http.StatusConflict, err)
+
+	default:
+		this.error(w, http.StatusInternalServerError, err)
+	}
+}
+
+// openapi serves the OpenAPI description of the API.
+func (this *Server) openapi(w http.ResponseWriter, r *http.Request) {
+
+	if !this.method(w, r, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set(`Content-Type`, `application/yaml`)
+	w.Write([]byte(OpenAPI))
+}
+
+// method verifies the request method, replying with 405 Method Not
+// Allowed if it is not one of the allowed methods.
+func (this *Server) method(w http.ResponseWriter, r *http.Request, allowed ...string) (bool) {
+
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set(`Allow`, strings.Join(allowed, `, `))
+	this.error(w, http.StatusMethodNotAllowed, fmt.Errorf(`method %s not allowed`, r.Method))
+
+	return false
+}
+
+// private wraps a handler so that, with an Auth verifier, it only serves
+// authenticated requests unless the verifier allows anonymous ones.
+func (this *Server) private(h http.HandlerFunc) (http.HandlerFunc) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if this.Auth != nil {
+			if err := this.Auth.Authenticated(r); err != nil {
+				this.error(w, http.StatusUnauthorized, err)
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
+
+// authorize verifies that the client may submit data for a host, replying
+// with 401 Unauthorized or 403 Forbidden if it may not.
+func (this *Server) authorize(w http.ResponseWriter, r *http.Request, host string) (bool) {
+
+	if this.Auth == nil {
+		return true
+	}
+
+	switch err := this.Auth.Authorize(r, host); err {
+
+	case nil:
+		return true
+
+	case auth.ErrUnauthorized:
+		this.error(w, http.StatusUnauthorized, err)
+
+	default:
+		this.error(w, http.StatusForbidden, err)
+	}
+
+	return false
+}
+
+// allocator verifies that the server has a serial number allocator.
+func (this *Server) allocator(w http.ResponseWriter) (bool) {
+
+	if this.Allocator == nil {
+		this.error(w, http.StatusNotImplemented, errors.New(`serial number issuance not configured`))
+		return false
+	}
+
+	return true
+}
+
+// body reads the request body, decompressing it if it is gzip-encoded,
+// up to the maximum size.
+func (this *Server) body(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+
+	var rd io.Reader = io.LimitReader(r.Body, this.MaxBody + 1)
+
+	if r.Header.Get(`Content-Encoding`) == `gzip` {
+
+		zr, err := gzip.NewReader(rd)
+
+		if err != nil {
+			this.error(w, http.StatusBadRequest, err)
+			return nil, false
+		}
+
+		defer zr.Close()
+		rd = io.LimitReader(zr, this.MaxBody + 1)
+	}
+
+	j, err := ioutil.ReadAll(rd)
+
+	if err != nil {
+		this.error(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if int64(len(j)) > this.MaxBody {
+		this.error(w, http.StatusRequestEntityTooLarge, errors.New(`request body too large`))
+		return nil, false
+	}
+
+	return j, true
+}
+
+// result replies with an object, mapping usb.ErrNotFound to 404 Not Found
+// and other errors to 500 Internal Server Error.
+func (this *Server) result(w http.ResponseWriter, i interface{}, err error) {
+
+	switch {
+	case err == usb.ErrNotFound:
+		this.error(w, http.StatusNotFound, err)
+	case err != nil:
+		this.error(w, http.StatusInternalServerError, err)
+	default:
+		this.reply(w, http.StatusOK, i)
+	}
+}
+
+// reply writes an object as JSON with a status code.
+func (this *Server) reply(w http.ResponseWriter, code int, i interface{}) {
+
+	j, err := json.Marshal(i)
+
+	if err != nil {
+		this.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+// error writes an error response. Validation errors are included as
+// details so the client can report each offending field.
+func (this *Server) error(w http.ResponseWriter, code int, err error) {
+
+	resp := &ErrorResponse{Error: err.Error()}
+
+	if se, ok := err.(usb.SchemaErrors); ok {
+		resp.Details = se
+	}
+
+	if code == http.StatusInternalServerError && this.Log != nil {
+		this.Log.Println(err)
+	}
+
+	writeJSON(w, code, resp)
+}
+
+// writeError writes an error response with a message.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, &ErrorResponse{Error: msg})
+}
+
+// writeJSON writes an object that is known to marshal without error.
+func writeJSON(w http.ResponseWriter, code int, i interface{}) {
+
+	j, _ := json.Marshal(i)
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	w.Write(j)
+}
@@ -0,0 +1,650 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	`bytes`
+	`compress/gzip`
+	`crypto/tls`
+	`crypto/x509`
+	`encoding/json`
+	`io/ioutil`
+	`log`
+	`net/http`
+	`net/http/httptest`
+	`path/filepath`
+	`strings`
+	`testing`
+
+	_ `github.com/mattn/go-sqlite3`
+	`github.com/jscherff/cmdb/auth`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+	`github.com/jscherff/cmdb/serial`
+	`github.com/jscherff/cmdb/store`
+)
+
+// testRequest is a request made to a test server. A non-empty host adds a
+// verified client certificate for that host, and an identity signs it.
+type testRequest struct {
+	method		string
+	path		string
+	body		[]byte
+	header		map[string]string
+	host		string
+	id		*auth.Identity
+}
+
+// do serves the request and returns the recorded response.
+func (this *testRequest) do(h http.Handler) (*httptest.ResponseRecorder) {
+
+	r := httptest.NewRequest(this.method, this.path, bytes.NewReader(this.body))
+
+	for k, v := range this.header {
+		r.Header.Set(k, v)
+	}
+
+	if this.id != nil {
+		this.id.SignRequest(r, this.body)
+	}
+
+	if this.host != `` {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{
+			{&x509.Certificate{DNSNames: []string{this.host}}},
+		}}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+// testRecord returns the JSON of a valid device record.
+func testRecord(host, vid, sn string) ([]byte) {
+
+	j, _ := json.Marshal(&usb.DeviceInfo{
+		HostName:	host,
+		VendorID:	vid,
+		ProductID:	`0001`,
+		SerialNum:	sn,
+		ObjectType:	`*usb.Generic`,
+		PortPath:	`1.2`,
+	})
+
+	return j
+}
+
+// gzipped returns compressed data.
+func gzipped(b []byte) ([]byte) {
+
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+// openTestStore opens a SQLite store in a file that outlives a server.
+// The go-sqlite3 driver registered as 'sqlite3' requires cgo.
+func openTestStore(t *testing.T, fn string) (usb.Store) {
+
+	s, err := store.OpenSQLStore(`sqlite3`, fn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// testServer instantiates a quiet server on a new SQLite store with an
+// allocator that issues serial numbers to vendor 0801.
+func testServer(t *testing.T) (*Server) {
+
+	a, err := serial.NewAllocator(``, []*serial.Rule{{
+		VendorID:	`0801`,
+		Sequence:	`mt`,
+		Format:		&serial.Format{Prefix: `MT`, Width: 6, Start: 1},
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(openTestStore(t, filepath.Join(t.TempDir(), `cmdb.db`)), a)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Log = log.New(ioutil.Discard, ``, 0)
+
+	return srv
+}
+
+// checkin checks in a device record and returns its fingerprint.
+func checkin(t *testing.T, h http.Handler, j []byte) (string) {
+
+	w := (&testRequest{method: `POST`, path: `/v1/checkin`, body: j}).do(h)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf(`checkin: %d %s`, w.Code, w.Body)
+	}
+
+	resp := &CheckinResponse{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Fingerprint
+}
+
+// testRequests serves each request in order and checks its status code
+// and, if want is not empty, that the response body contains it.
+func testRequests(t *testing.T, h http.Handler, tests []struct {
+	name		string
+	req		*testRequest
+	code		int
+	want		string
+}) {
+
+	for _, tt := range tests {
+
+		w := tt.req.do(h)
+
+		if w.Code != tt.code {
+			t.Errorf(`%s: status %d, want %d: %s`, tt.name, w.Code, tt.code, w.Body)
+		} else if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf(`%s: body %s, want %s`, tt.name, w.Body, tt.want)
+		}
+	}
+}
+
+func TestCheckin(t *testing.T) {
+
+	srv := testServer(t)
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`valid`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: testRecord(`host1`, `0801`, `S1`)}, http.StatusCreated, `"fingerprint"`},
+		{`gzip`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: gzipped(testRecord(`host1`, `0801`, `S2`)),
+			header: map[string]string{`Content-Encoding`: `gzip`}}, http.StatusCreated, `"fingerprint"`},
+		{`bad gzip`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: testRecord(`host1`, `0801`, `S2`),
+			header: map[string]string{`Content-Encoding`: `gzip`}}, http.StatusBadRequest, `"error"`},
+		{`malformed`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: []byte(`{"host_name":`)}, http.StatusBadRequest, `"error"`},
+		{`schema`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: []byte(`{"host_name":"host1","unknown":1}`)}, http.StatusBadRequest, `"details"`},
+		{`invalid`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: testRecord(`host1`, `08G1`, `S3`)}, http.StatusUnprocessableEntity, `/vendor_id`},
+		{`too large`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: bytes.Repeat([]byte(` `), int(DefaultMaxBody) + 1)}, http.StatusRequestEntityTooLarge, `"error"`},
+		{`method`, &testRequest{method: `GET`, path: `/v1/checkin`},
+			http.StatusMethodNotAllowed, `"error"`},
+	})
+}
+
+func TestDevices(t *testing.T) {
+
+	srv := testServer(t)
+
+	fp := checkin(t, srv, testRecord(`host1`, `0801`, `S1`))
+	checkin(t, srv, testRecord(`host2`, `0801`, `S2`))
+
+	changes := []byte(`[{"field":"firmware_ver","old_value":"1","new_value":"2"}]`)
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`list`, &testRequest{method: `GET`, path: `/v1/devices`},
+			http.StatusOK, `"host2"`},
+		{`filter`, &testRequest{method: `GET`, path: `/v1/devices?host_name=host1&serial_number=S1`},
+			http.StatusOK, `"host1"`},
+		{`no match`, &testRequest{method: `GET`, path: `/v1/devices?host_name=host9`},
+			http.StatusOK, `[]`},
+		{`list method`, &testRequest{method: `POST`, path: `/v1/devices`},
+			http.StatusMethodNotAllowed, `"error"`},
+		{`get`, &testRequest{method: `GET`, path: `/v1/devices/` + fp},
+			http.StatusOK, `"S1"`},
+		{`unknown`, &testRequest{method: `GET`, path: `/v1/devices/unknown`},
+			http.StatusNotFound, `"error"`},
+		{`history`, &testRequest{method: `GET`, path: `/v1/devices/` + fp + `/history`},
+			http.StatusOK, `"stored"`},
+		{`unknown history`, &testRequest{method: `GET`, path: `/v1/devices/unknown/history`},
+			http.StatusNotFound, `"error"`},
+		{`bad route`, &testRequest{method: `GET`, path: `/v1/devices/` + fp + `/other`},
+			http.StatusNotFound, `"error"`},
+		{`post changes`, &testRequest{method: `POST`, path: `/v1/devices/` + fp + `/changes`, body: changes},
+			http.StatusCreated, `"firmware_ver"`},
+		{`get changes`, &testRequest{method: `GET`, path: `/v1/devices/` + fp + `/changes`},
+			http.StatusOK, `"firmware_ver"`},
+		{`bad since`, &testRequest{method: `GET`, path: `/v1/devices/` + fp + `/changes?since=yesterday`},
+			http.StatusBadRequest, `since`},
+		{`malformed changes`, &testRequest{method: `POST`, path: `/v1/devices/` + fp + `/changes`, body: []byte(`{`)},
+			http.StatusBadRequest, `"error"`},
+		{`unknown changes`, &testRequest{method: `POST`, path: `/v1/devices/unknown/changes`, body: changes},
+			http.StatusNotFound, `"error"`},
+	})
+}
+
+func TestSerials(t *testing.T) {
+
+	srv := testServer(t)
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`issue`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001","host_name":"host1","fingerprint":"fp-a"}`)},
+			http.StatusCreated, `"MT000001"`},
+		{`reissue to holder`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001","host_name":"host1","fingerprint":"fp-a"}`)},
+			http.StatusCreated, `"MT000001"`},
+		{`next`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001","host_name":"host1","fingerprint":"fp-b"}`)},
+			http.StatusCreated, `"MT000002"`},
+		{`no rule`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0acd","product_id":"2030","host_name":"host1"}`)},
+			http.StatusUnprocessableEntity, `no serial number rule`},
+		{`missing product`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0801"}`)},
+			http.StatusUnprocessableEntity, `product_id`},
+		{`malformed`, &testRequest{method: `POST`, path: `/v1/serials`, body: []byte(`[`)},
+			http.StatusBadRequest, `"error"`},
+		{`lookup`, &testRequest{method: `GET`, path: `/v1/serials/MT000001`},
+			http.StatusOK, `"fp-a"`},
+		{`lookup unknown`, &testRequest{method: `GET`, path: `/v1/serials/MT999999`},
+			http.StatusNotFound, `"error"`},
+		{`claim`, &testRequest{method: `PUT`, path: `/v1/serials/F12345`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001","host_name":"host1","fingerprint":"fp-c"}`)},
+			http.StatusOK, `"F12345"`},
+		{`claim held`, &testRequest{method: `PUT`, path: `/v1/serials/MT000001`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001","host_name":"host1","fingerprint":"fp-d"}`)},
+			http.StatusConflict, `held by device`},
+		{`method`, &testRequest{method: `DELETE`, path: `/v1/serials/MT000001`},
+			http.StatusMethodNotAllowed, `"error"`},
+	})
+
+	srv.Allocator = nil
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`no allocator`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001"}`)},
+			http.StatusNotImplemented, `not configured`},
+	})
+}
+
+func TestKeys(t *testing.T) {
+
+	srv := testServer(t)
+
+	id, err := auth.NewIdentity(`host1`, auth.Ed25519)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enroll := func(token string) ([]byte) {
+		j, _ := json.Marshal(&EnrollRequest{Key: id.Key(), Token: token})
+		return j
+	}
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`no verifier`, &testRequest{method: `POST`, path: `/v1/keys`, body: enroll(`secret`)},
+			http.StatusNotImplemented, `not configured`},
+	})
+
+	kr, err := auth.NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Auth = auth.NewVerifier(kr)
+	srv.Auth.EnrollToken = `secret`
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`bad token`, &testRequest{method: `POST`, path: `/v1/keys`, body: enroll(`wrong`)},
+			http.StatusUnauthorized, `"error"`},
+		{`missing key`, &testRequest{method: `POST`, path: `/v1/keys`, body: []byte(`{"token":"secret"}`)},
+			http.StatusUnprocessableEntity, `key required`},
+		{`malformed`, &testRequest{method: `POST`, path: `/v1/keys`, body: []byte(`{`)},
+			http.StatusBadRequest, `"error"`},
+		{`enroll`, &testRequest{method: `POST`, path: `/v1/keys`, body: enroll(`secret`)},
+			http.StatusCreated, id.KeyID},
+		{`enrolled`, &testRequest{method: `POST`, path: `/v1/keys`, body: enroll(`secret`)},
+			http.StatusConflict, `"error"`},
+		{`other host`, &testRequest{method: `POST`, path: `/v1/keys`, body: enroll(``), host: `host2`},
+			http.StatusForbidden, `"error"`},
+		{`method`, &testRequest{method: `GET`, path: `/v1/keys`},
+			http.StatusMethodNotAllowed, `"error"`},
+	})
+}
+
+func TestIdempotentReplay(t *testing.T) {
+
+	srv := testServer(t)
+
+	req := &testRequest{method: `POST`, path: `/v1/checkin`, body: testRecord(`host1`, `0801`, `S1`),
+		header: map[string]string{IdempotencyHeader: `key-1`}}
+
+	first, again := req.do(srv), req.do(srv)
+
+	switch {
+	case first.Code != http.StatusCreated:
+		t.Fatalf(`first: status %d: %s`, first.Code, first.Body)
+	case first.Header().Get(`Idempotent-Replayed`) != ``:
+		t.Errorf(`first: replayed`)
+	case again.Code != http.StatusCreated || again.Header().Get(`Idempotent-Replayed`) != `true`:
+		t.Errorf(`again: status %d, replayed %q`, again.Code, again.Header().Get(`Idempotent-Replayed`))
+	case again.Body.String() != first.Body.String():
+		t.Errorf(`again: body %s, want %s`, again.Body, first.Body)
+	}
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`other request`, &testRequest{method: `POST`, path: `/v1/serials`,
+			body: []byte(`{"vendor_id":"0801","product_id":"0001"}`),
+			header: map[string]string{IdempotencyHeader: `key-1`}},
+			http.StatusUnprocessableEntity, `different request`},
+		{`error not replayed`, &testRequest{method: `POST`, path: `/v1/checkin`, body: []byte(`{`),
+			header: map[string]string{IdempotencyHeader: `key-2`}},
+			http.StatusBadRequest, `"error"`},
+	})
+}
+
+func TestIdempotentReplayAfterRestart(t *testing.T) {
+
+	stores := []struct {
+		name		string
+		open		func(*testing.T, string) (usb.Store)
+	}{
+		{`sqlite`, openTestStore},
+		{`bolt`, func(t *testing.T, fn string) (usb.Store) {
+			s, err := store.NewBoltStore(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+
+	for _, ts := range stores {
+
+		t.Run(ts.name, func(t *testing.T) {
+
+			fn := filepath.Join(t.TempDir(), `cmdb.db`)
+			s := ts.open(t, fn)
+
+			req := &testRequest{method: `POST`, path: `/v1/checkin`, body: testRecord(`host1`, `0801`, `S1`),
+				header: map[string]string{IdempotencyHeader: `key-1`}}
+
+			for i := 0; i < 2; i++ {
+
+				srv, err := NewServer(s, nil)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				w := req.do(srv)
+
+				if w.Code != http.StatusCreated {
+					t.Fatalf(`request %d: status %d: %s`, i + 1, w.Code, w.Body)
+				}
+				if got, want := w.Header().Get(`Idempotent-Replayed`) == `true`, i > 0; got != want {
+					t.Errorf(`request %d: replayed %t, want %t`, i + 1, got, want)
+				}
+			}
+
+			dis, err := s.List(nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			revs, err := s.History(dis[0].FP())
+
+			if err != nil {
+				t.Fatal(err)
+			} else if len(revs) != 1 {
+				t.Errorf(`%d revisions stored, want 1`, len(revs))
+			}
+		})
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+
+	srv := testServer(t)
+
+	kr, err := auth.NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Auth = auth.NewVerifier(kr)
+
+	for _, host := range []string{`host1`, `host2`} {
+
+		w := (&testRequest{method: `POST`, path: `/v1/checkin`, body: testRecord(host, `0801`, `S1`),
+			header: map[string]string{IdempotencyHeader: `key-1`}, host: host}).do(srv)
+
+		if w.Code != http.StatusCreated || w.Header().Get(`Idempotent-Replayed`) != `` {
+			t.Errorf(`%s: status %d, replayed %q`, host, w.Code, w.Header().Get(`Idempotent-Replayed`))
+		}
+	}
+
+	if dis, err := srv.Store.List(nil); err != nil {
+		t.Fatal(err)
+	} else if len(dis) != 2 {
+		t.Errorf(`%d records stored, want 2`, len(dis))
+	}
+}
+
+func TestAuth(t *testing.T) {
+
+	fn := filepath.Join(t.TempDir(), `cmdb.db`)
+	s := openTestStore(t, fn)
+
+	kr, err := auth.NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := auth.NewIdentity(`host1`, auth.Ed25519)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Enroll(id.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(s, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Log = log.New(ioutil.Discard, ``, 0)
+	srv.SetAuth(auth.NewVerifier(kr))
+
+	body := testRecord(`host1`, `0801`, `S1`)
+
+	captured := httptest.NewRequest(`POST`, `/v1/checkin`, bytes.NewReader(body))
+	id.SignRequest(captured, body)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, captured)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf(`signed: status %d: %s`, w.Code, w.Body)
+	}
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`anonymous checkin`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: testRecord(`host1`, `0801`, `S1`)}, http.StatusUnauthorized, `authentication required`},
+		{`anonymous list`, &testRequest{method: `GET`, path: `/v1/devices`},
+			http.StatusUnauthorized, `authentication required`},
+		{`anonymous openapi`, &testRequest{method: `GET`, path: `/v1/openapi.yaml`},
+			http.StatusOK, `openapi`},
+		{`signed other host`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: testRecord(`host2`, `0801`, `S2`), id: id}, http.StatusForbidden, `"error"`},
+		{`certificate`, &testRequest{method: `GET`, path: `/v1/devices`, host: `host2`},
+			http.StatusOK, `"host1"`},
+		{`certificate mismatch`, &testRequest{method: `GET`, path: `/v1/devices`, host: `host2`, id: id},
+			http.StatusForbidden, `"error"`},
+	})
+
+	srv.Auth.AllowAnonymous = true
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`anonymous allowed`, &testRequest{method: `GET`, path: `/v1/devices`},
+			http.StatusOK, `"host1"`},
+	})
+
+	restarted, err := NewServer(s, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted.SetAuth(auth.NewVerifier(kr))
+
+	w = httptest.NewRecorder()
+	captured.Body = ioutil.NopCloser(bytes.NewReader(body))
+	restarted.ServeHTTP(w, captured)
+
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), auth.ErrReplayed.Error()) {
+		t.Errorf(`replay after restart: status %d: %s`, w.Code, w.Body)
+	}
+}
+
+func TestCheckinOwnership(t *testing.T) {
+
+	srv := testServer(t)
+
+	kr, err := auth.NewKeyring(``)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]*auth.Identity)
+
+	for _, host := range []string{`host1`, `host2`} {
+		if id, err := auth.NewIdentity(host, auth.Ed25519); err != nil {
+			t.Fatal(err)
+		} else if err := kr.Enroll(id.Key()); err != nil {
+			t.Fatal(err)
+		} else {
+			ids[host] = id
+		}
+	}
+
+	srv.SetAuth(auth.NewVerifier(kr))
+
+	record := func(host, fp string) ([]byte) {
+		j, _ := json.Marshal(&usb.DeviceInfo{
+			HostName:	host,
+			VendorID:	`0801`,
+			ProductID:	`0001`,
+			FactorySN:	`F1`,
+			SerialNum:	`S1`,
+			ObjectType:	`*usb.Generic`,
+			Fingerprint:	fp,
+		})
+		return j
+	}
+
+	owned := &usb.DeviceInfo{VendorID: `0801`, ProductID: `0001`, FactorySN: `F1`}
+	fp := owned.MakeFingerprint()
+
+	testRequests(t, srv, []struct {
+		name		string
+		req		*testRequest
+		code		int
+		want		string
+	}{
+		{`forged fingerprint`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: record(`host1`, `0123456789abcdef`), id: ids[`host1`]},
+			http.StatusUnprocessableEntity, `fingerprint`},
+		{`owner`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: record(`host1`, fp), id: ids[`host1`]}, http.StatusCreated, fp},
+		{`owner again`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: record(`host1`, ``), id: ids[`host1`]}, http.StatusCreated, fp},
+		{`other host`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: record(`host2`, ``), id: ids[`host2`]}, http.StatusForbidden, `"error"`},
+		{`other host with fingerprint`, &testRequest{method: `POST`, path: `/v1/checkin`,
+			body: record(`host2`, fp), id: ids[`host2`]}, http.StatusForbidden, `"error"`},
+	})
+
+	if di, err := srv.Store.Get(fp); err != nil {
+		t.Fatal(err)
+	} else if di.HostName != `host1` {
+		t.Errorf(`record owned by %q after cross-host checkin, want "host1"`, di.HostName)
+	}
+}
@@ -0,0 +1,599 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spool
+
+import (
+	`bytes`
+	`crypto/rand`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`hash/crc32`
+	`io/ioutil`
+	`log`
+	`os`
+	`path/filepath`
+	`sort`
+	`strconv`
+	`strings`
+	`sync`
+	`time`
+)
+
+const (
+	KindCheckin		string		= `checkin`
+	KindChanges		string		= `changes`
+	KindSerial		string		= `serial`
+
+	DefaultMaxBytes		int64		= 64 << 20
+	DefaultMaxEntries	int		= 10000
+
+	// DefaultMaxAge is kept below the server's default idempotency TTL
+	// of 24 hours, so that every entry is delivered while the server
+	// still remembers its key.
+	DefaultMaxAge		time.Duration	= 23 * time.Hour
+
+	spoolDirMode		os.FileMode	= 0750
+	spoolFileMode		os.FileMode	= 0640
+	spoolFileExt		string		= `.rec`
+	spoolMagic		string		= `cmdbspool1`
+	corruptDir		string		= `corrupt`
+	rejectedDir		string		= `rejected`
+	expiredDir		string		= `expired`
+)
+
+// ErrFull is returned when an entry would exceed the spool's size limits.
+// The entry is not queued and the caller still owns it. Queued entries
+// are never evicted to make room.
+var ErrFull = errors.New(`spool full`)
+
+// Entry is a queued API request. The idempotency key is sent with every
+// delivery attempt so the server applies the request at most once. Target
+// identifies the record the request applies to, such as the fingerprint
+// of a device.
+type Entry struct {
+	Seq		uint64		`json:"-"`
+	Key		string		`json:"key"`
+	Kind		string		`json:"kind"`
+	Target		string		`json:"target,omitempty"`
+	Method		string		`json:"method"`
+	Path		string		`json:"path"`
+	Created		time.Time	`json:"created"`
+	Body		json.RawMessage	`json:"body,omitempty"`
+}
+
+// NewEntry instantiates an entry with a new idempotency key.
+func NewEntry(kind, method, path string, body []byte) (*Entry, error) {
+
+	key, err := NewKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		Key:		key,
+		Kind:		kind,
+		Method:		method,
+		Path:		path,
+		Created:	time.Now(),
+		Body:		body,
+	}, nil
+}
+
+// NewKey returns a random idempotency key.
+func NewKey() (string, error) {
+
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Spool is a durable first-in, first-out queue of entries kept in a
+// directory, one file per entry. Each file carries a checksum; files that
+// fail verification are moved to the 'corrupt' subdirectory rather than
+// blocking the queue. A checkin replaces the queued checkin for the same
+// target, if it is not being delivered, so only the newest is sent; no
+// other entry is ever removed before delivery.
+//
+// Entries older than MaxAge are not delivered but moved to the 'expired'
+// subdirectory: the server forgets idempotency keys after its TTL, so a
+// request it may already have applied would be applied again. MaxAge must
+// not exceed the server's idempotency TTL. Quarantined and expired entries
+// are logged to Log, if it is set. A Spool is safe for use by multiple
+// goroutines but not by multiple processes.
+type Spool struct {
+	Dir		string
+	MaxBytes	int64
+	MaxEntries	int
+	MaxAge		time.Duration
+	Log		*log.Logger
+
+	mu		sync.Mutex
+	replay		sync.Mutex
+	next		uint64
+	checkins	map[string]uint64
+	sending		uint64
+}
+
+// Open opens or creates a spool in a directory, removes temporary files
+// left by interrupted writes and quarantines corrupt entries.
+func Open(dir string) (*Spool, error) {
+
+	for _, d := range []string{dir, filepath.Join(dir, corruptDir),
+		filepath.Join(dir, rejectedDir), filepath.Join(dir, expiredDir)} {
+		if err := os.MkdirAll(d, spoolDirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	this := &Spool{
+		Dir:		dir,
+		MaxBytes:	DefaultMaxBytes,
+		MaxEntries:	DefaultMaxEntries,
+		MaxAge:		DefaultMaxAge,
+		checkins:	make(map[string]uint64),
+	}
+
+	if tmps, err := filepath.Glob(filepath.Join(dir, `.tmp-*`)); err != nil {
+		return nil, err
+	} else {
+		for _, fn := range tmps {
+			os.Remove(fn)
+		}
+	}
+
+	seqs, err := this.seqs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seq := range seqs {
+		if e, err := this.read(seq); err != nil {
+			if err := this.quarantine(seq, corruptDir, err); err != nil {
+				return nil, err
+			}
+		} else if e.Kind == KindCheckin && e.Target != `` {
+			this.checkins[e.Target] = seq
+		}
+		this.next = seq
+	}
+
+	this.next++
+
+	return this, nil
+}
+
+// Enqueue appends an entry to the spool and assigns its sequence number.
+// A checkin with a target instead replaces the queued checkin for that
+// target and takes its sequence number, unless that checkin is being
+// delivered. Enqueue returns ErrFull if the entry would exceed the spool's
+// limits.
+func (this *Spool) Enqueue(e *Entry) (error) {
+
+	data, err := encode(e)
+
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n, size, err := this.usage()
+
+	if err != nil {
+		return err
+	}
+
+	seq, replace := this.superseded(e)
+
+	if replace {
+		if fi, err := os.Stat(this.file(seq)); err != nil {
+			replace = false
+		} else {
+			n, size = n - 1, size - fi.Size()
+		}
+	}
+
+	if this.MaxEntries > 0 && n + 1 > this.MaxEntries {
+		return ErrFull
+	}
+	if this.MaxBytes > 0 && size + int64(len(data)) > this.MaxBytes {
+		return ErrFull
+	}
+
+	if !replace {
+		seq = this.next
+	}
+
+	if err := writeFile(this.file(seq), data); err != nil {
+		return err
+	}
+
+	if !replace {
+		this.next++
+	}
+	if e.Kind == KindCheckin && e.Target != `` {
+		this.checkins[e.Target] = seq
+	}
+
+	e.Seq = seq
+
+	return nil
+}
+
+// superseded returns the sequence number of the queued checkin that a
+// new entry replaces, if any.
+func (this *Spool) superseded(e *Entry) (uint64, bool) {
+
+	if e.Kind != KindCheckin || e.Target == `` {
+		return 0, false
+	}
+
+	seq, ok := this.checkins[e.Target]
+
+	if !ok || seq == this.sending {
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// Entries returns the queued entries in order.
+func (this *Spool) Entries() (es []*Entry, err error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	seqs, err := this.seqs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seq := range seqs {
+
+		e, err := this.read(seq)
+
+		if err != nil {
+			this.quarantine(seq, corruptDir, err)
+			continue
+		}
+
+		es = append(es, e)
+	}
+
+	return es, nil
+}
+
+// Len returns the number of queued entries.
+func (this *Spool) Len() (int, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n, _, err := this.usage()
+
+	return n, err
+}
+
+// Replay delivers queued entries in order, removing each after the
+// handler succeeds. It stops at the first temporary error, leaving that
+// entry and all later entries queued so order is preserved. Entries the
+// handler fails with a permanent error are moved to the 'rejected'
+// subdirectory along with the error, and entries older than MaxAge to the
+// 'expired' subdirectory without being delivered. An error is temporary
+// unless it has a Temporary method that returns false. Replay returns the
+// number of entries delivered.
+//
+// The handler is called without the spool locked, so entries may be
+// queued while it delivers one, but only one Replay runs at a time.
+func (this *Spool) Replay(handler func(*Entry) (error)) (n int, err error) {
+
+	this.replay.Lock()
+	defer this.replay.Unlock()
+
+	this.mu.Lock()
+	seqs, err := this.seqs()
+	this.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, seq := range seqs {
+
+		e, err := this.take(seq)
+
+		if err != nil {
+			return n, err
+		}
+		if e == nil {
+			continue
+		}
+
+		if age := time.Since(e.Created); this.MaxAge > 0 && age > this.MaxAge {
+			reason := fmt.Errorf(`queued %s ago, longer than %s`, age.Round(time.Second), this.MaxAge)
+			if err := this.settle(e, expiredDir, reason); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		if err := handler(e); err != nil {
+			if t, ok := err.(interface{ Temporary() (bool) }); ok && !t.Temporary() {
+				if err := this.settle(e, rejectedDir, err); err != nil {
+					return n, err
+				}
+				continue
+			}
+			this.release()
+			return n, err
+		}
+
+		if err := this.settle(e, ``, nil); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// take reads the entry with a given sequence number for delivery and
+// marks it as being delivered, so that it is not replaced until it is
+// settled or released. Corrupt entries are quarantined; the entry is nil
+// if it was corrupt or is no longer queued.
+func (this *Spool) take(seq uint64) (*Entry, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	e, err := this.read(seq)
+
+	switch {
+
+	case err == nil:
+		this.sending = seq
+		return e, nil
+
+	case os.IsNotExist(err):
+		return nil, nil
+
+	default:
+		return nil, this.quarantine(seq, corruptDir, err)
+	}
+}
+
+// release ends the delivery of an entry that remains queued.
+func (this *Spool) release() {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.sending = 0
+}
+
+// settle ends the delivery of an entry and removes it or, given the reason
+// it was not delivered, moves it to a subdirectory.
+func (this *Spool) settle(e *Entry, dir string, reason error) (error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.sending = 0
+
+	if seq, ok := this.checkins[e.Target]; ok && seq == e.Seq {
+		delete(this.checkins, e.Target)
+	}
+
+	var err error
+
+	if reason != nil {
+		err = this.quarantine(e.Seq, dir, reason)
+	} else {
+		err = os.Remove(this.file(e.Seq))
+	}
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// seqs returns the sequence numbers of queued entries in order.
+func (this *Spool) seqs() (seqs []uint64, err error) {
+
+	fns, err := filepath.Glob(filepath.Join(this.Dir, `*` + spoolFileExt))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fn := range fns {
+		if seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(fn), spoolFileExt), 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	return seqs, nil
+}
+
+// usage returns the number and total size of queued entries.
+func (this *Spool) usage() (n int, size int64, err error) {
+
+	fns, err := filepath.Glob(filepath.Join(this.Dir, `*` + spoolFileExt))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, fn := range fns {
+		if fi, err := os.Stat(fn); err == nil {
+			n, size = n + 1, size + fi.Size()
+		}
+	}
+
+	return n, size, nil
+}
+
+// read reads and verifies the entry with a given sequence number.
+func (this *Spool) read(seq uint64) (*Entry, error) {
+
+	data, err := ioutil.ReadFile(this.file(seq))
+
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decode(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.Seq = seq
+
+	return e, nil
+}
+
+// quarantine moves an entry file to a subdirectory under a unique name
+// and writes the reason alongside it.
+func (this *Spool) quarantine(seq uint64, dir string, reason error) (error) {
+
+	fn := filepath.Join(this.Dir, dir, fmt.Sprintf(`%s.%d`,
+		filepath.Base(this.file(seq)), time.Now().UnixNano()))
+
+	if err := os.Rename(this.file(seq), fn); err != nil {
+		return err
+	}
+
+	if this.Log != nil {
+		this.Log.Printf(`spool entry %d moved to %s: %v`, seq, dir, reason)
+	}
+
+	return ioutil.WriteFile(fn + `.err`, []byte(reason.Error() + "\n"), spoolFileMode)
+}
+
+// file returns the path of the entry file with a given sequence number.
+func (this *Spool) file(seq uint64) (string) {
+	return filepath.Join(this.Dir, fmt.Sprintf(`%020d%s`, seq, spoolFileExt))
+}
+
+// encode serializes an entry with a header line holding a magic string,
+// the CRC-32 checksum and the length of the JSON that follows.
+func encode(e *Entry) ([]byte, error) {
+
+	j, err := json.Marshal(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%s %08x %d\n", spoolMagic, crc32.ChecksumIEEE(j), len(j))
+	b.Write(j)
+
+	return b.Bytes(), nil
+}
+
+// decode verifies and deserializes an entry.
+func decode(data []byte) (*Entry, error) {
+
+	i := bytes.IndexByte(data, '\n')
+
+	if i < 0 {
+		return nil, errors.New(`missing header`)
+	}
+
+	var (
+		magic	string
+		sum	uint32
+		size	int
+	)
+
+	if _, err := fmt.Sscanf(string(data[:i]), "%s %x %d", &magic, &sum, &size); err != nil {
+		return nil, fmt.Errorf(`invalid header: %v`, err)
+	}
+	if magic != spoolMagic {
+		return nil, fmt.Errorf(`invalid header magic %q`, magic)
+	}
+
+	j := data[i+1:]
+
+	if len(j) != size {
+		return nil, fmt.Errorf(`length %d, expected %d`, len(j), size)
+	}
+	if crc32.ChecksumIEEE(j) != sum {
+		return nil, errors.New(`checksum mismatch`)
+	}
+
+	e := &Entry{}
+
+	if err := json.Unmarshal(j, e); err != nil {
+		return nil, err
+	}
+	if e.Key == `` || e.Method == `` || e.Path == `` {
+		return nil, errors.New(`incomplete entry`)
+	}
+
+	return e, nil
+}
+
+// writeFile durably and atomically writes data to a file by syncing a
+// temporary file in the same directory and renaming it.
+func writeFile(fn string, data []byte) (error) {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), `.tmp-`)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), spoolFileMode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
@@ -0,0 +1,338 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spool
+
+import (
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+	`time`
+)
+
+// testError is a delivery error that is temporary or permanent.
+type testError struct {
+	temporary	bool
+}
+
+func (this *testError) Error() (string) {
+	return `test error`
+}
+
+func (this *testError) Temporary() (bool) {
+	return this.temporary
+}
+
+// testSpool opens a spool in a new temporary directory.
+func testSpool(t *testing.T) (*Spool) {
+
+	s, err := Open(t.TempDir())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// testEntry returns an entry of a given kind and target with a body that
+// identifies it.
+func testEntry(t *testing.T, kind, target, body string) (*Entry) {
+
+	e, err := NewEntry(kind, `POST`, `/` + kind, []byte(`"` + body + `"`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Target = target
+
+	return e
+}
+
+// enqueue queues entries and fails the test on error.
+func enqueue(t *testing.T, s *Spool, es ...*Entry) {
+
+	for _, e := range es {
+		if err := s.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// bodies returns the bodies of the queued entries in order.
+func bodies(t *testing.T, s *Spool) (string) {
+
+	es, err := s.Entries()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ss []string
+
+	for _, e := range es {
+		ss = append(ss, strings.Trim(string(e.Body), `"`))
+	}
+
+	return strings.Join(ss, ` `)
+}
+
+// files returns the names of the files in a spool subdirectory that are
+// not error reports.
+func files(t *testing.T, s *Spool, dir string) (fns []string) {
+
+	fis, err := ioutil.ReadDir(filepath.Join(s.Dir, dir))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), `.err`) {
+			fns = append(fns, fi.Name())
+		}
+	}
+
+	return fns
+}
+
+func TestSpoolOpenQuarantine(t *testing.T) {
+
+	s := testSpool(t)
+
+	enqueue(t, s,
+		testEntry(t, KindChanges, `fp1`, `a`),
+		testEntry(t, KindChanges, `fp1`, `b`),
+		testEntry(t, KindChanges, `fp1`, `c`),
+		testEntry(t, KindChanges, `fp1`, `d`),
+	)
+
+	truncated, corrupted := s.file(2), s.file(3)
+
+	if data, err := ioutil.ReadFile(truncated); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(truncated, data[:len(data) - 5], spoolFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := ioutil.ReadFile(corrupted); err != nil {
+		t.Fatal(err)
+	} else {
+		data[len(data) - 2] ^= 0x01
+		if err := ioutil.WriteFile(corrupted, data, spoolFileMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(s.Dir, `.tmp-123`), []byte(`partial`), spoolFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(s.Dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bodies(t, s); got != `a d` {
+		t.Errorf(`queued: got %q, want "a d"`, got)
+	}
+	if got := files(t, s, corruptDir); len(got) != 2 {
+		t.Errorf(`quarantined: got %v, want 2 files`, got)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, `.tmp-123`)); !os.IsNotExist(err) {
+		t.Errorf(`temporary file not removed: %v`, err)
+	}
+
+	e := testEntry(t, KindChanges, `fp1`, `e`)
+	enqueue(t, s, e)
+
+	if e.Seq != 5 {
+		t.Errorf(`sequence after reopen: got %d, want 5`, e.Seq)
+	}
+}
+
+func TestSpoolReplayOrder(t *testing.T) {
+
+	s := testSpool(t)
+
+	enqueue(t, s,
+		testEntry(t, KindChanges, `fp1`, `a`),
+		testEntry(t, KindChanges, `fp1`, `b`),
+		testEntry(t, KindSerial, `sn1`, `c`),
+		testEntry(t, KindChanges, `fp2`, `d`),
+	)
+
+	var delivered []string
+
+	deliver := func(fail map[string]error) (func(*Entry) (error)) {
+		return func(e *Entry) (error) {
+			body := strings.Trim(string(e.Body), `"`)
+			if err := fail[body]; err != nil {
+				return err
+			}
+			delivered = append(delivered, body)
+			return nil
+		}
+	}
+
+	n, err := s.Replay(deliver(map[string]error{
+		`b`: &testError{temporary: false},
+		`c`: &testError{temporary: true},
+	}))
+
+	if n != 1 || err == nil {
+		t.Errorf(`first replay: delivered %d, error %v; want 1 and a temporary error`, n, err)
+	}
+	if got := bodies(t, s); got != `c d` {
+		t.Errorf(`after temporary error: queued %q, want "c d"`, got)
+	}
+	if got := files(t, s, rejectedDir); len(got) != 1 {
+		t.Errorf(`rejected: got %v, want 1 file`, got)
+	}
+
+	enqueue(t, s, testEntry(t, KindChanges, `fp1`, `e`))
+
+	if n, err := s.Replay(deliver(nil)); n != 3 || err != nil {
+		t.Errorf(`second replay: delivered %d, error %v; want 3 and no error`, n, err)
+	}
+	if got := strings.Join(delivered, ` `); got != `a c d e` {
+		t.Errorf(`delivery order: got %q, want "a c d e"`, got)
+	}
+	if n, _ := s.Len(); n != 0 {
+		t.Errorf(`%d entries left after replay`, n)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+
+	s := testSpool(t)
+	s.MaxEntries = 2
+
+	enqueue(t, s,
+		testEntry(t, KindCheckin, `fp1`, `a`),
+		testEntry(t, KindChanges, `fp1`, `b`),
+	)
+
+	for _, e := range []*Entry{
+		testEntry(t, KindChanges, `fp1`, `c`),
+		testEntry(t, KindSerial, `sn1`, `c`),
+		testEntry(t, KindCheckin, `fp2`, `c`),
+	} {
+		if err := s.Enqueue(e); err != ErrFull {
+			t.Errorf(`%s entry: got %v, want ErrFull`, e.Kind, err)
+		}
+	}
+
+	if got := bodies(t, s); got != `a b` {
+		t.Errorf(`queued: got %q, want "a b"`, got)
+	}
+
+	if err := s.Enqueue(testEntry(t, KindCheckin, `fp1`, `d`)); err != nil {
+		t.Errorf(`replacing checkin in a full spool: %v`, err)
+	}
+	if got := bodies(t, s); got != `d b` {
+		t.Errorf(`queued: got %q, want "d b"`, got)
+	}
+
+	s.MaxEntries = 0
+	s.MaxBytes = 1
+
+	if err := s.Enqueue(testEntry(t, KindChanges, `fp1`, `e`)); err != ErrFull {
+		t.Errorf(`byte limit: got %v, want ErrFull`, err)
+	}
+}
+
+func TestSpoolCheckinReplaced(t *testing.T) {
+
+	s := testSpool(t)
+
+	enqueue(t, s,
+		testEntry(t, KindCheckin, `fp1`, `a`),
+		testEntry(t, KindChanges, `fp1`, `b`),
+		testEntry(t, KindCheckin, `fp2`, `c`),
+		testEntry(t, KindCheckin, `fp1`, `d`),
+		testEntry(t, KindChanges, `fp1`, `e`),
+		testEntry(t, KindCheckin, ``, `f`),
+		testEntry(t, KindCheckin, ``, `g`),
+	)
+
+	if got := bodies(t, s); got != `d b c e f g` {
+		t.Errorf(`queued: got %q, want "d b c e f g"`, got)
+	}
+
+	s, err := Open(s.Dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enqueue(t, s, testEntry(t, KindCheckin, `fp2`, `h`))
+
+	if got := bodies(t, s); got != `d b h e f g` {
+		t.Errorf(`queued after reopen: got %q, want "d b h e f g"`, got)
+	}
+
+	var delivered []string
+
+	n, err := s.Replay(func(e *Entry) (error) {
+		body := strings.Trim(string(e.Body), `"`)
+		delivered = append(delivered, body)
+		if body == `d` {
+			enqueue(t, s, testEntry(t, KindCheckin, `fp1`, `i`))
+		}
+		return nil
+	})
+
+	if n != 6 || err != nil {
+		t.Errorf(`replay: delivered %d, error %v; want 6 and no error`, n, err)
+	}
+	if got := strings.Join(delivered, ` `); got != `d b h e f g` {
+		t.Errorf(`delivered: got %q, want "d b h e f g"`, got)
+	}
+	if got := bodies(t, s); got != `i` {
+		t.Errorf(`checkin queued during its delivery: got %q, want "i"`, got)
+	}
+}
+
+func TestSpoolExpired(t *testing.T) {
+
+	s := testSpool(t)
+	s.MaxAge = time.Hour
+
+	old := testEntry(t, KindChanges, `fp1`, `a`)
+	old.Created = time.Now().Add(-2 * time.Hour)
+
+	enqueue(t, s, old, testEntry(t, KindChanges, `fp1`, `b`))
+
+	var delivered []string
+
+	n, err := s.Replay(func(e *Entry) (error) {
+		delivered = append(delivered, strings.Trim(string(e.Body), `"`))
+		return nil
+	})
+
+	if n != 1 || err != nil {
+		t.Errorf(`replay: delivered %d, error %v; want 1 and no error`, n, err)
+	}
+	if got := strings.Join(delivered, ` `); got != `b` {
+		t.Errorf(`delivered: got %q, want "b"`, got)
+	}
+	if got := files(t, s, expiredDir); len(got) != 1 {
+		t.Errorf(`expired: got %v, want 1 file`, got)
+	}
+}
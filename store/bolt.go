@@ -0,0 +1,500 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	`bytes`
+	`encoding/binary`
+	`encoding/json`
+	`fmt`
+	`os`
+	`strings`
+	`time`
+
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+	bolt `go.etcd.io/bbolt`
+)
+
+const (
+	boltFileMode		os.FileMode	= 0640
+	boltOpenTimeout		time.Duration	= 5 * time.Second
+)
+
+var (
+	// boltCurrent holds the current record for each fingerprint.
+	boltCurrent = []byte(`current`)
+
+	// boltSerials indexes fingerprints by serial number. It holds a nested
+	// bucket for each serial number that maps the fingerprint of every
+	// current record with that serial number to the big-endian Unix
+	// nanoseconds at which it was stored, so records that share a serial
+	// number are all indexed.
+	boltSerials = []byte(`serials`)
+
+	// boltHistory holds a nested bucket of revisions for each fingerprint,
+	// keyed by big-endian Unix nanoseconds.
+	boltHistory = []byte(`history`)
+
+	// boltIdempotency holds the response to each request with an
+	// idempotency key, keyed by scope and key.
+	boltIdempotency = []byte(`idempotency`)
+
+	// boltIdempotencyAge indexes boltIdempotency by the big-endian Unix
+	// nanoseconds at which each entry was stored, so expired entries are
+	// found without a scan.
+	boltIdempotencyAge = []byte(`idempotency_age`)
+)
+
+// BoltStore is a Store backed by an embedded Bolt key-value database. It
+// also persists the responses to requests with idempotency keys.
+type BoltStore struct {
+	DB	*bolt.DB
+}
+
+// NewBoltStore opens or creates a Bolt database file and instantiates a
+// BoltStore.
+func NewBoltStore(fn string) (*BoltStore, error) {
+
+	db, err := bolt.Open(fn, boltFileMode, &bolt.Options{Timeout: boltOpenTimeout})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) (error) {
+
+		for _, b := range [][]byte{boltCurrent, boltSerials, boltHistory, boltIdempotency, boltIdempotencyAge} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{DB: db}, nil
+}
+
+// Put stores a device record under its fingerprint and adds a revision
+// to its history.
+func (this *BoltStore) Put(di *usb.DeviceInfo) (error) {
+
+	fp := di.FP()
+
+	if err := checkKey(fp); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(di)
+
+	if err != nil {
+		return err
+	}
+
+	now := timeKey(time.Now())
+
+	return this.DB.Update(func(tx *bolt.Tx) (error) {
+
+		cur := tx.Bucket(boltCurrent)
+
+		if old := cur.Get([]byte(fp)); old != nil {
+
+			prev := &usb.DeviceInfo{}
+
+			if err := json.Unmarshal(old, prev); err == nil && prev.SerialNum != di.SerialNum {
+				if err := unindexSerial(tx, prev.SerialNum, fp); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := cur.Put([]byte(fp), j); err != nil {
+			return err
+		}
+
+		if err := indexSerial(tx, di.SerialNum, fp, now); err != nil {
+			return err
+		}
+
+		hb, err := tx.Bucket(boltHistory).CreateBucketIfNotExists([]byte(fp))
+
+		if err != nil {
+			return err
+		}
+
+		return hb.Put(now, j)
+	})
+}
+
+// Get returns the current record with a given fingerprint.
+func (this *BoltStore) Get(fp string) (di *usb.DeviceInfo, err error) {
+
+	err = this.DB.View(func(tx *bolt.Tx) (error) {
+		di, err = getRecord(tx, fp)
+		return err
+	})
+
+	return di, err
+}
+
+// GetBySerial returns the most recently stored record with a given serial
+// number. Use List with a serial number filter to find every record that
+// shares it.
+func (this *BoltStore) GetBySerial(sn string) (di *usb.DeviceInfo, err error) {
+
+	if sn == `` {
+		return nil, usb.ErrNotFound
+	}
+
+	err = this.DB.View(func(tx *bolt.Tx) (error) {
+
+		var fp, latest []byte
+
+		sb := tx.Bucket(boltSerials).Bucket([]byte(sn))
+
+		if sb == nil {
+			return usb.ErrNotFound
+		}
+
+		sb.ForEach(func(k, v []byte) (error) {
+			if fp == nil || bytes.Compare(v, latest) > 0 {
+				fp, latest = k, v
+			}
+			return nil
+		})
+
+		if fp == nil {
+			return usb.ErrNotFound
+		}
+
+		di, err = getRecord(tx, string(fp))
+		return err
+	})
+
+	return di, err
+}
+
+// List returns the current records that match a filter, ordered by
+// fingerprint. A filter on an exact serial number is answered from the
+// serial number index.
+func (this *BoltStore) List(f *usb.Filter) (dis []*usb.DeviceInfo, err error) {
+
+	err = this.DB.View(func(tx *bolt.Tx) (error) {
+
+		if f != nil && f.SerialNum != `` && !hasMeta(f.SerialNum) {
+
+			sb := tx.Bucket(boltSerials).Bucket([]byte(f.SerialNum))
+
+			if sb == nil {
+				return nil
+			}
+
+			return sb.ForEach(func(k, _ []byte) (error) {
+
+				di, err := getRecord(tx, string(k))
+
+				if err != nil {
+					return fmt.Errorf(`%s: %v`, k, err)
+				}
+				if f.Match(di) {
+					dis = append(dis, di)
+				}
+
+				return nil
+			})
+		}
+
+		return tx.Bucket(boltCurrent).ForEach(func(k, v []byte) (error) {
+
+			di, err := decodeRecord(v)
+
+			if err != nil {
+				return fmt.Errorf(`%s: %v`, k, err)
+			}
+			if f.Match(di) {
+				dis = append(dis, di)
+			}
+
+			return nil
+		})
+	})
+
+	return dis, err
+}
+
+// History returns every stored revision of the record with a given
+// fingerprint, oldest first.
+func (this *BoltStore) History(fp string) (revs []*usb.Revision, err error) {
+
+	err = this.DB.View(func(tx *bolt.Tx) (error) {
+
+		hb := tx.Bucket(boltHistory).Bucket([]byte(fp))
+
+		if hb == nil {
+			return usb.ErrNotFound
+		}
+
+		return hb.ForEach(func(k, v []byte) (error) {
+
+			if len(k) != 8 {
+				return nil
+			}
+
+			di, err := decodeRecord(v)
+
+			if err != nil {
+				return fmt.Errorf(`%s: %v`, fp, err)
+			}
+
+			revs = append(revs, &usb.Revision{
+				Stored:	time.Unix(0, int64(binary.BigEndian.Uint64(k))),
+				Device:	di,
+			})
+
+			return nil
+		})
+	})
+
+	return revs, err
+}
+
+// ReserveKey implements IdempotencyStore. Responses older than ttl
+// are deleted first.
+func (this *BoltStore) ReserveKey(scope, key, request string, ttl, lease time.Duration) (resp *IdempotentResponse, ok bool, err error) {
+
+	now := time.Now()
+
+	err = this.DB.Update(func(tx *bolt.Tx) (error) {
+
+		if err := pruneResponses(tx, now.Add(-ttl)); err != nil {
+			return err
+		}
+
+		id := idempotencyID(scope, key)
+
+		if old, err := getResponse(tx, id); err != nil {
+			return err
+		} else if old != nil && !old.Expired(now, ttl, lease) {
+			resp = old
+			return nil
+		}
+
+		resp, ok = &IdempotentResponse{Request: request, Stored: now}, true
+
+		return putResponse(tx, id, resp)
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return resp, ok, nil
+}
+
+// RecordResponse implements IdempotencyStore.
+func (this *BoltStore) RecordResponse(scope, key string, resp *IdempotentResponse) (error) {
+
+	return this.DB.Update(func(tx *bolt.Tx) (error) {
+
+		id := idempotencyID(scope, key)
+
+		if old, err := getResponse(tx, id); err != nil || old == nil {
+			return err
+		}
+
+		return putResponse(tx, id, resp)
+	})
+}
+
+// ReleaseKey implements IdempotencyStore.
+func (this *BoltStore) ReleaseKey(scope, key string) (error) {
+
+	return this.DB.Update(func(tx *bolt.Tx) (error) {
+		return deleteResponse(tx, idempotencyID(scope, key))
+	})
+}
+
+// Close closes the underlying database.
+func (this *BoltStore) Close() (error) {
+	return this.DB.Close()
+}
+
+// indexSerial adds a fingerprint to the index entry of a serial number.
+func indexSerial(tx *bolt.Tx, sn, fp string, stored []byte) (error) {
+
+	if sn == `` {
+		return nil
+	}
+
+	sb, err := tx.Bucket(boltSerials).CreateBucketIfNotExists([]byte(sn))
+
+	if err != nil {
+		return err
+	}
+
+	return sb.Put([]byte(fp), stored)
+}
+
+// unindexSerial removes a fingerprint from the index entry of a serial
+// number, removing the entry once it is empty.
+func unindexSerial(tx *bolt.Tx, sn, fp string) (error) {
+
+	serials := tx.Bucket(boltSerials)
+	sb := serials.Bucket([]byte(sn))
+
+	if sn == `` || sb == nil {
+		return nil
+	}
+
+	if err := sb.Delete([]byte(fp)); err != nil {
+		return err
+	}
+
+	if k, _ := sb.Cursor().First(); k == nil {
+		return serials.DeleteBucket([]byte(sn))
+	}
+
+	return nil
+}
+
+// idempotencyID returns the key of an idempotency entry.
+func idempotencyID(scope, key string) ([]byte) {
+	return []byte(scope + "\x00" + key)
+}
+
+// getResponse returns the idempotency entry with a given ID, or nil.
+func getResponse(tx *bolt.Tx, id []byte) (*IdempotentResponse, error) {
+
+	v := tx.Bucket(boltIdempotency).Get(id)
+
+	if v == nil {
+		return nil, nil
+	}
+
+	resp := &IdempotentResponse{}
+
+	if err := json.Unmarshal(v, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// putResponse stores an idempotency entry, replacing any previous entry
+// with the same ID.
+func putResponse(tx *bolt.Tx, id []byte, resp *IdempotentResponse) (error) {
+
+	if err := deleteResponse(tx, id); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(resp)
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(boltIdempotency).Put(id, j); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltIdempotencyAge).Put(append(timeKey(resp.Stored), id...), nil)
+}
+
+// deleteResponse removes an idempotency entry and its age index entry.
+func deleteResponse(tx *bolt.Tx, id []byte) (error) {
+
+	old, err := getResponse(tx, id)
+
+	if err != nil || old == nil {
+		return err
+	}
+
+	if err := tx.Bucket(boltIdempotencyAge).Delete(append(timeKey(old.Stored), id...)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltIdempotency).Delete(id)
+}
+
+// pruneResponses removes the idempotency entries stored before a time.
+func pruneResponses(tx *bolt.Tx, before time.Time) (error) {
+
+	var (
+		ab	= tx.Bucket(boltIdempotencyAge)
+		ib	= tx.Bucket(boltIdempotency)
+		limit	= timeKey(before)
+		stale	[][]byte
+	)
+
+	c := ab.Cursor()
+
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+		stale = append(stale, append([]byte{}, k...))
+	}
+
+	for _, k := range stale {
+		if err := ab.Delete(k); err != nil {
+			return err
+		}
+		if err := ib.Delete(k[8:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasMeta reports whether a filter pattern contains glob metacharacters.
+func hasMeta(pattern string) (bool) {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// getRecord returns the current record with a given fingerprint.
+func getRecord(tx *bolt.Tx, fp string) (*usb.DeviceInfo, error) {
+
+	if v := tx.Bucket(boltCurrent).Get([]byte(fp)); v == nil {
+		return nil, usb.ErrNotFound
+	} else {
+		return decodeRecord(v)
+	}
+}
+
+// decodeRecord validates and decodes a device record. The value is copied
+// because Bolt values are only valid for the life of the transaction.
+func decodeRecord(v []byte) (*usb.DeviceInfo, error) {
+
+	di := &usb.DeviceInfo{}
+
+	if err := di.RestoreJSON(append([]byte{}, v...)); err != nil {
+		return nil, err
+	}
+
+	return di, nil
+}
+
+// timeKey encodes a time as a sortable big-endian key.
+func timeKey(t time.Time) ([]byte) {
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+
+	return k
+}
@@ -0,0 +1,251 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	`fmt`
+	`strconv`
+	`strings`
+)
+
+// Dialect describes the SQL differences between supported databases:
+// the bind parameter style, how a migration transaction is begun and
+// locked against concurrent migrations, and the schema migrations,
+// applied in order. Migration N brings the schema to version N+1.
+type Dialect struct {
+	Name		string
+	Numbered	bool
+	Begin		string
+	Lock		[]string
+	Migrations	[]string
+}
+
+// migrationLockID is the PostgreSQL advisory lock key held while
+// migrating.
+const migrationLockID = 0x636d6462
+
+var (
+	// SQLite is the dialect for SQLite 3.24 or later.
+	SQLite = &Dialect{
+		Name:		`sqlite`,
+		Numbered:	false,
+		Begin:		`BEGIN IMMEDIATE`,
+		Migrations:	[]string{sqliteMigration1, sqliteMigration2},
+	}
+
+	// PostgreSQL is the dialect for PostgreSQL 9.5 or later.
+	PostgreSQL = &Dialect{
+		Name:		`postgres`,
+		Numbered:	true,
+		Begin:		`BEGIN`,
+		Lock:		[]string{fmt.Sprintf(`SELECT pg_advisory_xact_lock(%d)`, migrationLockID)},
+		Migrations:	[]string{postgresMigration1, postgresMigration2},
+	}
+
+	// dialects maps database/sql driver names to dialects.
+	dialects = map[string]*Dialect{
+		`sqlite`:	SQLite,
+		`sqlite3`:	SQLite,
+		`postgres`:	PostgreSQL,
+		`pgx`:		PostgreSQL,
+	}
+)
+
+// DialectFor returns the dialect for a database/sql driver name.
+func DialectFor(driver string) (*Dialect, error) {
+
+	if d, ok := dialects[driver]; ok {
+		return d, nil
+	}
+
+	return nil, fmt.Errorf(`no SQL dialect for driver %q`, driver)
+}
+
+// Rebind converts '?' bind parameters to the dialect's style.
+func (this *Dialect) Rebind(query string) (string) {
+
+	if !this.Numbered {
+		return query
+	}
+
+	var b strings.Builder
+
+	for n := 1; ; n++ {
+
+		i := strings.IndexByte(query, '?')
+
+		if i < 0 {
+			break
+		}
+
+		b.WriteString(query[:i])
+		b.WriteString(`$` + strconv.Itoa(n))
+		query = query[i+1:]
+	}
+
+	b.WriteString(query)
+
+	return b.String()
+}
+
+// schemaVersionDDL creates the table that records applied migrations. It
+// is valid in every supported dialect.
+const schemaVersionDDL = `CREATE TABLE IF NOT EXISTS schema_version (
+	version		INTEGER		NOT NULL PRIMARY KEY,
+	applied		BIGINT		NOT NULL
+)`
+
+// Timestamps are stored as Unix nanoseconds so that both dialects sort
+// and compare them identically. Device records are stored as JSON along
+// with the columns used for lookups.
+
+const sqliteMigration1 = `
+CREATE TABLE hosts (
+	host_name	TEXT		NOT NULL PRIMARY KEY,
+	first_seen	BIGINT		NOT NULL,
+	last_seen	BIGINT		NOT NULL
+);
+
+CREATE TABLE devices (
+	fingerprint	TEXT		NOT NULL PRIMARY KEY,
+	host_name	TEXT		NOT NULL REFERENCES hosts (host_name),
+	vendor_id	TEXT		NOT NULL,
+	product_id	TEXT		NOT NULL,
+	serial_num	TEXT		NOT NULL,
+	object_type	TEXT		NOT NULL,
+	record		TEXT		NOT NULL,
+	updated		BIGINT		NOT NULL
+);
+
+CREATE INDEX devices_serial_num ON devices (serial_num);
+CREATE INDEX devices_host_name ON devices (host_name);
+
+CREATE TABLE device_history (
+	id		INTEGER		PRIMARY KEY AUTOINCREMENT,
+	fingerprint	TEXT		NOT NULL,
+	stored		BIGINT		NOT NULL,
+	record		TEXT		NOT NULL
+);
+
+CREATE INDEX device_history_fingerprint ON device_history (fingerprint, stored);
+
+CREATE TABLE device_hosts (
+	fingerprint	TEXT		NOT NULL,
+	host_name	TEXT		NOT NULL REFERENCES hosts (host_name),
+	first_seen	BIGINT		NOT NULL,
+	last_seen	BIGINT		NOT NULL,
+	PRIMARY KEY (fingerprint, host_name)
+);
+
+CREATE TABLE changes (
+	id		INTEGER		PRIMARY KEY AUTOINCREMENT,
+	fingerprint	TEXT		NOT NULL,
+	field		TEXT		NOT NULL,
+	old_value	TEXT		NOT NULL,
+	new_value	TEXT		NOT NULL,
+	detected_at	BIGINT		NOT NULL,
+	source		TEXT		NOT NULL,
+	collector	TEXT		NOT NULL,
+	severity	TEXT		NOT NULL
+);
+
+CREATE INDEX changes_fingerprint ON changes (fingerprint, detected_at);
+`
+
+const postgresMigration1 = `
+CREATE TABLE hosts (
+	host_name	TEXT		NOT NULL PRIMARY KEY,
+	first_seen	BIGINT		NOT NULL,
+	last_seen	BIGINT		NOT NULL
+);
+
+CREATE TABLE devices (
+	fingerprint	TEXT		NOT NULL PRIMARY KEY,
+	host_name	TEXT		NOT NULL REFERENCES hosts (host_name),
+	vendor_id	TEXT		NOT NULL,
+	product_id	TEXT		NOT NULL,
+	serial_num	TEXT		NOT NULL,
+	object_type	TEXT		NOT NULL,
+	record		TEXT		NOT NULL,
+	updated		BIGINT		NOT NULL
+);
+
+CREATE INDEX devices_serial_num ON devices (serial_num);
+CREATE INDEX devices_host_name ON devices (host_name);
+
+CREATE TABLE device_history (
+	id		BIGSERIAL	PRIMARY KEY,
+	fingerprint	TEXT		NOT NULL,
+	stored		BIGINT		NOT NULL,
+	record		TEXT		NOT NULL
+);
+
+CREATE INDEX device_history_fingerprint ON device_history (fingerprint, stored);
+
+CREATE TABLE device_hosts (
+	fingerprint	TEXT		NOT NULL,
+	host_name	TEXT		NOT NULL REFERENCES hosts (host_name),
+	first_seen	BIGINT		NOT NULL,
+	last_seen	BIGINT		NOT NULL,
+	PRIMARY KEY (fingerprint, host_name)
+);
+
+CREATE TABLE changes (
+	id		BIGSERIAL	PRIMARY KEY,
+	fingerprint	TEXT		NOT NULL,
+	field		TEXT		NOT NULL,
+	old_value	TEXT		NOT NULL,
+	new_value	TEXT		NOT NULL,
+	detected_at	BIGINT		NOT NULL,
+	source		TEXT		NOT NULL,
+	collector	TEXT		NOT NULL,
+	severity	TEXT		NOT NULL
+);
+
+CREATE INDEX changes_fingerprint ON changes (fingerprint, detected_at);
+`
+
+// Migration 2 adds the responses to requests that carried idempotency
+// keys. A zero code marks a request still in progress.
+
+const sqliteMigration2 = `
+CREATE TABLE idempotency (
+	scope		TEXT		NOT NULL,
+	idem_key	TEXT		NOT NULL,
+	request		TEXT		NOT NULL,
+	code		INTEGER		NOT NULL,
+	header		TEXT		NOT NULL,
+	body		BLOB		NOT NULL,
+	stored		BIGINT		NOT NULL,
+	PRIMARY KEY (scope, idem_key)
+);
+
+CREATE INDEX idempotency_stored ON idempotency (stored);
+`
+
+const postgresMigration2 = `
+CREATE TABLE idempotency (
+	scope		TEXT		NOT NULL,
+	idem_key	TEXT		NOT NULL,
+	request		TEXT		NOT NULL,
+	code		INTEGER		NOT NULL,
+	header		TEXT		NOT NULL,
+	body		BYTEA		NOT NULL,
+	stored		BIGINT		NOT NULL,
+	PRIMARY KEY (scope, idem_key)
+);
+
+CREATE INDEX idempotency_stored ON idempotency (stored);
+`
@@ -0,0 +1,296 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`regexp`
+	`sort`
+	`strconv`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+const (
+	fsDirMode		os.FileMode	= 0750
+	fsFileMode		os.FileMode	= 0640
+	fsCurrentDir		string		= `current`
+	fsHistoryDir		string		= `history`
+	fsFileExt		string		= `.json`
+)
+
+// keyRgx restricts record keys to characters safe for use in file names.
+var keyRgx = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// FileStore is a Store backed by a directory of JSON files. The current
+// record for each fingerprint is kept in 'current/<fp>.json' and every
+// revision in 'history/<fp>/<unix-nanoseconds>.json'.
+type FileStore struct {
+	Dir	string
+	mu	sync.RWMutex
+}
+
+// NewFileStore instantiates a FileStore rooted at a directory, creating
+// the directory if necessary.
+func NewFileStore(dir string) (*FileStore, error) {
+
+	for _, d := range []string{fsCurrentDir, fsHistoryDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), fsDirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileStore{Dir: dir}, nil
+}
+
+// Put stores a device record under its fingerprint and adds a revision
+// to its history.
+func (this *FileStore) Put(di *usb.DeviceInfo) (error) {
+
+	fp := di.FP()
+
+	if err := checkKey(fp); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(di)
+
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	hdir := filepath.Join(this.Dir, fsHistoryDir, fp)
+
+	if err := os.MkdirAll(hdir, fsDirMode); err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	if err := writeFile(filepath.Join(hdir, ts + fsFileExt), j); err != nil {
+		return err
+	}
+
+	return writeFile(this.currentFile(fp), j)
+}
+
+// Get returns the current record with a given fingerprint.
+func (this *FileStore) Get(fp string) (*usb.DeviceInfo, error) {
+
+	if err := checkKey(fp); err != nil {
+		return nil, err
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return readFile(this.currentFile(fp))
+}
+
+// GetBySerial returns the most recently stored record with a given serial
+// number.
+func (this *FileStore) GetBySerial(sn string) (*usb.DeviceInfo, error) {
+
+	if sn == `` {
+		return nil, usb.ErrNotFound
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	fns, err := filepath.Glob(filepath.Join(this.Dir, fsCurrentDir, `*` + fsFileExt))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		found	*usb.DeviceInfo
+		latest	time.Time
+	)
+
+	for _, fn := range fns {
+
+		di, err := readFile(fn)
+
+		if err != nil {
+			return nil, err
+		}
+		if di.SerialNum != sn {
+			continue
+		}
+
+		if fi, err := os.Stat(fn); err != nil {
+			return nil, err
+		} else if found == nil || fi.ModTime().After(latest) {
+			found, latest = di, fi.ModTime()
+		}
+	}
+
+	if found == nil {
+		return nil, usb.ErrNotFound
+	}
+
+	return found, nil
+}
+
+// List returns the current records that match a filter, ordered by
+// fingerprint.
+func (this *FileStore) List(f *usb.Filter) (dis []*usb.DeviceInfo, err error) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	fns, err := filepath.Glob(filepath.Join(this.Dir, fsCurrentDir, `*` + fsFileExt))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(fns)
+
+	for _, fn := range fns {
+
+		if di, err := readFile(fn); err != nil {
+			return nil, err
+		} else if f.Match(di) {
+			dis = append(dis, di)
+		}
+	}
+
+	return dis, nil
+}
+
+// History returns every stored revision of the record with a given
+// fingerprint, oldest first.
+func (this *FileStore) History(fp string) (revs []*usb.Revision, err error) {
+
+	if err := checkKey(fp); err != nil {
+		return nil, err
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	fns, err := filepath.Glob(filepath.Join(this.Dir, fsHistoryDir, fp, `*` + fsFileExt))
+
+	if err != nil {
+		return nil, err
+	}
+	if len(fns) == 0 {
+		return nil, usb.ErrNotFound
+	}
+
+	for _, fn := range fns {
+
+		ns, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(fn), fsFileExt), 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		di, err := readFile(fn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		revs = append(revs, &usb.Revision{Stored: time.Unix(0, ns), Device: di})
+	}
+
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Stored.Before(revs[j].Stored)
+	})
+
+	return revs, nil
+}
+
+// Close implements the Store interface; a FileStore holds no resources.
+func (this *FileStore) Close() (error) {
+	return nil
+}
+
+// currentFile returns the path of the current record for a fingerprint.
+func (this *FileStore) currentFile(fp string) (string) {
+	return filepath.Join(this.Dir, fsCurrentDir, fp + fsFileExt)
+}
+
+// checkKey verifies that a record key is non-empty and safe for use as a
+// file name.
+func checkKey(key string) (error) {
+
+	if !keyRgx.MatchString(key) || key == `.` || key == `..` {
+		return fmt.Errorf(`invalid record key %q`, key)
+	}
+
+	return nil
+}
+
+// readFile reads a device record from a JSON file.
+func readFile(fn string) (*usb.DeviceInfo, error) {
+
+	j, err := ioutil.ReadFile(fn)
+
+	if os.IsNotExist(err) {
+		return nil, usb.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	di := &usb.DeviceInfo{}
+
+	if err := di.RestoreJSON(j); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, fn, err)
+	}
+
+	return di, nil
+}
+
+// writeFile atomically writes data to a file by writing a temporary file
+// in the same directory and renaming it.
+func writeFile(fn string, data []byte) (error) {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), `.tmp-`)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), fsFileMode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
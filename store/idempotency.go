@@ -0,0 +1,60 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import `time`
+
+// IdempotencyStore is implemented by stores that persist the responses to
+// requests carrying idempotency keys, so that a request replayed after a
+// server restart returns the original response instead of being applied
+// again. Keys are unique within a scope, such as the
+// authenticated host that made the request.
+//
+// ReserveKey claims a key for a request, returning the new reservation and
+// true, unless the key holds a response stored less than ttl ago or a
+// reservation made less than lease ago, in which case that entry is
+// returned with false. RecordResponse stores the response for a reserved
+// key and ReleaseKey forgets a key so its request may be retried.
+type IdempotencyStore interface {
+	ReserveKey(scope, key, request string, ttl, lease time.Duration) (*IdempotentResponse, bool, error)
+	RecordResponse(scope, key string, resp *IdempotentResponse) (error)
+	ReleaseKey(scope, key string) (error)
+}
+
+// IdempotentResponse is the response recorded for an idempotency key. A
+// zero Code marks a reservation for a request still in progress.
+type IdempotentResponse struct {
+	Request		string			`json:"request"`
+	Code		int			`json:"code"`
+	Header		map[string][]string	`json:"header,omitempty"`
+	Body		[]byte			`json:"body,omitempty"`
+	Stored		time.Time		`json:"stored"`
+}
+
+// Done reports whether the response has been recorded.
+func (this *IdempotentResponse) Done() (bool) {
+	return this.Code != 0
+}
+
+// Expired reports whether a response has outlived ttl, or a reservation
+// lease, at a given time.
+func (this *IdempotentResponse) Expired(now time.Time, ttl, lease time.Duration) (bool) {
+
+	if this.Done() {
+		return now.Sub(this.Stored) >= ttl
+	}
+
+	return now.Sub(this.Stored) >= lease
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	`path/filepath`
+	`testing`
+	`time`
+)
+
+// testIdempotency runs a sequence of idempotency store operations, each
+// checked against the expected outcome of a reservation.
+func testIdempotency(t *testing.T, s IdempotencyStore) {
+
+	const (
+		ttl	= time.Hour
+		lease	= time.Minute
+	)
+
+	done := &IdempotentResponse{
+		Request:	`POST /v1/checkin`,
+		Code:		201,
+		Header:		map[string][]string{`Content-Type`: {`application/json`}},
+		Body:		[]byte(`{"fingerprint":"fp-a"}`),
+		Stored:		time.Now(),
+	}
+
+	steps := []struct {
+		name		string
+		op		func() (error)
+		scope		string
+		key		string
+		ttl		time.Duration
+		lease		time.Duration
+		reserved	bool
+		code		int
+	}{
+		{`new key`, nil, `host1`, `k1`, ttl, lease, true, 0},
+		{`in progress`, nil, `host1`, `k1`, ttl, lease, false, 0},
+		{`other scope`, nil, `host2`, `k1`, ttl, lease, true, 0},
+		{`recorded`, func() (error) { return s.RecordResponse(`host1`, `k1`, done) },
+			`host1`, `k1`, ttl, lease, false, 201},
+		{`expired`, nil, `host1`, `k1`, 0, lease, true, 0},
+		{`lease lapsed`, nil, `host1`, `k1`, ttl, 0, true, 0},
+		{`released`, func() (error) { return s.ReleaseKey(`host1`, `k1`) },
+			`host1`, `k1`, ttl, lease, true, 0},
+	}
+
+	for _, st := range steps {
+
+		if st.op != nil {
+			if err := st.op(); err != nil {
+				t.Fatalf(`%s: %v`, st.name, err)
+			}
+		}
+
+		resp, ok, err := s.ReserveKey(st.scope, st.key, `POST /v1/checkin`, st.ttl, st.lease)
+
+		switch {
+		case err != nil:
+			t.Fatalf(`%s: %v`, st.name, err)
+		case ok != st.reserved:
+			t.Errorf(`%s: reserved %t, want %t`, st.name, ok, st.reserved)
+		case resp.Code != st.code:
+			t.Errorf(`%s: code %d, want %d`, st.name, resp.Code, st.code)
+		case st.code != 0 && (string(resp.Body) != string(done.Body) ||
+			resp.Header[`Content-Type`][0] != `application/json`):
+			t.Errorf(`%s: got %+v, want %+v`, st.name, resp, done)
+		}
+	}
+}
+
+func TestSQLStoreIdempotency(t *testing.T) {
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			db, d := tdb.open(t)
+
+			s, err := NewSQLStore(db, d)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testIdempotency(t, s)
+		})
+	}
+}
+
+func TestBoltStoreIdempotency(t *testing.T) {
+
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), `cmdb.db`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	testIdempotency(t, s)
+}
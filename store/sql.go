@@ -0,0 +1,676 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	`context`
+	`database/sql`
+	`encoding/json`
+	`fmt`
+	`strings`
+	`time`
+
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+// HostLink records that a device has been seen attached to a host.
+type HostLink struct {
+	Fingerprint	string		`json:"fingerprint"`
+	HostName	string		`json:"host_name"`
+	FirstSeen	time.Time	`json:"first_seen"`
+	LastSeen	time.Time	`json:"last_seen"`
+}
+
+// sqlReserveTries bounds the attempts to reserve an idempotency key that
+// other servers are concurrently reserving and releasing.
+const sqlReserveTries = 3
+
+// SQLStore is a Store backed by a database/sql database. In addition to
+// device records and their history it persists audit change records, the
+// hosts each device has been attached to and the responses to requests
+// with idempotency keys. The caller must import the database driver.
+type SQLStore struct {
+	DB		*sql.DB
+	Dialect		*Dialect
+}
+
+// OpenSQLStore opens a database with a registered database/sql driver,
+// selects the dialect by driver name and migrates the schema.
+func OpenSQLStore(driver, dsn string) (*SQLStore, error) {
+
+	d, err := DialectFor(driver)
+
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this, err := NewSQLStore(db, d)
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// NewSQLStore instantiates an SQLStore on an open database and migrates
+// the schema to the latest version.
+func NewSQLStore(db *sql.DB, d *Dialect) (*SQLStore, error) {
+
+	this := &SQLStore{DB: db, Dialect: d}
+
+	if err := this.Migrate(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Version returns the current schema version.
+func (this *SQLStore) Version() (v int, err error) {
+
+	if _, err = this.DB.Exec(schemaVersionDDL); err != nil {
+		return 0, err
+	}
+
+	var nv sql.NullInt64
+
+	if err = this.DB.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&nv); err != nil {
+		return 0, err
+	}
+
+	return int(nv.Int64), nil
+}
+
+// Migrate applies every migration newer than the current schema version.
+// The version check and the migrations run in one transaction that is
+// opened with the dialect's lock, so servers migrating the same database
+// at once apply each migration only once.
+func (this *SQLStore) Migrate() (error) {
+
+	ctx := context.Background()
+	conn, err := this.DB.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	exec := func(query string, args ...interface{}) (error) {
+		_, err := conn.ExecContext(ctx, this.Dialect.Rebind(query), args...)
+		return err
+	}
+
+	if err := exec(this.Dialect.Begin); err != nil {
+		return err
+	}
+
+	if err := this.migrate(ctx, conn, exec); err != nil {
+		exec(`ROLLBACK`)
+		return err
+	}
+
+	return exec(`COMMIT`)
+}
+
+// migrate locks out concurrent migrations and applies every pending
+// migration within the transaction open on a connection.
+func (this *SQLStore) migrate(ctx context.Context, conn *sql.Conn,
+	exec func(string, ...interface{}) (error)) (error) {
+
+	for _, stmt := range this.Dialect.Lock {
+		if err := exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if err := exec(schemaVersionDDL); err != nil {
+		return err
+	}
+
+	var nv sql.NullInt64
+
+	if err := conn.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&nv); err != nil {
+		return err
+	}
+
+	v := int(nv.Int64)
+
+	if v > len(this.Dialect.Migrations) {
+		return fmt.Errorf(`schema version %d is newer than supported version %d`,
+			v, len(this.Dialect.Migrations))
+	}
+
+	for i := v; i < len(this.Dialect.Migrations); i++ {
+
+		for _, stmt := range statements(this.Dialect.Migrations[i]) {
+			if err := exec(stmt); err != nil {
+				return fmt.Errorf(`migration %d: %v`, i + 1, err)
+			}
+		}
+
+		if err := exec(`INSERT INTO schema_version (version, applied) VALUES (?, ?)`,
+			i + 1, time.Now().UnixNano()); err != nil {
+			return fmt.Errorf(`migration %d: %v`, i + 1, err)
+		}
+	}
+
+	return nil
+}
+
+// Put stores a device record under its fingerprint, adds a revision to
+// its history and records its attachment to its host.
+func (this *SQLStore) Put(di *usb.DeviceInfo) (error) {
+
+	fp := di.FP()
+
+	if err := checkKey(fp); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(di)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+
+	return this.tx(func(tx *sql.Tx) (error) {
+
+		if err := this.exec(tx,
+			`INSERT INTO hosts (host_name, first_seen, last_seen) VALUES (?, ?, ?)
+			ON CONFLICT (host_name) DO UPDATE SET last_seen = excluded.last_seen`,
+			di.HostName, now, now,
+		); err != nil {
+			return err
+		}
+
+		if err := this.exec(tx,
+			`INSERT INTO devices (fingerprint, host_name, vendor_id, product_id,
+				serial_num, object_type, record, updated)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (fingerprint) DO UPDATE SET
+				host_name = excluded.host_name,
+				vendor_id = excluded.vendor_id,
+				product_id = excluded.product_id,
+				serial_num = excluded.serial_num,
+				object_type = excluded.object_type,
+				record = excluded.record,
+				updated = excluded.updated`,
+			fp, di.HostName, di.VendorID, di.ProductID,
+			di.SerialNum, di.ObjectType, string(j), now,
+		); err != nil {
+			return err
+		}
+
+		if err := this.exec(tx,
+			`INSERT INTO device_history (fingerprint, stored, record) VALUES (?, ?, ?)`,
+			fp, now, string(j),
+		); err != nil {
+			return err
+		}
+
+		return this.exec(tx,
+			`INSERT INTO device_hosts (fingerprint, host_name, first_seen, last_seen)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (fingerprint, host_name) DO UPDATE SET last_seen = excluded.last_seen`,
+			fp, di.HostName, now, now,
+		)
+	})
+}
+
+// Get returns the current record with a given fingerprint.
+func (this *SQLStore) Get(fp string) (*usb.DeviceInfo, error) {
+	return this.one(`SELECT record FROM devices WHERE fingerprint = ?`, fp)
+}
+
+// GetBySerial returns the most recently stored record with a given serial
+// number.
+func (this *SQLStore) GetBySerial(sn string) (*usb.DeviceInfo, error) {
+
+	if sn == `` {
+		return nil, usb.ErrNotFound
+	}
+
+	return this.one(`SELECT record FROM devices WHERE serial_num = ?
+		ORDER BY updated DESC LIMIT 1`, sn)
+}
+
+// List returns the current records that match a filter, ordered by
+// fingerprint. The filter is translated to a WHERE clause so the lookup
+// columns' indexes narrow the query.
+func (this *SQLStore) List(f *usb.Filter) (dis []*usb.DeviceInfo, err error) {
+
+	cond, args := where(f)
+
+	rows, err := this.query(`SELECT record FROM devices` + cond + ` ORDER BY fingerprint`, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var j string
+
+		if err := rows.Scan(&j); err != nil {
+			return nil, err
+		}
+
+		if di, err := decodeRecord([]byte(j)); err != nil {
+			return nil, err
+		} else if f.Match(di) {
+			dis = append(dis, di)
+		}
+	}
+
+	return dis, rows.Err()
+}
+
+// History returns every stored revision of the record with a given
+// fingerprint, oldest first.
+func (this *SQLStore) History(fp string) (revs []*usb.Revision, err error) {
+
+	rows, err := this.query(`SELECT stored, record FROM device_history
+		WHERE fingerprint = ? ORDER BY stored, id`, fp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			ns	int64
+			j	string
+		)
+
+		if err := rows.Scan(&ns, &j); err != nil {
+			return nil, err
+		}
+
+		di, err := decodeRecord([]byte(j))
+
+		if err != nil {
+			return nil, err
+		}
+
+		revs = append(revs, &usb.Revision{Stored: time.Unix(0, ns), Device: di})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return nil, usb.ErrNotFound
+	}
+
+	return revs, nil
+}
+
+// PutChanges stores the change records of an audit of the device with a
+// given fingerprint.
+func (this *SQLStore) PutChanges(fp string, c usb.Changes) (error) {
+
+	if err := checkKey(fp); err != nil {
+		return err
+	}
+
+	return this.tx(func(tx *sql.Tx) (error) {
+
+		for _, ch := range c {
+
+			if err := this.exec(tx,
+				`INSERT INTO changes (fingerprint, field, old_value, new_value,
+					detected_at, source, collector, severity)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				fp, ch.Field, ch.OldValue, ch.NewValue,
+				ch.DetectedAt.UnixNano(), ch.Source, ch.Collector, string(ch.Severity),
+			); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Changes returns the change records of the device with a given
+// fingerprint detected at or after a given time, oldest first.
+func (this *SQLStore) Changes(fp string, since time.Time) (c usb.Changes, err error) {
+
+	rows, err := this.query(`SELECT field, old_value, new_value, detected_at,
+			source, collector, severity
+		FROM changes WHERE fingerprint = ? AND detected_at >= ?
+		ORDER BY detected_at, id`, fp, since.UnixNano())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			ch	= &usb.Change{}
+			ns	int64
+			sev	string
+		)
+
+		if err := rows.Scan(&ch.Field, &ch.OldValue, &ch.NewValue, &ns,
+			&ch.Source, &ch.Collector, &sev); err != nil {
+			return nil, err
+		}
+
+		ch.DetectedAt, ch.Severity = time.Unix(0, ns), usb.Severity(sev)
+		c = append(c, ch)
+	}
+
+	return c, rows.Err()
+}
+
+// Hosts returns the hosts the device with a given fingerprint has been
+// seen attached to, most recent first.
+func (this *SQLStore) Hosts(fp string) ([]*HostLink, error) {
+	return this.links(`SELECT fingerprint, host_name, first_seen, last_seen
+		FROM device_hosts WHERE fingerprint = ? ORDER BY last_seen DESC`, fp)
+}
+
+// Devices returns the devices that have been seen attached to a given
+// host, most recent first.
+func (this *SQLStore) Devices(host string) ([]*HostLink, error) {
+	return this.links(`SELECT fingerprint, host_name, first_seen, last_seen
+		FROM device_hosts WHERE host_name = ? ORDER BY last_seen DESC`, host)
+}
+
+// ReserveKey implements IdempotencyStore. Responses older than ttl
+// are deleted first, and the key is claimed with a conditional insert or
+// update, so that servers sharing the database agree on which of them
+// processes a request.
+func (this *SQLStore) ReserveKey(scope, key, request string, ttl, lease time.Duration) (*IdempotentResponse, bool, error) {
+
+	now := time.Now()
+	resp := &IdempotentResponse{Request: request, Stored: now}
+
+	if _, err := this.DB.Exec(this.Dialect.Rebind(
+		`DELETE FROM idempotency WHERE stored < ?`), now.Add(-ttl).UnixNano()); err != nil {
+		return nil, false, err
+	}
+
+	for try := 0; try < sqlReserveTries; try++ {
+
+		res, err := this.DB.Exec(this.Dialect.Rebind(
+			`INSERT INTO idempotency (scope, idem_key, request, code, header, body, stored)
+			VALUES (?, ?, ?, 0, '', ?, ?)
+			ON CONFLICT (scope, idem_key) DO NOTHING`),
+			scope, key, request, []byte{}, now.UnixNano())
+
+		if err != nil {
+			return nil, false, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, false, err
+		} else if n == 1 {
+			return resp, true, nil
+		}
+
+		old, err := this.response(scope, key)
+
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		if !old.Expired(now, ttl, lease) {
+			return old, false, nil
+		}
+
+		res, err = this.DB.Exec(this.Dialect.Rebind(
+			`UPDATE idempotency SET request = ?, code = 0, header = '', body = ?, stored = ?
+			WHERE scope = ? AND idem_key = ? AND code = ? AND stored = ?`),
+			request, []byte{}, now.UnixNano(), scope, key, old.Code, old.Stored.UnixNano())
+
+		if err != nil {
+			return nil, false, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, false, err
+		} else if n == 1 {
+			return resp, true, nil
+		}
+	}
+
+	return nil, false, fmt.Errorf(`idempotency key %q: too much contention`, key)
+}
+
+// RecordResponse implements IdempotencyStore.
+func (this *SQLStore) RecordResponse(scope, key string, resp *IdempotentResponse) (error) {
+
+	hj, err := json.Marshal(resp.Header)
+
+	if err != nil {
+		return err
+	}
+
+	body := resp.Body
+
+	if body == nil {
+		body = []byte{}
+	}
+
+	_, err = this.DB.Exec(this.Dialect.Rebind(
+		`UPDATE idempotency SET request = ?, code = ?, header = ?, body = ?, stored = ?
+		WHERE scope = ? AND idem_key = ?`),
+		resp.Request, resp.Code, string(hj), body, resp.Stored.UnixNano(), scope, key)
+
+	return err
+}
+
+// ReleaseKey implements IdempotencyStore.
+func (this *SQLStore) ReleaseKey(scope, key string) (error) {
+
+	_, err := this.DB.Exec(this.Dialect.Rebind(
+		`DELETE FROM idempotency WHERE scope = ? AND idem_key = ?`), scope, key)
+
+	return err
+}
+
+// response returns the entry stored for an idempotency key.
+func (this *SQLStore) response(scope, key string) (*IdempotentResponse, error) {
+
+	var (
+		resp	= &IdempotentResponse{}
+		hj	string
+		ns	int64
+	)
+
+	if err := this.DB.QueryRow(this.Dialect.Rebind(
+		`SELECT request, code, header, body, stored FROM idempotency
+		WHERE scope = ? AND idem_key = ?`), scope, key).Scan(
+		&resp.Request, &resp.Code, &hj, &resp.Body, &ns); err != nil {
+		return nil, err
+	}
+
+	if hj != `` {
+		if err := json.Unmarshal([]byte(hj), &resp.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	resp.Stored = time.Unix(0, ns)
+
+	return resp, nil
+}
+
+// Close closes the underlying database.
+func (this *SQLStore) Close() (error) {
+	return this.DB.Close()
+}
+
+// one returns the device record selected by a single-row query.
+func (this *SQLStore) one(query string, args ...interface{}) (*usb.DeviceInfo, error) {
+
+	var j string
+
+	err := this.DB.QueryRow(this.Dialect.Rebind(query), args...).Scan(&j)
+
+	if err == sql.ErrNoRows {
+		return nil, usb.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeRecord([]byte(j))
+}
+
+// links returns the host links selected by a query.
+func (this *SQLStore) links(query string, args ...interface{}) (hl []*HostLink, err error) {
+
+	rows, err := this.query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			l		= &HostLink{}
+			first, last	int64
+		)
+
+		if err := rows.Scan(&l.Fingerprint, &l.HostName, &first, &last); err != nil {
+			return nil, err
+		}
+
+		l.FirstSeen, l.LastSeen = time.Unix(0, first), time.Unix(0, last)
+		hl = append(hl, l)
+	}
+
+	return hl, rows.Err()
+}
+
+// query runs a query after rebinding its parameters for the dialect.
+func (this *SQLStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.DB.Query(this.Dialect.Rebind(query), args...)
+}
+
+// exec runs a statement in a transaction after rebinding its parameters
+// for the dialect.
+func (this *SQLStore) exec(tx *sql.Tx, query string, args ...interface{}) (error) {
+	_, err := tx.Exec(this.Dialect.Rebind(query), args...)
+	return err
+}
+
+// tx runs a function in a transaction, committing if it succeeds and
+// rolling back otherwise.
+func (this *SQLStore) tx(fn func(*sql.Tx) (error)) (error) {
+
+	tx, err := this.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// where returns a WHERE clause and its arguments that select the records
+// a filter may match. Exact values are compared for equality, and glob
+// patterns using only '*' and '?' become LIKE conditions; patterns with
+// character classes or escapes are left to Filter.Match, which is still
+// applied to every selected record.
+func where(f *usb.Filter) (string, []interface{}) {
+
+	if f == nil {
+		return ``, nil
+	}
+
+	var (
+		conds	[]string
+		args	[]interface{}
+	)
+
+	for _, c := range []struct{ col, pattern string }{
+		{`host_name`, f.HostName},
+		{`vendor_id`, f.VendorID},
+		{`product_id`, f.ProductID},
+		{`serial_num`, f.SerialNum},
+		{`object_type`, f.ObjectType},
+	} {
+		switch {
+
+		case c.pattern == ``, strings.ContainsAny(c.pattern, `[\`):
+
+		case !strings.ContainsAny(c.pattern, `*?`):
+			conds = append(conds, c.col + ` = ?`)
+			args = append(args, c.pattern)
+
+		default:
+			conds = append(conds, c.col + ` LIKE ? ESCAPE '\'`)
+			args = append(args, likePattern.Replace(c.pattern))
+		}
+	}
+
+	if len(conds) == 0 {
+		return ``, nil
+	}
+
+	return ` WHERE ` + strings.Join(conds, ` AND `), args
+}
+
+// likePattern converts a glob pattern without character classes or
+// escapes to a LIKE pattern with '\' as the escape character.
+var likePattern = strings.NewReplacer(
+	`%`, `\%`,
+	`_`, `\_`,
+	`*`, `%`,
+	`?`, `_`,
+)
+
+// statements splits a migration into individual statements, since not
+// every driver accepts several statements in one call.
+func statements(s string) (stmts []string) {
+
+	for _, stmt := range strings.Split(s, `;`) {
+		if stmt = strings.TrimSpace(stmt); stmt != `` {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	return stmts
+}
@@ -0,0 +1,554 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	`database/sql`
+	`fmt`
+	`os`
+	`path/filepath`
+	`sync`
+	`testing`
+	`time`
+
+	_ `github.com/lib/pq`
+	_ `github.com/mattn/go-sqlite3`
+	`github.com/jscherff/cmdb/meta/peripheral/usb`
+)
+
+// postgresDSNVar names the environment variable holding the DSN of a
+// scratch PostgreSQL database. PostgreSQL tests are skipped without it.
+const postgresDSNVar = `CMDB_TEST_POSTGRES_DSN`
+
+// testDatabases are the databases the SQL store is tested against. Each
+// opens an empty database for a test.
+var testDatabases = []struct {
+	name		string
+	open		func(*testing.T) (*sql.DB, *Dialect)
+}{
+	{`sqlite`, openSQLite},
+	{`postgres`, openPostgres},
+}
+
+// requireSQLite skips a test if the SQLite driver is unusable. The tests
+// use github.com/mattn/go-sqlite3, which registers the driver name
+// 'sqlite3' and needs cgo; DialectFor maps that name, like the 'sqlite'
+// name of modernc.org/sqlite, to the SQLite dialect.
+func requireSQLite(t *testing.T) {
+
+	db, err := sql.Open(`sqlite3`, `:memory:`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		t.Skipf(`sqlite3 driver unavailable, cgo is required: %v`, err)
+	}
+}
+
+// openSQLite opens an in-memory SQLite database. Every connection to
+// ':memory:' is a separate database, so the pool is limited to one.
+func openSQLite(t *testing.T) (*sql.DB, *Dialect) {
+
+	requireSQLite(t)
+
+	db, err := sql.Open(`sqlite3`, `:memory:`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	d, err := DialectFor(`sqlite3`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, d
+}
+
+// openPostgres opens the scratch PostgreSQL database and drops the
+// store's tables when the test ends.
+func openPostgres(t *testing.T) (*sql.DB, *Dialect) {
+
+	dsn := os.Getenv(postgresDSNVar)
+
+	if dsn == `` {
+		t.Skipf(`%s not set`, postgresDSNVar)
+	}
+
+	db, err := sql.Open(`postgres`, dsn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drop := func() {
+		db.Exec(`DROP TABLE IF EXISTS idempotency, changes, device_hosts,
+			device_history, devices, hosts, schema_version CASCADE`)
+	}
+
+	drop()
+
+	t.Cleanup(func() { drop(); db.Close() })
+
+	return db, PostgreSQL
+}
+
+// testRecord returns a device record with a given fingerprint, host,
+// vendor and product IDs and serial number.
+func testRecord(fp, host, vid, pid, sn string) (*usb.DeviceInfo) {
+
+	return &usb.DeviceInfo{
+		Fingerprint:	fp,
+		HostName:	host,
+		VendorID:	vid,
+		ProductID:	pid,
+		SerialNum:	sn,
+		ObjectType:	`*usb.Generic`,
+	}
+}
+
+// testStore opens a migrated store on a database and stores a fixed set
+// of records, in order.
+func testStore(t *testing.T, open func(*testing.T) (*sql.DB, *Dialect)) (*SQLStore) {
+
+	db, d := open(t)
+
+	this, err := NewSQLStore(db, d)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, di := range []*usb.DeviceInfo{
+		testRecord(`fp-a`, `host1`, `0801`, `0001`, `S1`),
+		testRecord(`fp-b`, `host1`, `0acd`, `2030`, `S2`),
+		testRecord(`fp-c`, `host2`, `0801`, `0001`, `S1`),
+		testRecord(`fp-d`, `host2`, `0801`, `0002`, ``),
+		testRecord(`fp-e`, `host_3`, `0801`, `0003`, `S%`),
+	} {
+		if err := this.Put(di); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return this
+}
+
+func TestSQLStoreMigrate(t *testing.T) {
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			db, d := tdb.open(t)
+
+			for i := 0; i < 2; i++ {
+
+				s, err := NewSQLStore(db, d)
+
+				if err != nil {
+					t.Fatalf(`migration %d: %v`, i + 1, err)
+				}
+
+				if v, err := s.Version(); err != nil {
+					t.Fatal(err)
+				} else if v != len(d.Migrations) {
+					t.Errorf(`version %d, want %d`, v, len(d.Migrations))
+				}
+			}
+		})
+	}
+}
+
+func TestSQLStoreMigrateConcurrent(t *testing.T) {
+
+	requireSQLite(t)
+
+	fn := filepath.Join(t.TempDir(), `cmdb.db`)
+
+	var (
+		wg	sync.WaitGroup
+		errs	= make([]error, 4)
+	)
+
+	for i := range errs {
+
+		db, err := sql.Open(`sqlite3`, fn + `?_busy_timeout=10000`)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.Close()
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = NewSQLStore(db, SQLite)
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf(`server %d: %v`, i, err)
+		}
+	}
+
+	db, err := sql.Open(`sqlite3`, fn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var n int
+
+	if err := db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != len(SQLite.Migrations) {
+		t.Errorf(`%d migrations recorded, want %d`, n, len(SQLite.Migrations))
+	}
+}
+
+func TestSQLStoreGet(t *testing.T) {
+
+	tests := []struct {
+		fp		string
+		host		string
+		err		error
+	}{
+		{`fp-a`, `host1`, nil},
+		{`fp-d`, `host2`, nil},
+		{`fp-x`, ``, usb.ErrNotFound},
+	}
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			s := testStore(t, tdb.open)
+
+			for _, tt := range tests {
+
+				di, err := s.Get(tt.fp)
+
+				switch {
+				case err != tt.err:
+					t.Errorf(`Get(%q): error %v, want %v`, tt.fp, err, tt.err)
+				case err == nil && (di.Fingerprint != tt.fp || di.HostName != tt.host):
+					t.Errorf(`Get(%q): got %s on %s`, tt.fp, di.Fingerprint, di.HostName)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLStoreGetBySerial(t *testing.T) {
+
+	tests := []struct {
+		sn		string
+		fp		string
+		err		error
+	}{
+		{`S1`, `fp-c`, nil},
+		{`S2`, `fp-b`, nil},
+		{`S%`, `fp-e`, nil},
+		{`S9`, ``, usb.ErrNotFound},
+		{``, ``, usb.ErrNotFound},
+	}
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			s := testStore(t, tdb.open)
+
+			for _, tt := range tests {
+
+				di, err := s.GetBySerial(tt.sn)
+
+				switch {
+				case err != tt.err:
+					t.Errorf(`GetBySerial(%q): error %v, want %v`, tt.sn, err, tt.err)
+				case err == nil && di.Fingerprint != tt.fp:
+					t.Errorf(`GetBySerial(%q): got %s, want %s`, tt.sn, di.Fingerprint, tt.fp)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLStoreList(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		filter		*usb.Filter
+		want		string
+	}{
+		{`nil`, nil, `[fp-a fp-b fp-c fp-d fp-e]`},
+		{`empty`, &usb.Filter{}, `[fp-a fp-b fp-c fp-d fp-e]`},
+		{`host`, &usb.Filter{HostName: `host1`}, `[fp-a fp-b]`},
+		{`host case`, &usb.Filter{HostName: `HOST1`}, `[]`},
+		{`vendor`, &usb.Filter{VendorID: `0801`}, `[fp-a fp-c fp-d fp-e]`},
+		{`serial`, &usb.Filter{SerialNum: `S1`}, `[fp-a fp-c]`},
+		{`vendor and product`, &usb.Filter{VendorID: `0801`, ProductID: `0001`}, `[fp-a fp-c]`},
+		{`star`, &usb.Filter{HostName: `host*`}, `[fp-a fp-b fp-c fp-d fp-e]`},
+		{`question`, &usb.Filter{ProductID: `000?`}, `[fp-a fp-c fp-d fp-e]`},
+		{`class`, &usb.Filter{HostName: `host[2-9]`}, `[fp-c fp-d]`},
+		{`literal underscore`, &usb.Filter{HostName: `host_*`}, `[fp-e]`},
+		{`literal percent`, &usb.Filter{SerialNum: `S%`}, `[fp-e]`},
+		{`escape`, &usb.Filter{SerialNum: `S\%`}, `[fp-e]`},
+		{`no match`, &usb.Filter{ObjectType: `*usb.Magtek`}, `[]`},
+	}
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			s := testStore(t, tdb.open)
+
+			for _, tt := range tests {
+
+				dis, err := s.List(tt.filter)
+
+				if err != nil {
+					t.Errorf(`%s: %v`, tt.name, err)
+					continue
+				}
+
+				fps := []string{}
+
+				for _, di := range dis {
+					fps = append(fps, di.Fingerprint)
+				}
+
+				if got := fmt.Sprint(fps); got != tt.want {
+					t.Errorf(`%s: got %s, want %s`, tt.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLStoreHistory(t *testing.T) {
+
+	tests := []struct {
+		fp		string
+		want		[]string
+		err		error
+	}{
+		{`fp-a`, []string{`host1`, `host9`}, nil},
+		{`fp-b`, []string{`host1`}, nil},
+		{`fp-x`, nil, usb.ErrNotFound},
+	}
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			s := testStore(t, tdb.open)
+
+			if err := s.Put(testRecord(`fp-a`, `host9`, `0801`, `0001`, `S1`)); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, tt := range tests {
+
+				revs, err := s.History(tt.fp)
+
+				if err != tt.err {
+					t.Errorf(`History(%q): error %v, want %v`, tt.fp, err, tt.err)
+					continue
+				}
+
+				hosts := []string{}
+
+				for _, rev := range revs {
+					hosts = append(hosts, rev.Device.HostName)
+				}
+
+				if got, want := fmt.Sprint(hosts), fmt.Sprint(tt.want); tt.err == nil && got != want {
+					t.Errorf(`History(%q): got %s, want %s`, tt.fp, got, want)
+				}
+			}
+
+			if di, err := s.Get(`fp-a`); err != nil {
+				t.Fatal(err)
+			} else if di.HostName != `host9` {
+				t.Errorf(`Get after update: host %s, want host9`, di.HostName)
+			}
+		})
+	}
+}
+
+func TestSQLStoreChanges(t *testing.T) {
+
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	changes := usb.Changes{
+		&usb.Change{Field: `FirmwareVer`, OldValue: `1.0`, NewValue: `1.1`, DetectedAt: t0,
+			Source: `store:fp-a`, Collector: `host1`, Severity: usb.SeverityInfo},
+		&usb.Change{Field: `SerialNum`, OldValue: `S1`, NewValue: `S9`, DetectedAt: t0.Add(time.Hour),
+			Source: `store:fp-a`, Collector: `host1`, Severity: usb.SeverityAlert},
+		&usb.Change{Field: `ProductVer`, OldValue: ``, NewValue: `2`, DetectedAt: t0.Add(2 * time.Hour),
+			Source: `store:fp-a`, Collector: `host1`},
+	}
+
+	tests := []struct {
+		fp		string
+		since		time.Time
+		want		[]string
+	}{
+		{`fp-a`, time.Time{}, []string{`FirmwareVer`, `SerialNum`, `ProductVer`}},
+		{`fp-a`, t0.Add(time.Hour), []string{`SerialNum`, `ProductVer`}},
+		{`fp-a`, t0.Add(3 * time.Hour), []string{}},
+		{`fp-b`, time.Time{}, []string{}},
+	}
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			s := testStore(t, tdb.open)
+
+			if err := s.PutChanges(`fp-a`, changes); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PutChanges(`../fp-a`, changes); err == nil {
+				t.Errorf(`PutChanges with invalid key: expected error`)
+			}
+
+			for _, tt := range tests {
+
+				c, err := s.Changes(tt.fp, tt.since)
+
+				if err != nil {
+					t.Errorf(`Changes(%q, %s): %v`, tt.fp, tt.since, err)
+					continue
+				}
+
+				fields := []string{}
+
+				for _, ch := range c {
+					fields = append(fields, ch.Field)
+				}
+
+				if got, want := fmt.Sprint(fields), fmt.Sprint(tt.want); got != want {
+					t.Errorf(`Changes(%q, %s): got %s, want %s`, tt.fp, tt.since, got, want)
+				}
+			}
+
+			c, err := s.Changes(`fp-a`, time.Time{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, ch := range c {
+
+				want := *changes[i]
+				got := *ch
+
+				if !got.DetectedAt.Equal(want.DetectedAt) {
+					t.Errorf(`change %d: detected %s, want %s`, i, got.DetectedAt, want.DetectedAt)
+				}
+
+				got.DetectedAt, want.DetectedAt = time.Time{}, time.Time{}
+
+				if got != want {
+					t.Errorf(`change %d: got %+v, want %+v`, i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLStoreHostLinks(t *testing.T) {
+
+	for _, tdb := range testDatabases {
+
+		t.Run(tdb.name, func(t *testing.T) {
+
+			s := testStore(t, tdb.open)
+
+			if err := s.Put(testRecord(`fp-a`, `host9`, `0801`, `0001`, `S1`)); err != nil {
+				t.Fatal(err)
+			}
+
+			hosts := func(hl []*HostLink) (ss []string) {
+				ss = []string{}
+				for _, l := range hl {
+					ss = append(ss, l.HostName)
+				}
+				return ss
+			}
+
+			fps := func(hl []*HostLink) (ss []string) {
+				ss = []string{}
+				for _, l := range hl {
+					ss = append(ss, l.Fingerprint)
+				}
+				return ss
+			}
+
+			tests := []struct {
+				name		string
+				get		func() ([]*HostLink, error)
+				key		func([]*HostLink) ([]string)
+				want		string
+			}{
+				{`hosts of moved device`, func() ([]*HostLink, error) { return s.Hosts(`fp-a`) }, hosts, `[host9 host1]`},
+				{`hosts of device`, func() ([]*HostLink, error) { return s.Hosts(`fp-c`) }, hosts, `[host2]`},
+				{`hosts of unknown device`, func() ([]*HostLink, error) { return s.Hosts(`fp-x`) }, hosts, `[]`},
+				{`devices of host`, func() ([]*HostLink, error) { return s.Devices(`host1`) }, fps, `[fp-b fp-a]`},
+				{`devices of new host`, func() ([]*HostLink, error) { return s.Devices(`host9`) }, fps, `[fp-a]`},
+				{`devices of pattern`, func() ([]*HostLink, error) { return s.Devices(`host*`) }, fps, `[]`},
+				{`devices of unknown host`, func() ([]*HostLink, error) { return s.Devices(`hostx`) }, fps, `[]`},
+			}
+
+			for _, tt := range tests {
+
+				hl, err := tt.get()
+
+				if err != nil {
+					t.Errorf(`%s: %v`, tt.name, err)
+					continue
+				}
+
+				if got := fmt.Sprint(tt.key(hl)); got != tt.want {
+					t.Errorf(`%s: got %s, want %s`, tt.name, got, tt.want)
+				}
+
+				for _, l := range hl {
+					if l.LastSeen.Before(l.FirstSeen) {
+						t.Errorf(`%s: %s on %s last seen before first seen`, tt.name, l.Fingerprint, l.HostName)
+					}
+				}
+			}
+		})
+	}
+}